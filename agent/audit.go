@@ -0,0 +1,44 @@
+package main
+
+import (
+	"agent/config"
+	"agent/core"
+	"agent/logger"
+	"flag"
+)
+
+// runAudit 实现 audit 子命令，目前只有 verify：校验审计日志的哈希链是否完整。
+// 末尾的记录被整体删除时校验仍会通过，应与另行留存的记录数比对。
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		logger.Error("用法: agent audit verify [-config config.yaml] [-dir 审计日志目录]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "配置文件路径")
+	dir := flags.String("dir", "", "审计日志目录, 为空时使用配置中的 audit.dir")
+	flags.Parse(args[1:])
+
+	if err := logger.Init(); err != nil {
+		panic("初始化日志失败: " + err.Error())
+	}
+	defer logger.Close()
+
+	if *dir == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			logger.Error("加载配置失败: ", err)
+			return 1
+		}
+		*dir = cfg.Audit.Dir
+	}
+
+	count, err := core.VerifyAuditLog(*dir)
+	if err != nil {
+		logger.Error("审计日志校验失败 (前", count, "条记录有效):", err)
+		return 1
+	}
+	logger.Info("审计日志校验通过, 共", count, "条记录")
+	return 0
+}
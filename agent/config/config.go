@@ -11,18 +11,82 @@ type Config struct {
 		Address         string   `yaml:"address"`
 		BackupAddresses []string `yaml:"backup_addresses"`
 		Port           int      `yaml:"port"`
-		Protocol       string   `yaml:"protocol"` // ipv4, ipv6, auto
+		Protocol       string   `yaml:"protocol"` // ipv4, ipv6, auto（happy eyeballs）
+		Codec          string   `yaml:"codec"`    // 负载编码格式: json, msgpack, protobuf
+		Compression    string   `yaml:"compression"`       // 负载压缩算法: none, gzip, zstd，与 Hub 协商后启用
+		CompressThreshold int   `yaml:"compressThreshold"` // 负载不小于该字节数时才压缩，默认 512
+		TLS struct {
+			Enabled    bool   `yaml:"enabled"`
+			CA         string `yaml:"ca"`         // CA 证书（PEM），为空时使用系统根证书
+			Cert       string `yaml:"cert"`       // mTLS 客户端证书（PEM）
+			Key        string `yaml:"key"`        // mTLS 客户端私钥（PEM）
+			ServerName string `yaml:"serverName"` // 校验证书时使用的服务器名称，默认为连接地址
+			MinVersion string `yaml:"minVersion"` // TLS 最低版本: 1.2, 1.3，默认 1.2
+			Pin        string `yaml:"pin"`        // 可选的 Hub 证书 SPKI pin: sha256/<base64>
+		} `yaml:"tls"`
+		Signing struct {
+			Mode      string `yaml:"mode"`      // 是否要求 Hub 对下发的帧签名: off, required
+			Algorithm string `yaml:"algorithm"` // 签名算法: hmac（由 auth.key 派生会话密钥）, ed25519
+			PublicKey string `yaml:"publicKey"` // Hub 的 Ed25519 公钥（base64）
+			Window    int    `yaml:"window"`    // 防重放窗口（帧），默认 64
+		} `yaml:"signing"`
+		Encryption struct {
+			Mode      string `yaml:"mode"`      // 负载加密: off, preferred（Hub 支持时加密，可被降级为明文）, required（唯一能防止降级的模式）
+			PublicKey string `yaml:"publicKey"` // Hub 的 X25519 公钥（base64），为空时使用注册时 Hub 下发的公钥
+		} `yaml:"encryption"`
+		Failover struct {
+			Strategy      string `yaml:"strategy"`      // 地址选择策略: priority（默认）, round_robin, random, sticky
+			ProbeInterval int    `yaml:"probeInterval"` // 连接到备用地址时探测主地址的间隔（秒），0 表示不切换回主地址
+		} `yaml:"failover"`
+		Discovery struct {
+			Mode        string   `yaml:"mode"`        // Hub 地址发现: off, srv（SRV 记录）, dns（hub.address 的所有 A/AAAA 记录）
+			Name        string   `yaml:"name"`        // SRV 记录名，默认 _pbm._tcp.<hub.address>
+			Nameservers []string `yaml:"nameservers"` // DNS 服务器，为空时使用 /etc/resolv.conf 中的服务器
+		} `yaml:"discovery"`
+		Proxy struct {
+			URL      string   `yaml:"url"`      // 代理地址: http://, https://, socks5://, socks5h://；为空时使用 HTTPS_PROXY/ALL_PROXY 环境变量，none 表示不使用代理
+			Username string   `yaml:"username"` // 代理认证用户名，优先于 URL 中的用户信息
+			Password string   `yaml:"password"`
+			NoProxy  []string `yaml:"noProxy"`  // 直接连接的主机名、域名后缀、IP 或 CIDR，为空时使用 NO_PROXY 环境变量
+		} `yaml:"proxy"`
+		Transport string `yaml:"transport"` // 传输方式: tcp（默认）, websocket, auto（TCP 连续失败后改用 WebSocket）
+		WebSocket struct {
+			Path string `yaml:"path"` // WebSocket 路径，默认 /agent
+			Port int    `yaml:"port"` // WebSocket 端口，0 表示与 hub.port 相同
+		} `yaml:"websocket"`
 	} `yaml:"hub"`
 	Auth struct {
-		Key string `yaml:"key"`
+		Key               string `yaml:"key"`
+		AllowPlaintextKey *bool  `yaml:"allowPlaintextKey"` // Hub 不支持挑战-应答认证时是否允许明文发送密钥，未设置时只对不回复握手的旧版 Hub 允许
+		EnrollToken       string `yaml:"enrollToken"`       // 一次性注册令牌，首次连接时换取 Agent 专属凭据
+		CredentialDir     string `yaml:"credentialDir"`     // 专属凭据保存目录，默认 data/credentials
 	} `yaml:"auth"`
 	Agent struct {
 		Alias              string `yaml:"alias"`              // Agent 别名
 		SystemInfoInterval int    `yaml:"systemInfoInterval"` // 系统信息上报间隔（秒）
 		StaticInfoInterval int    `yaml:"staticInfoInterval"` // 静态信息重新上报时间（小时）
 		HeartbeatInterval int    `yaml:"heartbeatInterval"`  // 心跳间隔（秒）
-		ReconnectInterval int    `yaml:"reconnectInterval"`  // 重连间隔（秒）
+		HeartbeatMisses   int    `yaml:"heartbeatMisses"`    // 连续未收到心跳回显的次数达到该值时判定 Hub 失联，默认 3
+		ReconnectInterval int    `yaml:"reconnectInterval"`  // 重连初始间隔（秒），连续失败时指数增长
+		ReconnectMaxInterval int `yaml:"reconnectMaxInterval"` // 重连间隔上限（秒），默认 300
+		SendQueueSize      int    `yaml:"sendQueueSize"`      // 发送队列容量（条），默认 256
+		MaxFrameSize       int    `yaml:"maxFrameSize"`       // 单帧负载上限（KB），默认 1024
 	} `yaml:"agent"`
+	Outbox struct {
+		Enabled bool   `yaml:"enabled"` // 是否启用离线缓存
+		Dir     string `yaml:"dir"`     // 缓存目录，默认 data/outbox
+		MaxSize int    `yaml:"maxSize"` // 容量上限（MB）
+		MaxAge  int    `yaml:"maxAge"`  // 记录保留时长（小时）
+	} `yaml:"outbox"`
+	Ack struct {
+		Enabled    bool `yaml:"enabled"`    // 是否为上报消息附带 ID 并等待 Hub 确认
+		Window     int  `yaml:"window"`     // 最多未确认消息数
+		RetryLimit int  `yaml:"retryLimit"` // 单条消息最多重传次数
+	} `yaml:"ack"`
+	Audit struct {
+		Enabled bool   `yaml:"enabled"` // 是否将 Hub 下发的指令记入审计日志
+		Dir     string `yaml:"dir"`     // 审计日志目录，默认 data/audit
+	} `yaml:"audit"`
 	Log struct {
 		Level string `yaml:"level"`
 		Path  string `yaml:"path"`
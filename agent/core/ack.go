@@ -0,0 +1,240 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrAckWindowFull = errors.New("未确认消息数已达窗口上限")
+	// ErrAckRequeued 表示离线缓存消息在重连时移出待确认列表，由 outboxLoop 从游标处重新投递
+	ErrAckRequeued = errors.New("消息将从离线缓存重新投递")
+	// ErrAckGaveUp 表示消息超过重试次数，已放弃投递
+	ErrAckGaveUp = errors.New("消息超过重试次数")
+)
+
+const (
+	defaultAckWindow     = 64
+	defaultAckRetryLimit = 5
+)
+
+// pendingMessage 是已发送但尚未被 Hub 确认的消息
+type pendingMessage struct {
+	msg     *protocol.Message
+	retries int
+	acked   bool
+	err     error           // 放弃投递的原因，acked 为 true 时有效
+	outbox  bool            // 来自离线缓存，重连后由 outboxLoop 重新投递
+	onAck   func()          // 确认后回调，按消息 ID 顺序触发
+	onFail  func(err error) // 放弃投递或移出待确认列表时回调，与 onAck 互斥
+}
+
+// done 返回消息移出待确认列表时应调用的回调，可为 nil
+func (p *pendingMessage) done() func() {
+	if p.err != nil {
+		if p.onFail == nil {
+			return nil
+		}
+		err, onFail := p.err, p.onFail
+		return func() { onFail(err) }
+	}
+	return p.onAck
+}
+
+// ackTracker 为需要确认的消息分配递增 ID，并在断线重连或收到 NACK 后重传
+type ackTracker struct {
+	mutex      sync.Mutex
+	nextID     uint64
+	pending    map[uint64]*pendingMessage
+	window     int
+	retryLimit int
+	space      chan struct{}
+}
+
+func newAckTracker(window, retryLimit int) *ackTracker {
+	if window <= 0 {
+		window = defaultAckWindow
+	}
+	if retryLimit <= 0 {
+		retryLimit = defaultAckRetryLimit
+	}
+	return &ackTracker{
+		nextID:     1,
+		pending:    make(map[uint64]*pendingMessage),
+		window:     window,
+		retryLimit: retryLimit,
+		space:      make(chan struct{}, 1),
+	}
+}
+
+// track 为消息分配 ID 并记录为待确认，窗口已满时返回 ErrAckWindowFull。
+// 消息移出待确认列表时恰好调用 onAck 与 onFail 之一。
+func (t *ackTracker) track(msg *protocol.Message, outbox bool, onAck func(), onFail func(error)) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.pending) >= t.window {
+		return ErrAckWindowFull
+	}
+	msg.Header.ID = t.nextID
+	t.nextID++
+	t.pending[msg.Header.ID] = &pendingMessage{msg: msg, outbox: outbox, onAck: onAck, onFail: onFail}
+	return nil
+}
+
+// wait 阻塞直到窗口有空位或 done 关闭，返回是否可以继续发送
+func (t *ackTracker) wait(done <-chan struct{}) bool {
+	for {
+		t.mutex.Lock()
+		full := len(t.pending) >= t.window
+		t.mutex.Unlock()
+		if !full {
+			return true
+		}
+		select {
+		case <-done:
+			return false
+		case <-t.space:
+		}
+	}
+}
+
+// ack 标记消息已确认，并按 ID 顺序释放连续已确认的消息
+func (t *ackTracker) ack(ids []uint64) {
+	t.mutex.Lock()
+	for _, id := range ids {
+		if p, exists := t.pending[id]; exists {
+			p.acked = true
+		}
+	}
+	callbacks := t.releaseLocked()
+	t.mutex.Unlock()
+
+	runCallbacks(callbacks)
+}
+
+// nack 返回需要立即重传的消息，超过重试次数的消息被丢弃
+func (t *ackTracker) nack(ids []uint64, reason string) []*protocol.Message {
+	t.mutex.Lock()
+	var resend []*protocol.Message
+	for _, id := range ids {
+		p, exists := t.pending[id]
+		if !exists || p.acked {
+			continue
+		}
+		p.retries++
+		if p.retries > t.retryLimit {
+			logger.Error("消息被拒绝且超过重试次数, 放弃投递:", p.msg.Header.Type, "ID:", id, "原因:", reason)
+			t.giveUpLocked(p)
+			continue
+		}
+		logger.Warn("消息被拒绝, 准备重传:", p.msg.Header.Type, "ID:", id, "原因:", reason)
+		resend = append(resend, p.msg)
+	}
+	callbacks := t.releaseLocked()
+	t.mutex.Unlock()
+
+	runCallbacks(callbacks)
+	return resend
+}
+
+// evicted 处理被挤出发送队列的消息：计一次重试并返回需要重新发送的消息，超过重试次数时放弃
+func (t *ackTracker) evicted(id uint64) *protocol.Message {
+	t.mutex.Lock()
+	p, exists := t.pending[id]
+	if !exists || p.acked {
+		t.mutex.Unlock()
+		return nil
+	}
+	p.retries++
+	if p.retries <= t.retryLimit {
+		t.mutex.Unlock()
+		return p.msg
+	}
+	logger.Error("消息多次被挤出发送队列, 放弃投递:", p.msg.Header.Type, "ID:", id)
+	t.giveUpLocked(p)
+	callbacks := t.releaseLocked()
+	t.mutex.Unlock()
+
+	runCallbacks(callbacks)
+	return nil
+}
+
+// giveUpLocked 放弃投递 p，p 按 ID 顺序移出待确认列表时调用 onFail
+func (t *ackTracker) giveUpLocked(p *pendingMessage) {
+	p.acked = true
+	p.err = ErrAckGaveUp
+}
+
+func runCallbacks(callbacks []func()) {
+	for _, cb := range callbacks {
+		cb()
+	}
+}
+
+// releaseLocked 从最小 ID 开始移除连续的已确认消息，返回其回调
+func (t *ackTracker) releaseLocked() []func() {
+	ids := t.sortedIDsLocked()
+	var callbacks []func()
+	for _, id := range ids {
+		p := t.pending[id]
+		if !p.acked {
+			break
+		}
+		delete(t.pending, id)
+		if cb := p.done(); cb != nil {
+			callbacks = append(callbacks, cb)
+		}
+	}
+	if len(callbacks) > 0 || len(t.pending) < t.window {
+		notify(t.space)
+	}
+	return callbacks
+}
+
+// reconnected 在新连接建立后调用，返回需要按 ID 顺序重传的消息。
+// 来自离线缓存的消息以 ErrAckRequeued 移除，由 outboxLoop 从游标处重新投递；
+// 被更早的消息挡住的已确认消息在此一并完成。
+func (t *ackTracker) reconnected() []*protocol.Message {
+	t.mutex.Lock()
+	var resend []*protocol.Message
+	var callbacks []func()
+	for _, id := range t.sortedIDsLocked() {
+		p := t.pending[id]
+		switch {
+		case p.outbox:
+			// 离线缓存的游标只能按序推进，已确认或已放弃的记录同样交由 outboxLoop 重新投递
+			p.err = ErrAckRequeued
+		case p.acked:
+		default:
+			p.retries++
+			if p.retries <= t.retryLimit {
+				resend = append(resend, p.msg)
+				continue
+			}
+			logger.Error("消息超过重试次数, 放弃投递:", p.msg.Header.Type, "ID:", id)
+			t.giveUpLocked(p)
+		}
+		delete(t.pending, id)
+		if cb := p.done(); cb != nil {
+			callbacks = append(callbacks, cb)
+		}
+	}
+	notify(t.space)
+	t.mutex.Unlock()
+
+	runCallbacks(callbacks)
+	return resend
+}
+
+func (t *ackTracker) sortedIDsLocked() []uint64 {
+	ids := make([]uint64, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"agent/protocol"
+	"errors"
+	"testing"
+)
+
+// ackRecorder 记录每条消息的完成方式
+type ackRecorder map[string]string
+
+func (r ackRecorder) track(t *testing.T, tracker *ackTracker, name string, outbox bool) *protocol.Message {
+	msg := protocol.NewMessage(protocol.MessageTypeTaskResult, name)
+	err := tracker.track(msg, outbox, func() { r[name] = "acked" }, func(err error) {
+		switch {
+		case errors.Is(err, ErrAckRequeued):
+			r[name] = "requeued"
+		case errors.Is(err, ErrAckGaveUp):
+			r[name] = "gave up"
+		default:
+			r[name] = err.Error()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestAckTrackerCallbacks(t *testing.T) {
+	tests := []struct {
+		name       string
+		run        func(tracker *ackTracker, ids map[string]uint64) int // 返回重传的消息数
+		want       ackRecorder
+		wantResend int
+	}{
+		{
+			name: "ack in order",
+			run: func(tracker *ackTracker, ids map[string]uint64) int {
+				tracker.ack([]uint64{ids["b"]})
+				tracker.ack([]uint64{ids["a"]})
+				return 0
+			},
+			want: ackRecorder{"a": "acked", "b": "acked"},
+		},
+		{
+			name: "reconnect completes every entry",
+			run: func(tracker *ackTracker, ids map[string]uint64) int {
+				// b 已确认但被 a 挡住；c、d 不是离线缓存消息，d 重连后重传
+				tracker.ack([]uint64{ids["b"], ids["c"]})
+				return len(tracker.reconnected())
+			},
+			want:       ackRecorder{"a": "requeued", "b": "requeued", "c": "acked"},
+			wantResend: 1,
+		},
+		{
+			name: "nack gives up after retry limit",
+			run: func(tracker *ackTracker, ids map[string]uint64) int {
+				n := 0
+				for i := 0; i < 3; i++ {
+					n += len(tracker.nack([]uint64{ids["a"]}, "test"))
+				}
+				return n
+			},
+			want:       ackRecorder{"a": "gave up"},
+			wantResend: 2,
+		},
+		{
+			name: "eviction resends then gives up",
+			run: func(tracker *ackTracker, ids map[string]uint64) int {
+				n := 0
+				for i := 0; i < 3; i++ {
+					if tracker.evicted(ids["d"]) != nil {
+						n++
+					}
+				}
+				tracker.ack([]uint64{ids["a"], ids["b"], ids["c"]})
+				return n
+			},
+			want:       ackRecorder{"a": "acked", "b": "acked", "c": "acked", "d": "gave up"},
+			wantResend: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newAckTracker(8, 2)
+			got := ackRecorder{}
+			ids := map[string]uint64{}
+			for _, m := range []struct {
+				name   string
+				outbox bool
+			}{{"a", true}, {"b", true}, {"c", false}, {"d", false}} {
+				ids[m.name] = got.track(t, tracker, m.name, m.outbox).Header.ID
+			}
+
+			resend := tt.run(tracker, ids)
+			if resend != tt.wantResend {
+				t.Errorf("resend = %d, want %d", resend, tt.wantResend)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s: got %q, want %q", name, got[name], want)
+				}
+			}
+			for name, state := range got {
+				if _, ok := tt.want[name]; !ok {
+					t.Errorf("%s: unexpected completion %q", name, state)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"agent/config"
 	"agent/logger"
 	"agent/plugin"
+	"agent/protocol"
 	"github.com/google/uuid"
 	"os"
 	"path/filepath"
@@ -19,6 +20,7 @@ type Agent struct {
 	cfg       *config.Config
 	client    *Client
 	collector *Collector
+	executor  *TaskExecutor
 	plugins   *plugin.Manager
 	stopWg    sync.WaitGroup
 }
@@ -28,10 +30,16 @@ func NewAgent(cfg *config.Config) *Agent {
 	client := NewClient(cfg)
 	client.SetCollector(collector)
 
+	executor := NewTaskExecutor(client.Report)
+	RegisterBuiltinTaskHandlers(executor, collector)
+	client.SetTaskExecutor(executor)
+	client.AdvertiseFeature(protocol.FeaturePlugins)
+
 	return &Agent{
 		cfg:       cfg,
 		client:    client,
 		collector: collector,
+		executor:  executor,
 		plugins:   plugin.NewManager(),
 	}
 }
@@ -52,6 +60,11 @@ func (a *Agent) Stop() error {
 	// 停止所有插件
 	a.plugins.StopAll()
 
+	// 取消正在执行的任务
+	if err := a.executor.Stop(); err != nil {
+		logger.Error("停止任务执行器失败:", err)
+	}
+
 	// 停止系统信息采集器
 	if err := a.collector.Stop(); err != nil {
 		logger.Error("停止系统信息采集器失败:", err)
@@ -66,6 +79,27 @@ func (a *Agent) Stop() error {
 	return nil
 }
 
+// Client 返回与 Hub 通信的客户端，供插件和任务处理器发起请求
+func (a *Agent) Client() *Client {
+	return a.client
+}
+
+// Done 返回在 Agent 遇到不可重试的错误（如认证被永久拒绝）时关闭的 channel，
+// 调用方应随后调用 Stop 并以非零状态退出
+func (a *Agent) Done() <-chan struct{} {
+	return a.client.Done()
+}
+
+// Err 返回导致 Done 关闭的错误
+func (a *Agent) Err() error {
+	return a.client.Err()
+}
+
+// TaskExecutor 返回任务执行器，供插件注册自定义任务处理器
+func (a *Agent) TaskExecutor() *TaskExecutor {
+	return a.executor
+}
+
 func GetAgentUUID() string {
 	agentUUIDOnce.Do(func() {
 		// 尝试从文件读取 UUID
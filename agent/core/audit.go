@@ -0,0 +1,250 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 审计日志为 JSON Lines 文件，每条记录包含上一条记录的哈希，
+// 修改、删除、插入或调换任意一条记录都会使之后的哈希链校验失败。
+// 哈希链没有密钥也没有外部锚点，截掉末尾的若干条完整记录后剩下的仍是合法的链，无法发现；
+// 需要防范时应将记录数或最后一条记录的哈希另行留存（如上报给 Hub）并与之比对。
+const (
+	auditLogFile = "audit.log"
+	auditGenesis = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+// 消息的处理结果
+const (
+	outcomeApplied   = "applied"   // 已执行
+	outcomeSubmitted = "submitted" // 已提交执行（如任务），最终结果另行上报
+	outcomeDelivered = "delivered" // 已交给等待中的请求或握手流程
+)
+
+func outcomeIgnored(reason string) string { return "ignored: " + reason }
+func outcomeFailed(err error) string      { return "failed: " + err.Error() }
+
+// audited 判断该类型的消息是否记入审计日志：Hub 的指令都需记录，
+// 握手、认证和注册的回复、消息确认及心跳回显不是指令，不记录
+func audited(t protocol.MessageType) bool {
+	switch t {
+	case protocol.MessageTypeAck, protocol.MessageTypeNack,
+		protocol.MessageTypeHello, protocol.MessageTypeAuthOK, protocol.MessageTypeAuthFail,
+		protocol.MessageTypeEnrollOK, protocol.MessageTypeHeartbeat:
+		return false
+	}
+	return true
+}
+
+// AuditRecord 是审计日志中的一条记录
+type AuditRecord struct {
+	Seq           uint64               `json:"seq"`
+	Time          time.Time            `json:"time"`
+	Type          protocol.MessageType `json:"type"`
+	ID            uint64               `json:"id,omitempty"`            // 消息 ID
+	CorrelationID uint64               `json:"correlationId,omitempty"` // 请求/响应关联 ID
+	TaskID        int64                `json:"taskId,omitempty"`
+	Digest        string               `json:"digest"`  // 负载的 SHA-256
+	Signed        bool                 `json:"signed"`  // 帧是否带有（已校验的）签名
+	Outcome       string               `json:"outcome"` // 处理结果
+	Prev          string               `json:"prev"`    // 上一条记录的哈希
+	Hash          string               `json:"hash"`
+}
+
+// computeHash 计算记录的哈希，覆盖除 Hash 外的所有字段
+func (r *AuditRecord) computeHash() (string, error) {
+	unhashed := *r
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog 是只追加的审计日志，每条记录写入后立即落盘
+type AuditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64
+	last  string
+}
+
+func auditDir(dir string) string {
+	if strings.TrimSpace(dir) == "" {
+		return filepath.Join("data", "audit")
+	}
+	return dir
+}
+
+// OpenAuditLog 打开（或创建）dir 下的审计日志并校验已有的哈希链。
+// 进程在写入过程中退出留下的不完整尾部记录会被截断；哈希链已损坏时返回错误，不再追加。
+func OpenAuditLog(dir string) (*AuditLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("创建审计日志目录失败: %v", err)
+	}
+	path := filepath.Join(dir, auditLogFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("打开审计日志失败: %v", err)
+	}
+
+	result, err := verifyAuditChain(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if result.validSize < result.size {
+		logger.Warn("审计日志尾部不完整, 截断至", result.validSize, "字节:", path)
+		if err := file.Truncate(result.validSize); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("截断审计日志失败: %v", err)
+		}
+	}
+
+	logger.Info("审计日志已打开:", path, "记录数:", result.records)
+	return &AuditLog{file: file, seq: result.seq, last: result.last}, nil
+}
+
+// Record 将 msg 及其处理结果追加到审计日志
+func (a *AuditLog) Record(msg *protocol.Message, outcome string) error {
+	rec := &AuditRecord{
+		Time:          time.Now().UTC(),
+		Type:          msg.Header.Type,
+		ID:            msg.Header.ID,
+		CorrelationID: msg.Header.CorrelationID,
+		Digest:        hex.EncodeToString(msg.Digest[:]),
+		Signed:        msg.Signature != nil,
+		Outcome:       outcome,
+	}
+	if task, ok := msg.Payload.(*protocol.TaskRequestPayload); ok {
+		rec.TaskID = task.TaskID
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return errors.New("审计日志已关闭")
+	}
+
+	rec.Seq = a.seq + 1
+	rec.Prev = a.last
+	hash, err := rec.computeHash()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	a.seq = rec.Seq
+	a.last = rec.Hash
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// AuditChainError 描述哈希链校验失败的位置
+type AuditChainError struct {
+	Line   int // 从 1 开始的行号
+	Reason string
+}
+
+func (e *AuditChainError) Error() string {
+	return fmt.Sprintf("审计日志第 %d 行校验失败: %s", e.Line, e.Reason)
+}
+
+// VerifyAuditLog 校验 dir 下审计日志的哈希链，返回有效记录数。
+// 不完整的尾部记录（写入过程中进程退出）不视为篡改；末尾完整记录被删除无法发现，见文件开头的说明。
+func VerifyAuditLog(dir string) (int, error) {
+	file, err := os.Open(filepath.Join(auditDir(dir), auditLogFile))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	result, err := verifyAuditChain(file)
+	return result.records, err
+}
+
+type auditChainResult struct {
+	records   int
+	seq       uint64
+	last      string
+	size      int64 // 文件大小
+	validSize int64 // 最后一条完整记录的结束位置
+}
+
+// verifyAuditChain 从头读取审计日志，逐条校验序号、前驱哈希和记录哈希
+func verifyAuditChain(r io.ReadSeeker) (auditChainResult, error) {
+	result := auditChainResult{last: auditGenesis}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		result.size += int64(len(data))
+		if err == io.EOF {
+			// 没有换行符的尾部是未写完的记录
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		rec := &AuditRecord{}
+		if err := json.Unmarshal(bytes.TrimSpace(data), rec); err != nil {
+			return result, &AuditChainError{Line: line, Reason: "记录格式错误"}
+		}
+		if rec.Seq != result.seq+1 {
+			return result, &AuditChainError{Line: line, Reason: fmt.Sprintf("序号应为 %d, 实际为 %d", result.seq+1, rec.Seq)}
+		}
+		if rec.Prev != result.last {
+			return result, &AuditChainError{Line: line, Reason: "前一条记录的哈希不匹配, 记录可能被删除或插入"}
+		}
+		hash, err := rec.computeHash()
+		if err != nil {
+			return result, err
+		}
+		if hash != rec.Hash {
+			return result, &AuditChainError{Line: line, Reason: "记录哈希不匹配, 记录可能被修改"}
+		}
+
+		result.records++
+		result.seq = rec.Seq
+		result.last = rec.Hash
+		result.validSize = result.size
+	}
+}
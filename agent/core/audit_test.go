@@ -0,0 +1,162 @@
+package core
+
+import (
+	"agent/protocol"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAuditLog 在 dir 下写入 n 条审计记录，返回日志的各行
+func writeAuditLog(t *testing.T, dir string, n int) [][]byte {
+	t.Helper()
+	audit, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		msg := protocol.NewMessage(protocol.MessageTypeTaskRequest, &protocol.TaskRequestPayload{TaskID: int64(i + 1), Type: "ping"})
+		if err := audit.Record(msg, outcomeSubmitted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return readAuditLines(t, dir)
+}
+
+func readAuditLines(t *testing.T, dir string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, auditLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(data, []byte("\n"))
+}
+
+func writeAuditLines(t *testing.T, dir string, lines [][]byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, auditLogFile), bytes.Join(lines, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// editRecord 修改第 i 行的处理结果，rehash 为 true 时同时重新计算该记录的哈希
+func editRecord(t *testing.T, lines [][]byte, i int, rehash bool) {
+	t.Helper()
+	rec := &AuditRecord{}
+	if err := json.Unmarshal(lines[i], rec); err != nil {
+		t.Fatal(err)
+	}
+	rec.Outcome = outcomeIgnored("已篡改")
+	if rehash {
+		hash, err := rec.computeHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Hash = hash
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines[i] = append(data, '\n')
+}
+
+func TestAuditLogRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeAuditLog(t, dir, 3)
+	if n, err := VerifyAuditLog(dir); err != nil || n != 3 {
+		t.Fatalf("VerifyAuditLog = %d, %v, want 3", n, err)
+	}
+
+	// 重新打开后接着原有的哈希链追加
+	lines := writeAuditLog(t, dir, 2)
+	if n, err := VerifyAuditLog(dir); err != nil || n != 5 {
+		t.Fatalf("VerifyAuditLog = %d, %v, want 5", n, err)
+	}
+	rec := &AuditRecord{}
+	if err := json.Unmarshal(lines[3], rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Seq != 4 || rec.TaskID != 1 || rec.Outcome != outcomeSubmitted {
+		t.Fatalf("record = %+v", rec)
+	}
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(t *testing.T, lines [][]byte) [][]byte
+		wantLine int
+	}{
+		{"edited", func(t *testing.T, lines [][]byte) [][]byte {
+			editRecord(t, lines, 1, false)
+			return lines
+		}, 2},
+		{"edited and rehashed", func(t *testing.T, lines [][]byte) [][]byte {
+			editRecord(t, lines, 1, true)
+			return lines
+		}, 3},
+		{"reordered", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 2},
+		{"deleted", func(t *testing.T, lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, 2},
+		{"inserted", func(t *testing.T, lines [][]byte) [][]byte {
+			return append(lines[:2], append([][]byte{lines[0]}, lines[2:]...)...)
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeAuditLines(t, dir, tt.tamper(t, writeAuditLog(t, dir, 4)))
+
+			_, err := VerifyAuditLog(dir)
+			var chainErr *AuditChainError
+			if !errors.As(err, &chainErr) || chainErr.Line != tt.wantLine {
+				t.Fatalf("err = %v, want chain error at line %d", err, tt.wantLine)
+			}
+			// 哈希链已损坏时不再追加
+			if audit, err := OpenAuditLog(dir); err == nil {
+				audit.Close()
+				t.Fatal("OpenAuditLog 应拒绝已损坏的日志")
+			}
+		})
+	}
+}
+
+// TestAuditLogTail 记录哈希链无法发现的情形：哈希链没有密钥也没有外部锚点，
+// 截掉末尾的完整记录后剩下的仍是一条合法的链
+func TestAuditLogTail(t *testing.T) {
+	t.Run("incomplete record", func(t *testing.T) {
+		dir := t.TempDir()
+		lines := writeAuditLog(t, dir, 3)
+		lines[2] = lines[2][:len(lines[2])/2]
+		writeAuditLines(t, dir, lines)
+
+		if n, err := VerifyAuditLog(dir); err != nil || n != 2 {
+			t.Fatalf("VerifyAuditLog = %d, %v, want 2", n, err)
+		}
+		// 打开时截断未写完的记录并接着追加
+		writeAuditLog(t, dir, 1)
+		if n, err := VerifyAuditLog(dir); err != nil || n != 3 {
+			t.Fatalf("VerifyAuditLog = %d, %v, want 3", n, err)
+		}
+	})
+
+	t.Run("truncated undetected", func(t *testing.T) {
+		dir := t.TempDir()
+		lines := writeAuditLog(t, dir, 3)
+		writeAuditLines(t, dir, lines[:2])
+		if n, err := VerifyAuditLog(dir); err != nil || n != 2 {
+			t.Fatalf("VerifyAuditLog = %d, %v, want 2", n, err)
+		}
+	})
+}
@@ -4,42 +4,169 @@ import (
 	"agent/config"
 	"agent/logger"
 	"agent/protocol"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	writeTimeout = 10 * time.Second
+	// 连续出现的可恢复解析错误超过该值时断开连接
+	maxFrameErrors = 10
+)
+
 type Client struct {
 	cfg         *config.Config
 	conn        net.Conn
-	parser      *protocol.MessageParser
-	connected   bool
+	addr        string     // 当前连接的 Hub 地址（host:port）
+	queue       *sendQueue // 当前连接的发送队列，由 writeLoop 独占消费
+	encoding    protocol.EncodeOptions // 当前连接的负载编码格式及压缩算法
+	caps        Capabilities                // 最近一次握手协商出的能力
+	control     chan *protocol.Message      // 当前连接上 Hub 的握手及认证回复
+	features    []string                    // 额外通告给 Hub 的功能
+	state       State // 连接状态，见 state.go
+	notifier    stateNotifier
 	mutex       sync.RWMutex
 	reconnect   chan struct{}
 	stop        chan struct{}
 	systemInfo  chan *protocol.SystemInfo
 	staticInfo  chan *protocol.StaticSystemInfo
 	heartbeat   *time.Ticker
-	registered  bool
+	liveness    liveness // 心跳回显及往返时延统计
 	collector   *Collector
+	executor    *TaskExecutor
+	outbox      *Outbox
+	acks        *ackTracker // 未启用消息确认时为 nil
+	requests    *requestRouter
 	stopWg      sync.WaitGroup
 	shutdownOnce sync.Once
+	tlsConfig   *tls.Config // 未启用 TLS 时为 nil
+	credentials *credentialStore
+	credential  *Credential   // 注册后 Hub 签发的专属凭据，未注册时为 nil
+	reenroll    bool          // 忽略已有凭据重新注册
+	enrolled    chan struct{} // 注册成功后关闭
+	enrollOnce  sync.Once
+	pending     *Credential // 轮换中尚未通过认证的新凭据，下一次连接以其尝试
+	pendingTLS  *tls.Config // 新凭据包含证书时使用的 TLS 配置
+	pendingFailures int     // 以新凭据认证失败的次数
+	audit       *AuditLog   // 未启用审计日志时为 nil
+	signing     *signingConfig // 未要求帧签名时为 nil
+	encryption  *encryptionConfig // 未启用负载加密时为 nil
+	exchange    *keyExchange      // 当前连接的密钥交换状态，不加密时为 nil
+	failover    FailoverStrategy
+	resolver    Resolver   // 为 nil 时按 hub.discovery 配置创建
+	discovery   *discovery
+	families    familyCache // 各 Hub 上次连接成功的地址族
+	dialer      Dialer
+	proxy       *proxyDialer // 未使用代理时为 nil
+	transport   *transportSelector
+	received    atomic.Bool // 本次连接尝试是否收到过 Hub 的有效帧
+	backoff     *backoff
+	preferPrimary bool // 已探测到主地址恢复，下一轮优先尝试主地址
+	metrics     clientMetrics
+	failed      chan struct{} // 遇到不可重试的错误后关闭
+	failErr     error
+	failOnce    sync.Once
 }
 
 func NewClient(cfg *config.Config) *Client {
-	return &Client{
+	c := &Client{
 		cfg:        cfg,
-		parser:     protocol.NewMessageParser(),
 		reconnect:  make(chan struct{}, 1), // 使用带缓冲的channel
 		stop:       make(chan struct{}),
+		failed:     make(chan struct{}),
+		enrolled:   make(chan struct{}),
 		systemInfo: make(chan *protocol.SystemInfo, 100),
 		staticInfo: make(chan *protocol.StaticSystemInfo, 10),
+		requests:   newRequestRouter(),
+		backoff: newBackoff(time.Duration(cfg.Agent.ReconnectInterval)*time.Second,
+			time.Duration(cfg.Agent.ReconnectMaxInterval)*time.Second),
+	}
+	if cfg.Ack.Enabled {
+		c.acks = newAckTracker(cfg.Ack.Window, cfg.Ack.RetryLimit)
 	}
+	return c
 }
 
 func (c *Client) Start() error {
 	logger.Info("开始启动客户端连接...")
+	tlsConfig, err := newTLSConfig(c.cfg)
+	if err != nil {
+		return fmt.Errorf("TLS 配置错误: %v", err)
+	}
+	c.tlsConfig = tlsConfig
+	if err := c.loadCredential(); err != nil {
+		return fmt.Errorf("加载凭据失败: %v", err)
+	}
+	signing, err := newSigningConfig(c.cfg, c.signingKey() != "")
+	if err != nil {
+		return fmt.Errorf("帧签名配置错误: %v", err)
+	}
+	c.signing = signing
+	encryption, err := newEncryptionConfig(c.cfg)
+	if err != nil {
+		return fmt.Errorf("负载加密配置错误: %v", err)
+	}
+	c.encryption = encryption
+	if c.failover == nil {
+		failover, err := NewFailoverStrategy(c.cfg.Hub.Failover.Strategy)
+		if err != nil {
+			return fmt.Errorf("故障转移配置错误: %v", err)
+		}
+		c.failover = failover
+	}
+	discovery, err := newDiscovery(c.cfg, c.resolver)
+	if err != nil {
+		return fmt.Errorf("地址发现配置错误: %v", err)
+	}
+	c.discovery = discovery
+	transport, err := newTransportSelector(c.cfg.Hub.Transport)
+	if err != nil {
+		return fmt.Errorf("传输方式配置错误: %v", err)
+	}
+	c.transport = transport
+	if c.dialer == nil {
+		c.dialer = &net.Dialer{}
+	}
+	proxy, err := newProxyDialer(c.cfg, c.dialer)
+	if err != nil {
+		return fmt.Errorf("代理配置错误: %v", err)
+	}
+	if proxy != nil {
+		logger.Info("经由代理连接 Hub:", proxy)
+		c.proxy = proxy
+	}
+	if c.encryption != nil {
+		if err := c.checkEncryptionKey(); err != nil {
+			return err
+		}
+	}
+	if c.cfg.Audit.Enabled {
+		audit, err := OpenAuditLog(auditDir(c.cfg.Audit.Dir))
+		if err != nil {
+			// 审计日志是合规要求，不可用时拒绝启动而不是静默地不记录
+			return fmt.Errorf("审计日志不可用: %v", err)
+		}
+		c.audit = audit
+	}
+	if c.cfg.Outbox.Enabled {
+		maxBytes := int64(c.cfg.Outbox.MaxSize) << 20
+		maxAge := time.Duration(c.cfg.Outbox.MaxAge) * time.Hour
+		outbox, err := OpenOutbox(outboxDir(c.cfg.Outbox.Dir), maxBytes, maxAge)
+		if err != nil {
+			// 离线缓存不可用时仍继续上报，只是断线期间的数据会丢失
+			logger.Error("打开离线缓存失败:", err)
+		} else {
+			c.outbox = outbox
+		}
+	}
+
+
 	// 启动连接管理
 	c.stopWg.Add(1)
 	go func() {
@@ -47,12 +174,29 @@ func (c *Client) Start() error {
 		c.connectionManager()
 	}()
 	
-	// 启动心跳
+	// 启动心跳，定时器在启动协程前创建，Stop 及 updateIntervals 可以直接使用
+	c.heartbeat = time.NewTicker(time.Duration(c.cfg.Agent.HeartbeatInterval) * time.Second)
 	c.stopWg.Add(1)
 	go func() {
 		defer c.stopWg.Done()
 		c.heartbeatManager()
 	}()
+
+	// 启动系统信息定时上报，断线期间的数据由离线缓存暂存
+	c.stopWg.Add(1)
+	go func() {
+		defer c.stopWg.Done()
+		c.systemInfoReporter()
+	}()
+
+	// 连接到备用地址期间探测主地址
+	if probeInterval := c.cfg.Hub.Failover.ProbeInterval; probeInterval > 0 && (len(c.cfg.Hub.BackupAddresses) > 0 || c.discovery.enabled()) {
+		c.stopWg.Add(1)
+		go func() {
+			defer c.stopWg.Done()
+			c.primaryProbe(time.Duration(probeInterval) * time.Second)
+		}()
+	}
 	
 	// 触发首次连接
 	c.reconnect <- struct{}{}
@@ -66,11 +210,15 @@ func (c *Client) Stop() error {
 		close(c.stop)
 		
 		c.mutex.Lock()
+		c.transitionLocked(StateDraining, nil)
 		if c.conn != nil {
 			c.conn.Close()
 			c.conn = nil
 		}
-		c.connected = false
+		if c.queue != nil {
+			c.queue.close()
+			c.queue = nil
+		}
 		c.mutex.Unlock()
 		
 		if c.heartbeat != nil {
@@ -79,6 +227,20 @@ func (c *Client) Stop() error {
 		
 		// 等待所有 goroutine 完成
 		c.stopWg.Wait()
+		if c.outbox != nil {
+			if err := c.outbox.Close(); err != nil {
+				logger.Error("关闭离线缓存失败:", err)
+			}
+		}
+		if c.audit != nil {
+			if err := c.audit.Close(); err != nil {
+				logger.Error("关闭审计日志失败:", err)
+			}
+		}
+		c.mutex.Lock()
+		c.transitionLocked(StateStopped, nil)
+		c.mutex.Unlock()
+		c.notifier.wait()
 		logger.Info("客户端已完全停止")
 	})
 	return nil
@@ -87,12 +249,33 @@ func (c *Client) Stop() error {
 
 func (c *Client) connectionManager() {
 	logger.Info("连接管理器启动")
+	first := true
 	for {
 		select {
 		case <-c.stop:
 			logger.Info("连接管理器收到停止信号")
 			return
+		case <-c.failed:
+			logger.Info("连接管理器停止重连")
+			return
 		case <-c.reconnect:
+			if c.Err() != nil {
+				return
+			}
+			if !first {
+				// 上一个连接从未收到 Hub 的有效帧时（如被防火墙拦截或对端不是 Hub）视为传输方式不可用
+				if c.received.Load() {
+					c.transport.succeeded()
+				} else {
+					c.transport.failed()
+				}
+				// 首次连接之外的每次重连都先退避等待，等待期间可被 Stop 打断
+				if !c.waitReconnect() {
+					return
+				}
+			}
+			first = false
+			c.received.Store(false)
 			logger.Info("尝试建立连接...")
 			c.connect()
 		}
@@ -100,105 +283,236 @@ func (c *Client) connectionManager() {
 }
 
 func (c *Client) connect() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	// 有轮换中的新凭据时本次连接以其尝试，Hub 明确拒绝新凭据或以其认证多次失败时才回退到原凭据；
+	// 连接、TLS 及握手失败与凭据无关，新凭据保留到下一次重连
+	rotating := c.rotationPending()
+	conn, queue, control, err := c.dial()
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if conn == nil {
+		return
+	}
+	failed := func(msg string, err error) {
+		if rotating && credentialRejected(err) {
+			err = c.rotationFailed(err)
+		}
+		c.connectFailed(conn, msg, err)
+	}
 
-	if c.connected {
-		logger.Info("已经连接到服务器，跳过连接")
+	// 握手和认证期间不持有锁，接收循环需要据此投递 Hub 的回复或处理断线
+	c.mutex.RLock()
+	exchange := c.exchange
+	c.mutex.RUnlock()
+	caps, err := c.handshake(queue, control, exchange)
+	if err != nil {
+		failed("握手失败:", err)
 		return
 	}
+	encoding, ok := c.applyCapabilities(conn, caps)
+	if !ok {
+		return
+	}
+	if c.needsEnrollment() {
+		if err := c.enroll(queue, control, caps); err != nil {
+			failed("注册失败:", err)
+			return
+		}
+	}
+	if err := c.authenticate(queue, control, caps, encoding); err != nil {
+		var authErr *AuthError
+		if !rotating && errors.As(err, &authErr) && !authErr.Unverified && authErr.Reason == protocol.AuthFailRevoked {
+			err = c.credentialRevoked(err)
+		}
+		if rotating && c.pendingAuthFailed(err) {
+			err = c.rotationFailed(err)
+		}
+		c.connectFailed(conn, "认证失败:", err)
+		return
+	}
+	if rotating {
+		if caps.Legacy {
+			// 旧版 Hub 不回复认证结果，无法确认新凭据有效
+			c.connectFailed(conn, "认证失败:", c.rotationFailed(errors.New("Hub 不回复认证结果")))
+			return
+		}
+		c.rotationSucceeded()
+	}
+
+	// 发送静态系统信息
+	if staticInfo, err := c.collector.collectStaticInfo(); err == nil {
+		staticInfoMsg := protocol.NewMessage(protocol.MessageTypeStaticInfo, staticInfo)
+		logger.Debug("静态系统信息内容:", staticInfoMsg)
+		if err := c.enqueue(queue, encoding, staticInfoMsg); err != nil {
+			logger.Error("发送静态系统信息失败:", err)
+		}
+	}
+
+	// 认证通过后才允许发送心跳等业务消息；旧版 Hub 不回复认证结果，认证消息已排在队首
+	c.mutex.Lock()
+	ready := c.conn == conn && c.transitionLocked(StateReady, nil) == nil
+	addr := c.addr
+	c.mutex.Unlock()
+	if ready {
+		c.backoff.reset()
+		c.failover.Connected(addr)
+		c.liveness.reset()
+	}
+
+	// 重传上一个连接上未被确认的消息
+	if c.ackingEnabled() {
+		for _, msg := range c.acks.reconnected() {
+			if err := c.enqueue(queue, encoding, msg); err != nil {
+				logger.Error("重传未确认消息失败:", msg.Header.Type, err)
+			}
+		}
+	}
+
+	// 按顺序补发离线缓存中的记录
+	if c.outbox != nil {
+		c.stopWg.Add(1)
+		go func() {
+			defer c.stopWg.Done()
+			c.outboxLoop(queue)
+		}()
+	}
+}
+
+// connectFailed 处理握手或认证阶段的错误：重试无法解决时（如认证被永久拒绝）停止重连，否则断开后重连
+func (c *Client) connectFailed(conn net.Conn, msg string, err error) {
+	logger.Error(msg, err)
+	var permanent interface{ Permanent() bool }
+	if errors.As(err, &permanent) && permanent.Permanent() {
+		c.fail(err)
+	}
+	c.handleDisconnect(conn, err)
+}
+
+// dial 依次尝试所有地址并启动连接上的读写协程，返回连接、发送队列及接收握手回复的 channel；
+// 地址的尝试顺序由故障转移策略决定。全部失败时触发下一次重连并返回 nil，由连接管理器退避等待。
+// Hub 证书校验失败时返回不可重试的错误。
+func (c *Client) dial() (net.Conn, *sendQueue, chan *protocol.Message, error) {
+	// 地址发现可能需要查询 DNS，不在持有锁时进行
+	targets := c.discovery.resolve()
+
+	// 只在检查、转换状态及安装连接时持有锁，拨号、TLS 及 WebSocket 握手期间不阻塞 Stop 和 Send
+	c.mutex.Lock()
+	if c.state != StateDisconnected {
+		logger.Info("当前状态为 " + c.state.String() + ", 跳过连接")
+		c.mutex.Unlock()
+		return nil, nil, nil, nil
+	}
+	c.transitionLocked(StateDialing, nil)
+	order := c.dialOrderLocked(targets)
+	tlsConfig := c.tlsConfigLocked()
+	c.mutex.Unlock()
 
 	// 尝试所有可用地址
-	addresses := []string{c.cfg.Hub.Address}
-	addresses = append(addresses, c.cfg.Hub.BackupAddresses...)
+	transport := c.transport.current
+	var lastErr error
+	for _, group := range c.dialGroups(order) {
+		select {
+		case <-c.stop:
+			return nil, nil, nil, nil
+		default:
+		}
 
-	for _, addr := range addresses {
-		endpoint := fmt.Sprintf("%s:%d", addr, c.cfg.Hub.Port)
-		logger.Info("正在连接到服务器:", endpoint)
-		
-		// 根据配置选择网络协议
-		network := "tcp"
-		if c.cfg.Hub.Protocol == "ipv6" {
-			network = "tcp6"
-		} else if c.cfg.Hub.Protocol == "ipv4" {
-			network = "tcp4"
+		// 同一组的地址竞速连接，以组内第一个地址代表该 Hub
+		target := group[0]
+		addr := target.endpoint
+		if transport == transportWebSocket {
+			group = webSocketTargets(c.cfg, group)
 		}
-		logger.Info("使用网络协议:", network)
+		logger.Info("正在连接到服务器:", endpoints(group))
+		logger.Info("使用网络协议:", c.network(), ", 传输方式:", transport)
 
-		conn, err := net.DialTimeout(network, endpoint, 5*time.Second)
+		conn, err := c.dialHub(group)
 		if err != nil {
 			logger.Error("连接失败:", addr, err)
+			lastErr = err
 			continue
 		}
 
 		logger.Info("成功建立TCP连接")
-		c.conn = conn
-		c.connected = true
-		
-		// 发送认证消息
-		authMsg := protocol.NewMessage(protocol.MessageTypeAuth, &protocol.AuthPayload{
-			Key:   c.cfg.Auth.Key,
-			UUID:  GetAgentUUID(),
-			Alias: c.cfg.Agent.Alias,
-		})
-		
-		logger.Info("正在发送认证消息...")
-		logger.Debug("认证消息内容:", authMsg)
-		
-		data := authMsg.Encode()
-		logger.Debug("编码后的认证消息:", fmt.Sprintf("%x", data))
-		
-		n, err := c.conn.Write(data)
+		if tlsConfig != nil {
+			conn, err = handshakeTLS(conn, tlsConfig, target.serverName)
+			if err != nil {
+				var permanent *permanentError
+				if errors.As(err, &permanent) {
+					c.dialFailed(err)
+					return nil, nil, nil, err
+				}
+				logger.Error("TLS 握手失败:", addr, err)
+				lastErr = err
+				continue
+			}
+			logger.Info("TLS 握手完成")
+		}
+		if transport == transportWebSocket {
+			conn, err = c.upgradeWebSocket(conn, group[0])
+			if err != nil {
+				logger.Error("WebSocket 握手失败:", addr, err)
+				lastErr = err
+				continue
+			}
+			logger.Info("WebSocket 握手完成")
+		}
+
+		c.mutex.Lock()
+		if c.state != StateDialing {
+			// 拨号期间 Stop 已开始停止
+			c.mutex.Unlock()
+			conn.Close()
+			return nil, nil, nil, nil
+		}
+		exchange, err := c.newKeyExchangeLocked()
 		if err != nil {
-			logger.Error("发送认证消息失败:", err)
-			c.conn.Close()
-			c.conn = nil
-			c.connected = false
+			c.mutex.Unlock()
+			logger.Error("负载加密初始化失败:", err)
+			conn.Close()
+			lastErr = err
 			continue
 		}
-		logger.Info("认证消息发送成功, 已发送", n, "字节")
 
-		// 启动接收循环
-		c.stopWg.Add(1)
+		queue := newSendQueue(c.cfg.Agent.SendQueueSize)
+		control := make(chan *protocol.Message, 2)
+		c.conn = conn
+		c.addr = addr
+		c.queue = queue
+		c.control = control
+		c.exchange = exchange
+		// 握手完成前只使用 JSON
+		c.encoding = protocol.EncodeOptions{}
+		c.transitionLocked(StateHandshaking, nil)
+
+		// 启动写协程和接收循环，连接上的所有写操作都经由发送队列完成
+		c.stopWg.Add(2)
 		go func() {
 			defer c.stopWg.Done()
-			c.receiveLoop()
+			c.writeLoop(conn, queue)
 		}()
-
-		// 发送静态系统信息
-		if staticInfo, err := c.collector.collectStaticInfo(); err == nil {
-			staticInfoMsg := protocol.NewMessage(protocol.MessageTypeStaticInfo, staticInfo)
-			logger.Debug("静态系统信息内容:", staticInfoMsg)
-			data := staticInfoMsg.Encode()
-			logger.Debug("编码后的静态系统信息:", fmt.Sprintf("%x", data))
-			
-			n, err := c.conn.Write(data)
-			if err != nil {
-				logger.Error("发送静态系统信息失败:", err)
-			} else {
-				logger.Info("静态系统信息发送成功, 已发送", n, "字节")
-			}
-		}
-
-		// 启动系统信息定时上报
-		c.stopWg.Add(1)
 		go func() {
 			defer c.stopWg.Done()
-			c.systemInfoReporter()
+			c.receiveLoop(conn, c.newParser(), c.newFrameGuard(conn), exchange)
 		}()
-		return
+		c.mutex.Unlock()
+		return conn, queue, control, nil
 	}
 
-	// 所有地址都连接失败,等待重试
-	retryInterval := time.Duration(c.cfg.Agent.ReconnectInterval) * time.Second
-	logger.Info("所有连接尝试失败，将在", retryInterval, "后重试")
-	time.Sleep(retryInterval)
-	
-	// 使用 select 避免阻塞
-	select {
-	case c.reconnect <- struct{}{}:
-	default:
-		// channel 已满，说明重连已在进行中
+	// 所有地址都连接失败，由连接管理器退避后重试
+	logger.Info("所有连接尝试失败")
+	c.dialFailed(lastErr)
+	c.triggerReconnect()
+	return nil, nil, nil, nil
+}
+
+// dialFailed 在拨号失败后回到 Disconnected；拨号期间 Stop 已开始停止时保持停止中的状态
+func (c *Client) dialFailed(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == StateDialing {
+		c.transitionLocked(StateDisconnected, err)
 	}
 }
 
@@ -206,7 +520,7 @@ func (c *Client) systemInfoReporter() {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Error("系统信息上报器发生panic:", r)
-			go c.handleDisconnect()
+			go c.handleDisconnect(nil, fmt.Errorf("系统信息上报器发生panic: %v", r))
 		}
 	}()
 
@@ -218,82 +532,216 @@ func (c *Client) systemInfoReporter() {
 		case <-c.stop:
 			return
 		case <-ticker.C:
-			c.mutex.RLock()
-			if !c.connected || c.conn == nil {
-				c.mutex.RUnlock()
-				continue
-			}
-			
 			if info, err := c.collector.collectDynamicInfo(); err == nil {
+				info.Link = c.linkStats()
 				msg := protocol.NewMessage(protocol.MessageTypeSystemInfo, info)
 				logger.Debug("系统信息内容:", msg)
-				data := msg.Encode()
-				logger.Debug("编码后的系统信息:", fmt.Sprintf("%x", data))
-				
-				n, err := c.conn.Write(data)
-				if err != nil {
+				if err := c.Report(msg); err != nil && err != ErrNotConnected {
 					logger.Error("发送系统信息失败:", err)
-					c.mutex.RUnlock()
-					c.handleDisconnect()
-					continue
 				}
-				logger.Debug("系统信息发送成功, 已发送", n, "字节")
 			}
-			c.mutex.RUnlock()
 		}
 	}
 }
 
-func (c *Client) receiveLoop() {
+// writeLoop 是连接上唯一的写协程，按优先级从发送队列中取出消息写入连接
+func (c *Client) writeLoop(conn net.Conn, queue *sendQueue) {
+	logger.Info("启动数据发送循环")
+	for {
+		frame, ok := queue.pop()
+		if !ok {
+			return
+		}
+
+		logger.Debug("发送消息:", frame.msgType, "大小:", len(frame.data), "字节")
+		// 认证消息可能含有密钥，不记录内容
+		if frame.msgType != protocol.MessageTypeAuth {
+			logger.Debug("消息内容:", fmt.Sprintf("%x", frame.data))
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		n, err := conn.Write(frame.data)
+		if err != nil {
+			logger.Error("发送消息失败:", frame.msgType, err)
+			c.handleDisconnect(conn, err)
+			return
+		}
+		logger.Debug("消息发送成功, 已发送", n, "字节")
+		if frame.written != nil {
+			frame.written()
+		}
+	}
+}
+
+// outboxLoop 将离线缓存中尚未投递的记录按序号顺序放入发送队列，写入成功后推进游标
+func (c *Client) outboxLoop(queue *sendQueue) {
+	after := c.outbox.Cursor()
+	acking := c.ackingEnabled()
+	logger.Info("开始投递离线缓存记录, 起始序号:", after+1)
+
+	for {
+		records, err := c.outbox.Pending(after, 64)
+		if err != nil {
+			logger.Error("读取离线缓存失败:", err)
+		}
+
+		for _, rec := range records {
+			seq := rec.Seq
+			msg := rec.Message()
+			ack := func() {
+				c.outbox.Ack(seq)
+			}
+			fail := func(err error) {
+				if errors.Is(err, ErrAckRequeued) {
+					return
+				}
+				// 按 ID 顺序放弃，之前的记录均已完成，可以跳过该记录
+				logger.Error("离线缓存记录投递失败, 已跳过:", seq, err)
+				c.outbox.Ack(seq)
+			}
+
+			// 启用消息确认时，收到 Hub 的 ACK 后才推进游标；否则以写入连接为准
+			var written func()
+			if acking {
+				if !c.acks.wait(queue.done) {
+					return
+				}
+				if err := c.acks.track(msg, true, ack, fail); err != nil {
+					logger.Error("记录待确认消息失败:", err)
+					return
+				}
+			} else {
+				written = ack
+			}
+
+			// 所有记录使用同一优先级，保证按序号顺序写入
+			frame, err := c.encodeFrame(msg, c.currentEncoding())
+			if err != nil {
+				logger.Error("离线缓存记录编码失败, 已跳过:", seq, err)
+				c.outbox.Ack(seq)
+				after = seq
+				continue
+			}
+			frame.priority = PriorityLow
+			frame.written = written
+			frame.durable = true
+			if err := queue.pushWait(context.Background(), frame); err != nil {
+				return
+			}
+			after = seq
+		}
+		if len(records) > 0 {
+			continue
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-queue.done:
+			return
+		case <-c.outbox.Notify():
+		}
+	}
+}
+
+// receiveLoop 读取连接数据并分发消息，读取过程中不持有锁。
+// guard 不为 nil 时，未通过签名校验的消息在分发前丢弃；
+// exchange 不为 nil 时，Hub 的 HELLO 回复同意加密后只接受加密的帧，解密失败即断开连接。
+func (c *Client) receiveLoop(conn net.Conn, parser *protocol.MessageParser, guard *frameGuard, exchange *keyExchange) {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Error("接收循环发生panic:", r)
-			go c.handleDisconnect()
+			go c.handleDisconnect(conn, fmt.Errorf("接收循环发生panic: %v", r))
 		}
 	}()
 
 	logger.Info("启动数据接收循环")
 	buffer := make([]byte, 4096)
+	frameErrors := 0
 	
 	for {
 		select {
 		case <-c.stop:
 			return
 		default:
-			c.mutex.RLock()
-			if !c.connected || c.conn == nil {
-				c.mutex.RUnlock()
-				return
-			}
+			// 设置读取超时，启用心跳回显后由心跳判定 Hub 失联，见 liveness.go
+			conn.SetReadDeadline(time.Now().Add(c.readTimeout(conn)))
 			
-			// 设置读取超时
-			c.conn.SetReadDeadline(time.Now().Add(time.Second * 30))
-			
-			n, err := c.conn.Read(buffer)
+			n, err := conn.Read(buffer)
 			if err != nil {
-				c.mutex.RUnlock()
 				logger.Error("读取数据失败:", err)
-				c.handleDisconnect()
+				c.handleDisconnect(conn, err)
 				return
 			}
 
 			logger.Debug("收到", n, "字节数据:", fmt.Sprintf("%x", buffer[:n]))
-			c.parser.Append(buffer[:n])
+			parser.Append(buffer[:n])
 			
-			for c.parser.HasCompleteMessage() {
-				if msg := c.parser.ParseMessage(); msg != nil {
-					logger.Info("解析到完整消息:", msg.Header.Type)
-					logger.Debug("消息内容:", msg)
-					c.handleMessage(msg)
+			for {
+				msg, err := parser.ParseMessage()
+				if err != nil {
+					if errors.Is(err, protocol.ErrDecrypt) || errors.Is(err, protocol.ErrUnencrypted) {
+						c.metrics.rejectedEncrypted.Add(1)
+					}
+					frameErrors++
+					var frameErr *protocol.FrameError
+					if !errors.As(err, &frameErr) || !frameErr.Recoverable() || frameErrors > maxFrameErrors {
+						logger.Error("收到无法解析的数据, 断开连接:", err)
+						c.handleDisconnect(conn, err)
+						return
+					}
+					logger.Warn("丢弃无法解析的消息:", err)
+					continue
+				}
+				if msg == nil {
+					break
+				}
+				if exchange != nil && msg.Header.Type == protocol.MessageTypeHello {
+					if hello, ok := msg.Payload.(*protocol.HelloPayload); ok {
+						exchange.arm(hello, parser)
+					}
 				}
+				if guard != nil {
+					if err := guard.check(msg); err != nil {
+						c.metrics.countReject(err)
+						frameErrors++
+						if frameErrors > maxFrameErrors {
+							logger.Error("连续收到未通过签名校验的消息, 断开连接:", err)
+							c.handleDisconnect(conn, err)
+							return
+						}
+						logger.Warn("丢弃消息", msg.Header.Type, ":", err)
+						continue
+					}
+				}
+				frameErrors = 0
+				c.received.Store(true)
+				logger.Info("解析到完整消息:", msg.Header.Type)
+				logger.Debug("消息内容:", msg)
+				c.handleMessage(msg)
 			}
-			c.mutex.RUnlock()
 		}
 	}
 }
 
+// handleMessage 处理 Hub 下发的消息，Hub 的指令及其处理结果记入审计日志
 func (c *Client) handleMessage(msg *protocol.Message) {
+	outcome := c.dispatch(msg)
+	if c.audit != nil && audited(msg.Header.Type) {
+		if err := c.audit.Record(msg, outcome); err != nil {
+			logger.Error("写入审计日志失败:", err)
+		}
+	}
+}
+
+// dispatch 按类型处理消息并返回处理结果
+func (c *Client) dispatch(msg *protocol.Message) string {
 	switch msg.Header.Type {
+	case protocol.MessageTypeResponse:
+		// 响应交给等待中的 Request，其余类型即使带有关联 ID 也按类型处理
+		if !c.requests.deliver(msg) {
+			return outcomeIgnored("没有等待该响应的请求")
+		}
+		return outcomeDelivered
 	case protocol.MessageTypeConfig:
 		logger.Info("收到配置更新消息")
 		logger.Debug("配置内容:", msg.Payload)
@@ -301,25 +749,84 @@ func (c *Client) handleMessage(msg *protocol.Message) {
 		var config struct {
 			SystemInfoInterval int `json:"systemInfoInterval"`
 			HeartbeatInterval int `json:"heartbeatInterval"`
+			Compression       []string `json:"compression"` // Hub 支持的压缩算法
 		}
-		if err := msg.DecodePayload(&config); err == nil {
-			c.updateIntervals(config.SystemInfoInterval, config.HeartbeatInterval)
+		if err := msg.DecodePayload(&config); err != nil {
+			return outcomeFailed(err)
 		}
+		c.updateIntervals(config.SystemInfoInterval, config.HeartbeatInterval)
+		c.enableCompression(config.Compression)
+	case protocol.MessageTypeAck, protocol.MessageTypeNack:
+		if c.acks == nil {
+			return outcomeIgnored("未启用消息确认")
+		}
+		var ack protocol.AckPayload
+		if err := msg.DecodePayload(&ack); err != nil {
+			logger.Error("解析确认消息失败:", err)
+			return outcomeFailed(err)
+		}
+		if msg.Header.Type == protocol.MessageTypeAck {
+			c.acks.ack(ack.IDs)
+			return outcomeApplied
+		}
+		for _, resend := range c.acks.nack(ack.IDs, ack.Reason) {
+			if err := c.Send(resend); err != nil {
+				logger.Error("重传被拒绝的消息失败:", resend.Header.Type, err)
+			}
+		}
+	case protocol.MessageTypeHeartbeat:
+		var heartbeat protocol.HeartbeatPayload
+		if err := msg.DecodePayload(&heartbeat); err != nil {
+			return outcomeFailed(err)
+		}
+		c.heartbeatEchoed(&heartbeat)
+	case protocol.MessageTypeHello, protocol.MessageTypeAuthOK, protocol.MessageTypeAuthFail, protocol.MessageTypeEnrollOK:
+		c.deliverControl(msg)
+		return outcomeDelivered
+	case protocol.MessageTypeRotate:
+		logger.Info("收到凭据轮换消息")
+		if err := c.rotate(msg); err != nil {
+			return outcomeFailed(err)
+		}
+	case protocol.MessageTypeTaskRequest:
+		logger.Info("收到任务请求消息")
+		if !c.Capabilities().Supports(protocol.FeatureTasks) {
+			logger.Warn("Hub 未协商任务功能, 忽略任务请求")
+			return outcomeIgnored("未协商任务功能")
+		}
+		if c.executor == nil {
+			logger.Warn("未配置任务执行器, 忽略任务请求")
+			return outcomeIgnored("未配置任务执行器")
+		}
+		if err := c.executor.Submit(msg); err != nil {
+			logger.Error("提交任务失败:", err)
+			return outcomeFailed(err)
+		}
+		return outcomeSubmitted
+	default:
+		return outcomeIgnored("未知的消息类型")
 	}
+	return outcomeApplied
 }
 
-func (c *Client) handleDisconnect() {
-	logger.Info("处理连接断开")
+// handleDisconnect 关闭 conn 并触发重连，err 为断开的原因；conn 为 nil 时处理当前连接。
+// 若 conn 已不是当前连接（已被其他协程处理），直接返回。
+func (c *Client) handleDisconnect(conn net.Conn, err error) {
 	c.mutex.Lock()
-	if c.conn != nil {
-		c.conn.Close()
-		c.conn = nil
+	if c.conn == nil || (conn != nil && c.conn != conn) {
+		c.mutex.Unlock()
+		return
 	}
-	c.connected = false
+	logger.Info("处理连接断开")
+	c.closeConnLocked(err)
 	c.mutex.Unlock()
 
 	// 触发重连
 	logger.Info("触发重连机制")
+	c.triggerReconnect()
+}
+
+func (c *Client) triggerReconnect() {
 	select {
 	case c.reconnect <- struct{}{}:
 	default:
@@ -327,16 +834,32 @@ func (c *Client) handleDisconnect() {
 	}
 }
 
+// closeConnLocked 关闭当前连接及其发送队列并回到 Disconnected，调用方需持有 mutex
+func (c *Client) closeConnLocked(err error) {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.addr = ""
+	if c.queue != nil {
+		c.queue.close()
+		c.queue = nil
+	}
+	c.control = nil
+	c.exchange = nil
+	c.transitionLocked(StateDisconnected, err)
+	c.requests.failAll(ErrConnectionLost)
+}
+
 func (c *Client) heartbeatManager() {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Error("心跳管理器发生panic:", r)
-			go c.handleDisconnect()
+			go c.handleDisconnect(nil, fmt.Errorf("心跳管理器发生panic: %v", r))
 		}
 	}()
 
 	logger.Info("心跳管理器启动")
-	c.heartbeat = time.NewTicker(time.Duration(c.cfg.Agent.HeartbeatInterval) * time.Second)
 	defer c.heartbeat.Stop()
 
 	for {
@@ -346,25 +869,11 @@ func (c *Client) heartbeatManager() {
 			return
 		case <-c.heartbeat.C:
 			c.mutex.RLock()
-			if !c.connected || c.conn == nil {
-				c.mutex.RUnlock()
-				continue
-			}
-			
-			heartbeat := protocol.NewMessage(protocol.MessageTypeHeartbeat, &protocol.HeartbeatPayload{
-				UUID: GetAgentUUID(),
-			})
-			data := heartbeat.Encode()
-			logger.Debug("发送心跳:", fmt.Sprintf("%x", data))
-			n, err := c.conn.Write(data)
-			if err != nil {
-				logger.Error("发送心跳失败:", err)
-				c.mutex.RUnlock()
-				c.handleDisconnect()
-				continue
-			}
-			logger.Debug("心跳发送成功, 已发送", n, "字节")
+			conn, ready := c.conn, c.state == StateReady
 			c.mutex.RUnlock()
+			if ready {
+				c.sendHeartbeat(conn)
+			}
 		}
 	}
 }
@@ -379,31 +888,172 @@ func (c *Client) updateIntervals(systemInfo, heartbeat int) {
 	}
 }
 
+// Send 将消息放入发送队列后立即返回，握手完成前返回 ErrNotConnected，队列已满时返回 ErrQueueFull
 func (c *Client) Send(msg *protocol.Message) error {
 	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+	queue, encoding, ready := c.queue, c.encoding, c.state == StateReady
+	c.mutex.RUnlock()
 
-	if !c.connected || c.conn == nil {
-		return fmt.Errorf("未连接到服务器")
+	if !ready {
+		return ErrNotConnected
 	}
+	return c.enqueue(queue, encoding, msg)
+}
+
+// SendContext 与 Send 相同，但队列已满时会等待空位直到 ctx 结束
+func (c *Client) SendContext(ctx context.Context, msg *protocol.Message) error {
+	c.mutex.RLock()
+	queue, encoding, ready := c.queue, c.encoding, c.state == StateReady
+	c.mutex.RUnlock()
 
-	data := msg.Encode()
-	logger.Debug("发送消息:", msg.Header.Type, "大小:", len(data), "字节")
-	logger.Debug("消息内容:", fmt.Sprintf("%x", data))
-	n, err := c.conn.Write(data)
+	if !ready {
+		return ErrNotConnected
+	}
+	frame, err := c.encodeFrame(msg, encoding)
 	if err != nil {
 		return err
 	}
-	logger.Debug("消息发送成功, 已发送", n, "字节")
+	return queue.pushWait(ctx, frame)
+}
+
+// Report 上报需要可靠投递的消息。启用离线缓存时先写入磁盘，
+// 由 outboxLoop 在连接可用时按顺序发送；否则等同于 Send。
+func (c *Client) Report(msg *protocol.Message) error {
+	if !isReportable(msg.Header.Type) {
+		return c.Send(msg)
+	}
+	if c.outbox != nil {
+		_, err := c.outbox.Append(msg.Header.Type, msg.Header.Timestamp, msg.Payload)
+		return err
+	}
+	if c.ackingEnabled() {
+		return c.sendTracked(msg)
+	}
+	return c.Send(msg)
+}
+
+// sendTracked 为消息分配 ID 后发送；未连接时消息保留在待确认列表中，重连后重传
+func (c *Client) sendTracked(msg *protocol.Message) error {
+	if err := c.acks.track(msg, false, nil, nil); err != nil {
+		return err
+	}
+	if err := c.Send(msg); err != nil && err != ErrNotConnected {
+		return err
+	}
 	return nil
 }
 
+// newParser 创建按配置限制单帧大小的解析器
+func (c *Client) newParser() *protocol.MessageParser {
+	parser := protocol.NewMessageParser()
+	if c.cfg.Agent.MaxFrameSize > 0 {
+		parser.SetMaxPayloadSize(uint32(c.cfg.Agent.MaxFrameSize) << 10)
+	}
+	return parser
+}
+
+func (c *Client) enqueue(queue *sendQueue, encoding protocol.EncodeOptions, msg *protocol.Message) error {
+	frame, err := c.encodeFrame(msg, encoding)
+	if err != nil {
+		return err
+	}
+	return queue.push(frame)
+}
+
+// encodeFrame 以连接的编码方式编码消息，编码格式不支持的负载类型回退到 JSON
+func (c *Client) encodeFrame(msg *protocol.Message, encoding protocol.EncodeOptions) (*outboundFrame, error) {
+	data, err := msg.EncodeWithOptions(encoding)
+	if errors.Is(err, protocol.ErrCodecUnsupported) {
+		encoding.Codec = protocol.JSONCodec
+		data, err = msg.EncodeWithOptions(encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	frame := &outboundFrame{
+		msgType:  msg.Header.Type,
+		priority: priorityOf(msg.Header.Type),
+		data:     data,
+	}
+	// 待确认的消息被挤出队列时交由 ackTracker 重发
+	if id := msg.Header.ID; id != 0 && c.acks != nil {
+		frame.evicted = func() { c.resendEvicted(id) }
+	}
+	return frame, nil
+}
+
+// resendEvicted 重新发送被挤出发送队列的待确认消息，仍然失败时保留到重连后重传
+func (c *Client) resendEvicted(id uint64) {
+	msg := c.acks.evicted(id)
+	if msg == nil {
+		return
+	}
+	if err := c.Send(msg); err != nil {
+		logger.Warn("重发被挤出队列的消息失败, 将在重连后重传:", msg.Header.Type, err)
+	}
+}
+
+// configuredCodec 返回配置的负载编码格式，未配置或无法识别时使用 JSON
+func (c *Client) configuredCodec() protocol.Codec {
+	if c.cfg.Hub.Codec == "" {
+		return protocol.JSONCodec
+	}
+	codec, ok := protocol.CodecByName(c.cfg.Hub.Codec)
+	if !ok {
+		logger.Warn("未知的编码格式:", c.cfg.Hub.Codec, ", 使用 json")
+		return protocol.JSONCodec
+	}
+	return codec
+}
+
+// enableCompression 在旧版 Hub 通过配置消息声明支持配置的压缩算法后，为当前连接启用压缩；
+// 支持握手的 Hub 在 HELLO 中协商压缩算法
+func (c *Client) enableCompression(supported []string) {
+	name := c.cfg.Hub.Compression
+	if name == "" || name == "none" {
+		return
+	}
+	compressor, ok := protocol.CompressorByName(name)
+	if !ok {
+		logger.Warn("未知的压缩算法:", name, ", 不启用压缩")
+		return
+	}
+
+	for _, s := range supported {
+		if s != compressor.Name() {
+			continue
+		}
+		c.mutex.Lock()
+		if c.conn != nil && c.caps.Legacy && c.encoding.Compressor == nil {
+			c.encoding.Compressor = compressor
+			logger.Info("Hub 支持", compressor.Name(), "压缩, 已启用负载压缩")
+		}
+		c.mutex.Unlock()
+		return
+	}
+}
+
+func (c *Client) currentEncoding() protocol.EncodeOptions {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.encoding
+}
+
+// IsConnected 返回是否已与 Hub 建立连接（握手及认证期间也视为已连接）
 func (c *Client) IsConnected() bool {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
-	return c.connected
+	switch c.state {
+	case StateHandshaking, StateAuthenticating, StateReady:
+		return true
+	}
+	return false
 }
 
 func (c *Client) SetCollector(collector *Collector) {
 	c.collector = collector
 }
+
+func (c *Client) SetTaskExecutor(executor *TaskExecutor) {
+	c.executor = executor
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"agent/config"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingDialer 在 release 关闭前阻塞拨号，返回 net.Pipe 的一端
+type blockingDialer struct {
+	dialing chan struct{}
+	release chan struct{}
+	peer    net.Conn
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	close(d.dialing)
+	<-d.release
+	conn, peer := net.Pipe()
+	d.peer = peer
+	return conn, nil
+}
+
+func TestDialWithoutLock(t *testing.T) {
+	tests := []struct {
+		name      string
+		stop      bool // 拨号期间调用 Stop
+		wantConn  bool
+		wantState State
+	}{
+		{"connected", false, true, StateHandshaking},
+		{"stopped while dialing", true, false, StateStopped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Hub.Address = "127.0.0.1"
+			cfg.Hub.Port = 9527
+			cfg.Hub.Protocol = "ipv4"
+			c := NewClient(cfg)
+			dialer := &blockingDialer{dialing: make(chan struct{}), release: make(chan struct{})}
+			c.dialer = dialer
+			c.failover = priorityStrategy{}
+			var err error
+			if c.discovery, err = newDiscovery(cfg, nil); err != nil {
+				t.Fatal(err)
+			}
+			if c.transport, err = newTransportSelector(""); err != nil {
+				t.Fatal(err)
+			}
+
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				conn, _, _, err := c.dial()
+				done <- result{conn, err}
+			}()
+			<-dialer.dialing
+
+			// 拨号期间读取状态和停止客户端都不应等待拨号完成
+			if state := c.State(); state != StateDialing {
+				t.Fatalf("state = %v, want %v", state, StateDialing)
+			}
+			if tt.stop {
+				stopped := make(chan struct{})
+				go func() {
+					c.Stop()
+					close(stopped)
+				}()
+				select {
+				case <-stopped:
+				case <-time.After(2 * time.Second):
+					t.Fatal("Stop 被拨号阻塞")
+				}
+			}
+			close(dialer.release)
+
+			res := <-done
+			if res.err != nil {
+				t.Fatalf("dial: %v", res.err)
+			}
+			if (res.conn != nil) != tt.wantConn {
+				t.Fatalf("conn = %v, want conn %v", res.conn, tt.wantConn)
+			}
+			if state := c.State(); state != tt.wantState {
+				t.Fatalf("state = %v, want %v", state, tt.wantState)
+			}
+			if !tt.wantConn {
+				// Stop 之后建立的连接应被关闭
+				dialer.peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+				if _, err := dialer.peer.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+					t.Fatalf("连接未被关闭: %v", err)
+				}
+			}
+			c.Stop()
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,194 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	credentialFile        = "credential.json"
+	pendingCredentialFile = "credential.next.json" // 轮换中尚未通过认证的新凭据
+)
+
+// ErrCredentialRevoked 表示 Agent 的专属凭据已被 Hub 吊销，需要重新注册
+var ErrCredentialRevoked = errors.New("Agent 凭据已被吊销, 请使用 enroll 命令重新注册")
+
+// Credential 是注册或轮换时 Hub 签发的凭据，保存在数据目录中
+type Credential struct {
+	Secret      string    `json:"secret,omitempty"`      // 认证密钥，替代配置中的 auth.key
+	Certificate string    `json:"certificate,omitempty"` // mTLS 客户端证书（PEM）
+	PrivateKey  string    `json:"privateKey,omitempty"`  // 证书私钥（PEM），不经过线路传输
+	HubKey      string    `json:"hubKey,omitempty"`      // Hub 的 X25519 公钥（base64），用于负载加密
+	IssuedAt    time.Time `json:"issuedAt"`
+}
+
+// tlsCertificate 返回凭据中的客户端证书，未签发证书时返回 nil
+func (cred *Credential) tlsCertificate() (*tls.Certificate, error) {
+	if cred.Certificate == "" {
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(cred.Certificate), []byte(cred.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("凭据中的客户端证书无效: %v", err)
+	}
+	return &cert, nil
+}
+
+// credentialStore 管理数据目录中的凭据文件，目录和文件仅所有者可读写
+type credentialStore struct {
+	dir string
+}
+
+func credentialDir(dir string) string {
+	if strings.TrimSpace(dir) == "" {
+		return filepath.Join("data", "credentials")
+	}
+	return dir
+}
+
+func newCredentialStore(dir string) *credentialStore {
+	return &credentialStore{dir: credentialDir(dir)}
+}
+
+func (s *credentialStore) path() string {
+	return filepath.Join(s.dir, credentialFile)
+}
+
+func (s *credentialStore) pendingPath() string {
+	return filepath.Join(s.dir, pendingCredentialFile)
+}
+
+// Load 读取已保存的凭据，尚未注册时返回 nil
+func (s *credentialStore) Load() (*Credential, error) {
+	return readCredential(s.path())
+}
+
+// LoadPending 读取轮换中的新凭据，没有时返回 nil
+func (s *credentialStore) LoadPending() (*Credential, error) {
+	return readCredential(s.pendingPath())
+}
+
+// Save 原子地写入凭据，写入过程中崩溃不会留下半个文件
+func (s *credentialStore) Save(cred *Credential) error {
+	return s.write(s.path(), cred)
+}
+
+// SavePending 将新凭据写在现有凭据旁边，通过认证之前不影响现有凭据
+func (s *credentialStore) SavePending(cred *Credential) error {
+	return s.write(s.pendingPath(), cred)
+}
+
+// PromotePending 以新凭据原子地替换现有凭据
+func (s *credentialStore) PromotePending() error {
+	return os.Rename(s.pendingPath(), s.path())
+}
+
+// DiscardPending 删除未通过认证的新凭据
+func (s *credentialStore) DiscardPending() error {
+	err := os.Remove(s.pendingPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *credentialStore) write(path string, cred *Credential) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("创建凭据目录失败: %v", err)
+	}
+	data, err := json.MarshalIndent(cred, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+func readCredential(path string) (*Credential, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取凭据失败: %v", err)
+	}
+	cred := &Credential{}
+	if err := json.Unmarshal(data, cred); err != nil {
+		return nil, fmt.Errorf("凭据文件 %s 已损坏: %v", path, err)
+	}
+	return cred, nil
+}
+
+// Discard 将现有凭据改名为 credential.json.<suffix> 留档，不存在时忽略
+func (s *credentialStore) Discard(suffix string) error {
+	err := os.Rename(s.path(), s.path()+"."+suffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic 先写入同目录的临时文件并落盘，再改名覆盖目标文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// newCertificateRequest 生成 ECDSA P-256 私钥及以 Agent UUID 为 CN 的证书签名请求（均为 PEM）
+func newCertificateRequest(uuid string) (csrPEM, keyPEM string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: uuid},
+	}, key)
+	if err != nil {
+		return "", "", err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	csrPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	return csrPEM, keyPEM, nil
+}
@@ -0,0 +1,273 @@
+package core
+
+import (
+	"agent/config"
+	"agent/logger"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryTimeout = 5 * time.Second
+	// DNS 结果的缓存时长限制在 [minDiscoveryTTL, maxDiscoveryTTL] 内，
+	// 避免 TTL 为 0 的记录导致每次重连都查询，或过长的 TTL 使迁移迟迟不生效
+	minDiscoveryTTL = 5 * time.Second
+	maxDiscoveryTTL = time.Hour
+)
+
+// hubTarget 是一个可连接的 Hub 地址
+type hubTarget struct {
+	endpoint   string // 连接地址 host:port
+	serverName string // TLS 校验证书时使用的名称
+}
+
+// discovery 维护 Hub 地址列表：未启用发现时为 hub.address 及 backup_addresses，
+// 启用后为 DNS 解析结果加上 backup_addresses，按 TTL 缓存，过期后在下一次使用时刷新。
+// DNS 发现时 hub.address 本身也作为备用地址，连接时经由系统解析器解析。
+type discovery struct {
+	mode     string
+	name     string // SRV 记录名或要展开的主机名
+	port     int
+	static   []hubTarget
+	resolver Resolver
+
+	mutex   sync.Mutex
+	targets []hubTarget
+	expires time.Time
+}
+
+func newDiscovery(cfg *config.Config, resolver Resolver) (*discovery, error) {
+	d := &discovery{mode: cfg.Hub.Discovery.Mode, port: cfg.Hub.Port}
+	switch d.mode {
+	case "", "off":
+		d.mode = ""
+	case "srv":
+		d.name = cfg.Hub.Discovery.Name
+		if d.name == "" {
+			if cfg.Hub.Address == "" {
+				return nil, fmt.Errorf("SRV 发现需要配置 hub.discovery.name 或 hub.address")
+			}
+			d.name = "_pbm._tcp." + cfg.Hub.Address
+		}
+	case "dns":
+		if cfg.Hub.Address == "" {
+			return nil, fmt.Errorf("DNS 发现需要配置 hub.address")
+		}
+		d.name = cfg.Hub.Address
+	default:
+		return nil, fmt.Errorf("未知的地址发现模式: %s", d.mode)
+	}
+
+	addresses := cfg.Hub.BackupAddresses
+	// DNS 发现时 hub.address 排在展开的地址之后，直接查询的结果与系统解析不一致（如 /etc/hosts）时仍可连接；
+	// SRV 记录名另行配置时 hub.address 是普通地址，同样作为备用
+	if d.mode == "" || d.mode == "dns" || (d.mode == "srv" && cfg.Hub.Discovery.Name != "" && cfg.Hub.Address != "") {
+		addresses = append([]string{cfg.Hub.Address}, addresses...)
+	}
+	for _, addr := range addresses {
+		d.static = append(d.static, hubTarget{endpoint: net.JoinHostPort(addr, strconv.Itoa(cfg.Hub.Port)), serverName: addr})
+	}
+
+	if d.mode != "" {
+		if resolver == nil {
+			resolver = NewResolver(cfg.Hub.Discovery.Nameservers)
+		}
+		d.resolver = resolver
+	}
+	return d, nil
+}
+
+// enabled 返回是否通过 DNS 发现地址
+func (d *discovery) enabled() bool {
+	return d.mode != ""
+}
+
+// resolve 返回当前的 Hub 地址列表，第一个为主地址。缓存过期时重新解析；
+// 解析失败时沿用上一次的结果，从未成功时只使用备用地址。
+func (d *discovery) resolve() []hubTarget {
+	if !d.enabled() {
+		return d.static
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.targets != nil && time.Now().Before(d.expires) {
+		return d.targets
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	discovered, ttl, err := d.lookup(ctx)
+	if err != nil {
+		logger.Warn("解析 Hub 地址失败:", d.name, err)
+		d.expires = time.Now().Add(minDiscoveryTTL)
+		if d.targets != nil {
+			return d.targets
+		}
+		return d.static
+	}
+
+	targets := appendTargets(discovered, d.static)
+	if !sameTargets(targets, d.targets) {
+		logger.Info("Hub 地址已更新:", endpoints(targets))
+	}
+	d.targets = targets
+	d.expires = time.Now().Add(clampTTL(ttl))
+	return targets
+}
+
+func (d *discovery) lookup(ctx context.Context) ([]hubTarget, time.Duration, error) {
+	if d.mode == "srv" {
+		records, ttl, err := d.resolver.LookupSRV(ctx, d.name)
+		if err != nil {
+			return nil, 0, err
+		}
+		var targets []hubTarget
+		for _, srv := range orderSRV(records) {
+			host := strings.TrimSuffix(srv.Target, ".")
+			// 目标为 "." 表示该服务不可用
+			if host == "" {
+				continue
+			}
+			// 目标主机同样经由 resolver 展开，无法解析时交给连接时的系统解析
+			expanded, hostTTL, err := d.expand(ctx, host, int(srv.Port))
+			if err != nil {
+				logger.Warn("解析 SRV 目标失败:", host, err)
+				targets = append(targets, hubTarget{endpoint: net.JoinHostPort(host, strconv.Itoa(int(srv.Port))), serverName: host})
+				continue
+			}
+			targets = append(targets, expanded...)
+			if hostTTL < ttl {
+				ttl = hostTTL
+			}
+		}
+		if len(targets) == 0 {
+			return nil, 0, errNoRecords
+		}
+		return targets, ttl, nil
+	}
+	return d.expand(ctx, d.name, d.port)
+}
+
+// expand 将主机名展开为其所有 A/AAAA 记录
+func (d *discovery) expand(ctx context.Context, host string, port int) ([]hubTarget, time.Duration, error) {
+	if net.ParseIP(host) != nil {
+		return []hubTarget{{endpoint: net.JoinHostPort(host, strconv.Itoa(port)), serverName: host}}, maxDiscoveryTTL, nil
+	}
+	addrs, ttl, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errNoRecords
+	}
+	targets := make([]hubTarget, 0, len(addrs))
+	for _, addr := range addrs {
+		// 按 IP 连接，证书仍按域名校验
+		targets = append(targets, hubTarget{endpoint: net.JoinHostPort(addr, strconv.Itoa(port)), serverName: host})
+	}
+	return targets, ttl, nil
+}
+
+// orderSRV 按 RFC 2782 排序：优先级小的在前，同一优先级内按权重随机排列
+func orderSRV(records []*net.SRV) []*net.SRV {
+	ordered := append([]*net.SRV(nil), records...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Priority < ordered[j].Priority })
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+		shuffleByWeight(ordered[start:end])
+		start = end
+	}
+	return ordered
+}
+
+// shuffleByWeight 依次以权重为概率选出下一个记录，权重为 0 的记录只有很小的概率排在前面
+func shuffleByWeight(records []*net.SRV) {
+	sum := 0
+	for _, srv := range records {
+		sum += int(srv.Weight)
+	}
+	for sum > 0 && len(records) > 1 {
+		s := 0
+		n := rand.Intn(sum + 1)
+		for i := range records {
+			s += int(records[i].Weight)
+			if s >= n {
+				if i > 0 {
+					records[0], records[i] = records[i], records[0]
+				}
+				break
+			}
+		}
+		sum -= int(records[0].Weight)
+		records = records[1:]
+	}
+}
+
+// appendTargets 合并地址列表并去除重复的地址
+func appendTargets(targets, extra []hubTarget) []hubTarget {
+	merged := append([]hubTarget(nil), targets...)
+	for _, target := range extra {
+		duplicate := false
+		for _, t := range merged {
+			if t.endpoint == target.endpoint {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			merged = append(merged, target)
+		}
+	}
+	return merged
+}
+
+// sameTargets 比较两个地址列表包含的地址是否相同（SRV 的权重随机排列不算变化）
+func sameTargets(a, b []hubTarget) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[hubTarget]bool, len(a))
+	for _, t := range a {
+		seen[t] = true
+	}
+	for _, t := range b {
+		if !seen[t] {
+			return false
+		}
+	}
+	return true
+}
+
+func endpoints(targets []hubTarget) []string {
+	list := make([]string, len(targets))
+	for i, t := range targets {
+		list[i] = t.endpoint
+	}
+	return list
+}
+
+func clampTTL(ttl time.Duration) time.Duration {
+	if ttl < minDiscoveryTTL {
+		return minDiscoveryTTL
+	}
+	if ttl > maxDiscoveryTTL {
+		return maxDiscoveryTTL
+	}
+	return ttl
+}
+
+// SetResolver 替换 DNS 发现使用的解析器，须在 Start 之前调用
+func (c *Client) SetResolver(resolver Resolver) {
+	c.resolver = resolver
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"agent/config"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS 是只应答 UDP 查询的 DNS 服务器，records 中没有的名称返回 NXDOMAIN。
+// 记录在 serve 启动前添加。
+type stubDNS struct {
+	conn    net.PacketConn
+	records map[dnsmessage.Type]map[string][]dnsmessage.Resource
+}
+
+func newStubDNS(t *testing.T) *stubDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubDNS{conn: conn, records: make(map[dnsmessage.Type]map[string][]dnsmessage.Resource)}
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func (s *stubDNS) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubDNS) add(name string, ttl uint32, body dnsmessage.ResourceBody) {
+	qname := dnsmessage.MustNewName(name)
+	var rtype dnsmessage.Type
+	switch body.(type) {
+	case *dnsmessage.AResource:
+		rtype = dnsmessage.TypeA
+	case *dnsmessage.AAAAResource:
+		rtype = dnsmessage.TypeAAAA
+	case *dnsmessage.SRVResource:
+		rtype = dnsmessage.TypeSRV
+	}
+	if s.records[rtype] == nil {
+		s.records[rtype] = make(map[string][]dnsmessage.Resource)
+	}
+	s.records[rtype][name] = append(s.records[rtype][name], dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: qname, Type: rtype, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	})
+}
+
+// exists 返回 name 是否有任一类型的记录
+func (s *stubDNS) exists(name string) bool {
+	for _, byName := range s.records {
+		if len(byName[name]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stubDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, peer, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) == 0 {
+			continue
+		}
+		question := query.Questions[0]
+		reply := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		name := question.Name.String()
+		if !s.exists(name) {
+			reply.RCode = dnsmessage.RCodeNameError
+		}
+		reply.Answers = s.records[question.Type][name]
+		packed, err := reply.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(packed, peer)
+	}
+}
+
+// staticResolver 返回固定的结果，用作回退解析器
+type staticResolver struct {
+	srv   []*net.SRV
+	hosts map[string][]string
+}
+
+func (r staticResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	if len(r.srv) == 0 {
+		return nil, 0, errNoRecords
+	}
+	return r.srv, systemResolverTTL, nil
+}
+
+func (r staticResolver) LookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, 0, errNoRecords
+	}
+	return addrs, systemResolverTTL, nil
+}
+
+func newTestStubDNS(t *testing.T) *stubDNS {
+	s := newStubDNS(t)
+	s.add("_pbm._tcp.example.test.", 300, &dnsmessage.SRVResource{Priority: 10, Weight: 1, Port: 9601, Target: dnsmessage.MustNewName("hub2.example.test.")})
+	s.add("_pbm._tcp.example.test.", 60, &dnsmessage.SRVResource{Priority: 0, Weight: 1, Port: 9600, Target: dnsmessage.MustNewName("hub1.example.test.")})
+	s.add("hub1.example.test.", 120, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	s.add("hub1.example.test.", 30, &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}})
+	s.add("hub2.example.test.", 600, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}})
+	go s.serve()
+	return s
+}
+
+func TestDNSResolver(t *testing.T) {
+	stub := newTestStubDNS(t)
+	fallback := staticResolver{hosts: map[string][]string{"hosts-only.test": {"127.0.0.1"}}}
+	ctx := context.Background()
+
+	t.Run("srv", func(t *testing.T) {
+		r := &dnsResolver{servers: []string{stub.addr()}}
+		records, ttl, err := r.LookupSRV(ctx, "_pbm._tcp.example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []*net.SRV{
+			{Target: "hub2.example.test.", Port: 9601, Priority: 10, Weight: 1},
+			{Target: "hub1.example.test.", Port: 9600, Priority: 0, Weight: 1},
+		}
+		if !reflect.DeepEqual(records, want) {
+			t.Fatalf("records = %+v, want %+v", records, want)
+		}
+		if ttl != 60*time.Second {
+			t.Fatalf("ttl = %v, want 60s", ttl)
+		}
+	})
+
+	tests := []struct {
+		name      string
+		host      string
+		fallback  Resolver
+		wantAddrs []string
+		wantTTL   time.Duration
+		wantError bool
+	}{
+		{"a and aaaa", "hub1.example.test", nil, []string{"192.0.2.1", "2001:db8::1"}, 30 * time.Second, false},
+		{"a only", "hub2.example.test", nil, []string{"192.0.2.2"}, 600 * time.Second, false},
+		{"a only ignores fallback", "hub2.example.test", fallback, []string{"192.0.2.2"}, 600 * time.Second, false},
+		{"nxdomain", "hosts-only.test", nil, nil, 0, true},
+		{"nxdomain falls back", "hosts-only.test", fallback, []string{"127.0.0.1"}, systemResolverTTL, false},
+		{"fallback fails too", "missing.test", fallback, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &dnsResolver{servers: []string{stub.addr()}, fallback: tt.fallback}
+			addrs, ttl, err := r.LookupHost(ctx, tt.host)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("err = %v, want error %v", err, tt.wantError)
+			}
+			if !reflect.DeepEqual(addrs, tt.wantAddrs) || ttl != tt.wantTTL {
+				t.Fatalf("got %v ttl %v, want %v ttl %v", addrs, ttl, tt.wantAddrs, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	stub := newTestStubDNS(t)
+
+	tests := []struct {
+		name    string
+		mode    string
+		address string
+		servers []string // 为空时使用 stub
+		want    []hubTarget
+	}{
+		{"off", "off", "hub.example.test", nil, []hubTarget{
+			{"hub.example.test:9527", "hub.example.test"},
+			{"backup.example.test:9527", "backup.example.test"},
+		}},
+		{"dns keeps hub.address as fallback", "dns", "hub1.example.test", nil, []hubTarget{
+			{"192.0.2.1:9527", "hub1.example.test"},
+			{"[2001:db8::1]:9527", "hub1.example.test"},
+			{"hub1.example.test:9527", "hub1.example.test"},
+			{"backup.example.test:9527", "backup.example.test"},
+		}},
+		{"dns lookup fails", "dns", "hub1.example.test", []string{"127.0.0.1:1"}, []hubTarget{
+			{"hub1.example.test:9527", "hub1.example.test"},
+			{"backup.example.test:9527", "backup.example.test"},
+		}},
+		{"srv", "srv", "example.test", nil, []hubTarget{
+			{"192.0.2.1:9600", "hub1.example.test"},
+			{"[2001:db8::1]:9600", "hub1.example.test"},
+			{"192.0.2.2:9601", "hub2.example.test"},
+			{"backup.example.test:9527", "backup.example.test"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Hub.Address = tt.address
+			cfg.Hub.Port = 9527
+			cfg.Hub.BackupAddresses = []string{"backup.example.test"}
+			cfg.Hub.Discovery.Mode = tt.mode
+			servers := tt.servers
+			if servers == nil {
+				servers = []string{stub.addr()}
+			}
+			d, err := newDiscovery(cfg, &dnsResolver{servers: servers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := d.resolve(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("targets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewResolverFallback(t *testing.T) {
+	r, ok := NewResolver([]string{"192.0.2.53"}).(*dnsResolver)
+	if !ok {
+		t.Fatal("配置了 DNS 服务器时应直接查询")
+	}
+	if !reflect.DeepEqual(r.servers, []string{"192.0.2.53:53"}) {
+		t.Fatalf("servers = %v", r.servers)
+	}
+	if r.fallback == nil {
+		t.Fatal("直接查询失败时应回退到系统解析器")
+	}
+}
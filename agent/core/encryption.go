@@ -0,0 +1,190 @@
+package core
+
+import (
+	"agent/config"
+	"agent/logger"
+	"agent/protocol"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var ErrEncryptionUnsupported = &permanentError{errors.New("Hub 不支持负载加密, 而配置要求加密 (hub.encryption.mode)")}
+
+// encryptionConfig 是解析后的 hub.encryption 配置
+type encryptionConfig struct {
+	required bool
+	hubKey   *ecdh.PublicKey // 配置中的 Hub 长期公钥，为 nil 时使用注册时 Hub 下发的公钥
+}
+
+// newEncryptionConfig 解析 hub.encryption 配置，未启用加密时返回 nil
+func newEncryptionConfig(cfg *config.Config) (*encryptionConfig, error) {
+	ec := cfg.Hub.Encryption
+	encryption := &encryptionConfig{}
+	switch ec.Mode {
+	case "", "off":
+		return nil, nil
+	case "preferred":
+	case "required":
+		encryption.required = true
+	default:
+		return nil, fmt.Errorf("未知的加密模式: %s", ec.Mode)
+	}
+
+	if ec.PublicKey != "" {
+		key, err := parseX25519PublicKey(ec.PublicKey)
+		if err != nil {
+			return nil, errors.New("无效的 Hub X25519 公钥 (hub.encryption.publicKey)")
+		}
+		encryption.hubKey = key
+	}
+	return encryption, nil
+}
+
+func parseX25519PublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// hubEncryptionKeyLocked 返回 Hub 的长期公钥：配置优先，其次为注册时 Hub 下发的公钥，都没有时返回 nil。
+// 调用方须持有 c.mutex。
+func (c *Client) hubEncryptionKeyLocked() *ecdh.PublicKey {
+	if c.encryption.hubKey != nil {
+		return c.encryption.hubKey
+	}
+	if c.credential == nil || c.credential.HubKey == "" {
+		return nil
+	}
+	key, err := parseX25519PublicKey(c.credential.HubKey)
+	if err != nil {
+		logger.Warn("凭据中的 Hub 公钥无效:", err)
+		return nil
+	}
+	return key
+}
+
+// checkEncryptionKey 在启动时确认负载加密所需的 Hub 公钥可用。
+// 要求加密时缺少公钥是配置错误；否则在取得公钥（如完成注册）之前以明文传输负载。
+func (c *Client) checkEncryptionKey() error {
+	c.mutex.RLock()
+	key := c.hubEncryptionKeyLocked()
+	c.mutex.RUnlock()
+	if key != nil {
+		return nil
+	}
+	if c.encryption.required {
+		return errors.New("负载加密需要 Hub 公钥, 请配置 hub.encryption.publicKey 或先完成注册")
+	}
+	logger.Warn("没有可用的 Hub 公钥, 暂不加密负载")
+	return nil
+}
+
+// keyExchange 是一个连接上负载加密的密钥交换状态。Agent 在 HELLO 中给出临时公钥，
+// 接收循环收到 Hub 的 HELLO 回复后派生会话密钥，从此只接受加密的帧。
+// arm 在接收循环中调用，结果经由 HELLO 回复所在的 control channel 交给握手流程读取。
+type keyExchange struct {
+	private *ecdh.PrivateKey
+	hubKey  *ecdh.PublicKey
+	armed   bool
+	send    *protocol.FrameCipher // Agent→Hub，Hub 同意加密后设置
+	err     error                 // Hub 同意加密但无法派生密钥时的错误
+}
+
+// newKeyExchangeLocked 为新连接生成临时密钥，未启用加密或没有 Hub 公钥时返回 nil。
+// 调用方须持有 c.mutex。
+func (c *Client) newKeyExchangeLocked() (*keyExchange, error) {
+	if c.encryption == nil {
+		return nil, nil
+	}
+	hubKey := c.hubEncryptionKeyLocked()
+	if hubKey == nil {
+		return nil, nil
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("生成临时密钥失败: %v", err)
+	}
+	return &keyExchange{private: private, hubKey: hubKey}, nil
+}
+
+// keyShare 返回 HELLO 中通告的临时公钥
+func (x *keyExchange) keyShare() string {
+	return base64.StdEncoding.EncodeToString(x.private.PublicKey().Bytes())
+}
+
+// arm 在 Hub 同意加密时派生会话密钥，并为 parser 设置解密密钥；只在第一个 HELLO 回复上生效
+func (x *keyExchange) arm(hello *protocol.HelloPayload, parser *protocol.MessageParser) {
+	if x.armed {
+		return
+	}
+	x.armed = true
+	if !contains(hello.Features, protocol.FeatureEncryption) {
+		return
+	}
+	send, recv, err := x.derive(hello.KeyShare)
+	if err != nil {
+		x.err = err
+		return
+	}
+	parser.SetCipher(recv)
+	x.send = send
+}
+
+// derive 以 Hub 的临时公钥派生双向的会话密钥
+func (x *keyExchange) derive(keyShare string) (send, recv *protocol.FrameCipher, err error) {
+	hubEphemeral, err := parseX25519PublicKey(keyShare)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Hub 的临时公钥无效: %v", err)
+	}
+	ephemeral, err := x.private.ECDH(hubEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	static, err := x.private.ECDH(x.hubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	agentToHub, hubToAgent, err := protocol.PayloadKeys(ephemeral, static, x.private.PublicKey().Bytes(), hubEphemeral.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	if send, err = protocol.NewFrameCipher(agentToHub); err != nil {
+		return nil, nil, err
+	}
+	if recv, err = protocol.NewFrameCipher(hubToAgent); err != nil {
+		return nil, nil, err
+	}
+	return send, recv, nil
+}
+
+// negotiateEncryption 在握手完成后确定本连接是否加密负载：配置要求加密而 Hub 不支持时返回错误
+func (c *Client) negotiateEncryption(caps *Capabilities, exchange *keyExchange) error {
+	if exchange == nil {
+		return nil
+	}
+	if !caps.Supports(protocol.FeatureEncryption) {
+		if c.encryption.required {
+			return ErrEncryptionUnsupported
+		}
+		// preferred 模式无法区分旧版 Hub 与中间人去掉了加密能力，只有 required 能防止降级
+		logger.Warn("Hub 未同意负载加密, 以明文传输负载; 如需防止降级请将 hub.encryption.mode 设为 required")
+		return nil
+	}
+	if exchange.err != nil {
+		return fmt.Errorf("负载加密协商失败: %v", exchange.err)
+	}
+	caps.cipher = exchange.send
+	return nil
+}
+
+// encrypted 判断当前连接是否已就绪且协商了负载加密
+func (c *Client) encrypted() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.state == StateReady && c.caps.cipher != nil
+}
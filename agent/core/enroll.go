@@ -0,0 +1,224 @@
+package core
+
+import (
+	"agent/config"
+	"agent/logger"
+	"agent/protocol"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrEnrollUnsupported = &permanentError{errors.New("Hub 不支持注册, 无法使用注册令牌 (auth.enrollToken)")}
+
+// loadCredential 读取数据目录中的专属凭据，重新注册时忽略已有凭据
+func (c *Client) loadCredential() error {
+	c.credentials = newCredentialStore(c.cfg.Auth.CredentialDir)
+	if c.reenroll {
+		return nil
+	}
+	cred, err := c.credentials.Load()
+	if err != nil {
+		return err
+	}
+	if cred != nil {
+		if err := c.useCredential(cred); err != nil {
+			return err
+		}
+		logger.Info("使用专属凭据认证, 签发时间:", cred.IssuedAt.Format(time.RFC3339))
+		if c.cfg.Auth.EnrollToken != "" {
+			logger.Warn("已完成注册, 配置中的注册令牌 (auth.enrollToken) 不再使用, 建议删除")
+		}
+	}
+
+	// 上次轮换未完成（如认证前进程退出）时，首次连接仍先以新凭据尝试
+	pending, err := c.credentials.LoadPending()
+	if err != nil || pending == nil {
+		if err != nil {
+			logger.Error("读取轮换中的新凭据失败:", err)
+			c.credentials.DiscardPending()
+		}
+		return nil
+	}
+	if err := c.setPendingCredential(pending); err != nil {
+		logger.Error("轮换中的新凭据无效:", err)
+		c.credentials.DiscardPending()
+	}
+	return nil
+}
+
+// useCredential 启用凭据：专属密钥替代 auth.key，证书替代配置中的 mTLS 客户端证书
+func (c *Client) useCredential(cred *Credential) error {
+	cert, err := cred.tlsCertificate()
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.credential = cred
+	if cert != nil && c.tlsConfig != nil {
+		conf := c.tlsConfig.Clone()
+		conf.Certificates = []tls.Certificate{*cert}
+		c.tlsConfig = conf
+	}
+	return nil
+}
+
+// authKey 返回认证使用的密钥：轮换中的新密钥优先，其次为凭据中的密钥，否则为 auth.key
+func (c *Client) authKey() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.pending != nil && c.pending.Secret != "" {
+		return c.pending.Secret
+	}
+	if c.credential != nil && c.credential.Secret != "" {
+		return c.credential.Secret
+	}
+	return c.cfg.Auth.Key
+}
+
+// signingKey 返回派生 HMAC 帧签名密钥所用的密钥，注册期间 Hub 尚未签发凭据，使用注册令牌
+func (c *Client) signingKey() string {
+	if c.needsEnrollment() {
+		return c.cfg.Auth.EnrollToken
+	}
+	return c.authKey()
+}
+
+// needsEnrollment 判断本次连接是否需要先以注册令牌换取凭据
+func (c *Client) needsEnrollment() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.credential == nil && c.cfg.Auth.EnrollToken != ""
+}
+
+// enroll 以注册令牌换取专属凭据并保存，随后在同一连接上以新凭据认证。
+// 注册消息与 HELLO 一样始终以 JSON 发送，协商了负载加密时加密；令牌无效时 Hub 以 AUTH_FAIL 拒绝。
+func (c *Client) enroll(queue *sendQueue, control <-chan *protocol.Message, caps Capabilities) error {
+	if !caps.Supports(protocol.FeatureEnroll) {
+		return ErrEnrollUnsupported
+	}
+
+	payload := &protocol.EnrollPayload{
+		Token: c.cfg.Auth.EnrollToken,
+		UUID:  GetAgentUUID(),
+		Alias: c.cfg.Agent.Alias,
+	}
+	var keyPEM string
+	if c.cfg.Hub.TLS.Enabled {
+		csr, key, err := newCertificateRequest(payload.UUID)
+		if err != nil {
+			return fmt.Errorf("生成证书签名请求失败: %v", err)
+		}
+		payload.CSR, keyPEM = csr, key
+	}
+
+	logger.Info("正在以注册令牌向 Hub 注册...")
+	if err := c.enqueue(queue, protocol.EncodeOptions{Cipher: caps.cipher}, protocol.NewMessage(protocol.MessageTypeEnroll, payload)); err != nil {
+		return fmt.Errorf("发送注册消息失败: %v", err)
+	}
+
+	timer := time.NewTimer(authTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-control:
+			switch msg.Header.Type {
+			case protocol.MessageTypeEnrollOK:
+				result, ok := msg.Payload.(*protocol.EnrollResultPayload)
+				if !ok || (result.Secret == "" && result.Certificate == "") {
+					return errors.New("Hub 未签发凭据")
+				}
+				cred := &Credential{
+					Secret:      result.Secret,
+					Certificate: result.Certificate,
+					HubKey:      result.EncryptionKey,
+					IssuedAt:    time.Now(),
+				}
+				if result.Certificate != "" {
+					cred.PrivateKey = keyPEM
+				}
+				return c.saveCredential(cred)
+			case protocol.MessageTypeAuthFail:
+				return authError(msg)
+			}
+			logger.Warn("等待注册结果时收到意外的消息:", msg.Header.Type)
+		case <-timer.C:
+			return errors.New("等待注册结果超时")
+		case <-queue.done:
+			return connectionLost(control)
+		case <-c.stop:
+			return ErrConnectionLost
+		}
+	}
+}
+
+// saveCredential 保存并启用新签发的凭据，重新注册时旧凭据改名留档
+func (c *Client) saveCredential(cred *Credential) error {
+	if c.reenroll {
+		if err := c.credentials.Discard("old"); err != nil {
+			return &permanentError{fmt.Errorf("备份旧凭据失败: %v", err)}
+		}
+	}
+	if err := c.credentials.Save(cred); err != nil {
+		// 凭据无法落盘时令牌已被消耗，重试也无济于事
+		return &permanentError{fmt.Errorf("保存凭据失败: %v", err)}
+	}
+	if err := c.useCredential(cred); err != nil {
+		return &permanentError{err}
+	}
+	logger.Info("注册成功, 凭据已保存到", c.credentials.path())
+	c.enrollOnce.Do(func() { close(c.enrolled) })
+	return nil
+}
+
+// credentialRevoked 在 Hub 以 revoked 拒绝专属凭据时将其改名留档，之后需重新注册
+func (c *Client) credentialRevoked(err error) error {
+	c.mutex.Lock()
+	hadCredential := c.credential != nil
+	c.credential = nil
+	c.mutex.Unlock()
+	if !hadCredential {
+		return err
+	}
+	if discardErr := c.credentials.Discard("revoked"); discardErr != nil {
+		logger.Error("移除已吊销的凭据失败:", discardErr)
+	}
+	return &permanentError{fmt.Errorf("%w: %v", ErrCredentialRevoked, err)}
+}
+
+// Enrolled 返回注册成功并保存凭据后关闭的 channel
+func (c *Client) Enrolled() <-chan struct{} {
+	return c.enrolled
+}
+
+// Enroll 以一次性注册令牌向 Hub 注册并保存专属凭据，供 enroll 命令使用。
+// 已有凭据时只在注册成功后才将其替换，失败时原凭据保持不变。
+func Enroll(cfg *config.Config, token string, timeout time.Duration) error {
+	enrollCfg := *cfg
+	enrollCfg.Auth.EnrollToken = token
+	enrollCfg.Outbox.Enabled = false
+	enrollCfg.Audit.Enabled = false
+
+	client := NewClient(&enrollCfg)
+	client.SetCollector(NewCollector(&enrollCfg))
+	client.reenroll = true
+	if err := client.Start(); err != nil {
+		return err
+	}
+	defer client.Stop()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-client.Enrolled():
+		return nil
+	case <-client.Done():
+		return client.Err()
+	case <-timer.C:
+		return errors.New("注册超时")
+	}
+}
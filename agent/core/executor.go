@@ -0,0 +1,159 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrExecutorStopped 表示任务执行器已停止，不再接受任务
+var ErrExecutorStopped = errors.New("任务执行器已停止")
+
+// TaskHandler 执行一种类型的任务，返回的结果会作为 TRSLT 消息的 result 上报
+type TaskHandler func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error)
+
+// TaskExecutor 接收 Hub 下发的任务请求，按类型分发给已注册的处理器并上报执行状态
+type TaskExecutor struct {
+	send     func(msg *protocol.Message) error
+	handlers map[string]TaskHandler
+	actions  map[string]TaskHandler // custom 任务的处理器，按 action 区分
+	running  map[int64]context.CancelFunc
+	stopped  bool // 由 Stop 设置，与 wg.Add 同在 mutex 下，保证 Stop 等待期间不再有任务启动
+	mutex    sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewTaskExecutor(send func(msg *protocol.Message) error) *TaskExecutor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TaskExecutor{
+		send:     send,
+		handlers: make(map[string]TaskHandler),
+		actions:  make(map[string]TaskHandler),
+		running:  make(map[int64]context.CancelFunc),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// RegisterHandler 注册任务处理器，同类型的处理器会被覆盖
+func (e *TaskExecutor) RegisterHandler(taskType string, handler TaskHandler) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.handlers[taskType] = handler
+}
+
+// RegisterCustomAction 注册 custom 任务中名为 action 的处理器，同名的处理器会被覆盖
+func (e *TaskExecutor) RegisterCustomAction(action string, handler TaskHandler) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.actions[action] = handler
+}
+
+// Submit 解析 TREQ 消息并异步执行任务
+func (e *TaskExecutor) Submit(msg *protocol.Message) error {
+	var task protocol.TaskRequestPayload
+	if req, ok := msg.Payload.(*protocol.TaskRequestPayload); ok {
+		task = *req
+	} else if err := msg.DecodePayload(&task); err != nil {
+		return fmt.Errorf("解析任务请求失败: %v", err)
+	}
+
+	e.mutex.Lock()
+	if e.stopped {
+		e.mutex.Unlock()
+		return ErrExecutorStopped
+	}
+	if _, exists := e.running[task.TaskID]; exists {
+		e.mutex.Unlock()
+		logger.Warn("任务已在执行中, 忽略重复请求:", task.TaskID)
+		return nil
+	}
+	handler, exists := e.handlers[task.Type]
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.running[task.TaskID] = cancel
+	e.wg.Add(1)
+	e.mutex.Unlock()
+
+	go func() {
+		defer e.wg.Done()
+		defer func() {
+			e.mutex.Lock()
+			delete(e.running, task.TaskID)
+			e.mutex.Unlock()
+			cancel()
+		}()
+
+		if !exists {
+			logger.Error("未注册的任务类型:", task.Type, "任务:", task.TaskID)
+			e.report(&task, protocol.TaskStatusFailed, nil, fmt.Errorf("未注册的任务类型: %s", task.Type))
+			return
+		}
+		e.run(ctx, &task, handler)
+	}()
+	return nil
+}
+
+func (e *TaskExecutor) run(ctx context.Context, task *protocol.TaskRequestPayload, handler TaskHandler) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("任务执行发生panic:", task.TaskID, r)
+			e.report(task, protocol.TaskStatusFailed, nil, fmt.Errorf("任务执行发生panic: %v", r))
+		}
+	}()
+
+	logger.Info("开始执行任务:", task.TaskID, "类型:", task.Type)
+	e.report(task, protocol.TaskStatusRunning, nil, nil)
+
+	result, err := handler(ctx, task)
+	if err != nil {
+		logger.Error("任务执行失败:", task.TaskID, err)
+		e.report(task, protocol.TaskStatusFailed, result, err)
+		return
+	}
+
+	logger.Info("任务执行完成:", task.TaskID)
+	e.report(task, protocol.TaskStatusCompleted, result, nil)
+}
+
+// report 以 TRSLT 消息上报任务状态
+func (e *TaskExecutor) report(task *protocol.TaskRequestPayload, status protocol.TaskStatus, result interface{}, err error) {
+	payload := &protocol.TaskResultPayload{
+		TaskID: task.TaskID,
+		UUID:   GetAgentUUID(),
+		Status: status,
+		Result: result,
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	if sendErr := e.send(protocol.NewMessage(protocol.MessageTypeTaskResult, payload)); sendErr != nil {
+		logger.Error("上报任务状态失败:", task.TaskID, status, sendErr)
+	}
+}
+
+// Cancel 取消正在执行的任务
+func (e *TaskExecutor) Cancel(taskID int64) bool {
+	e.mutex.RLock()
+	cancel, exists := e.running[taskID]
+	e.mutex.RUnlock()
+	if exists {
+		cancel()
+	}
+	return exists
+}
+
+// Stop 取消所有任务并等待其退出，之后的 Submit 返回 ErrExecutorStopped
+func (e *TaskExecutor) Stop() error {
+	e.mutex.Lock()
+	e.stopped = true
+	e.mutex.Unlock()
+	e.cancel()
+	e.wg.Wait()
+	return nil
+}
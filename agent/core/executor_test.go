@@ -0,0 +1,230 @@
+package core
+
+import (
+	"agent/protocol"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resultRecorder 收集执行器上报的 TRSLT
+type resultRecorder struct {
+	results chan *protocol.TaskResultPayload
+}
+
+func newResultRecorder() *resultRecorder {
+	return &resultRecorder{results: make(chan *protocol.TaskResultPayload, 16)}
+}
+
+func (r *resultRecorder) send(msg *protocol.Message) error {
+	if msg.Header.Type == protocol.MessageTypeTaskResult {
+		r.results <- msg.Payload.(*protocol.TaskResultPayload)
+	}
+	return nil
+}
+
+func (r *resultRecorder) next(t *testing.T) *protocol.TaskResultPayload {
+	t.Helper()
+	select {
+	case result := <-r.results:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待任务结果超时")
+		return nil
+	}
+}
+
+func taskRequest(id int64, taskType string) *protocol.Message {
+	return protocol.NewMessage(protocol.MessageTypeTaskRequest, &protocol.TaskRequestPayload{TaskID: id, Type: taskType})
+}
+
+func TestCustomHandler(t *testing.T) {
+	e := NewTaskExecutor(func(*protocol.Message) error { return nil })
+	RegisterBuiltinTaskHandlers(e, nil)
+	e.RegisterCustomAction("echo", func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+		var params map[string]string
+		if err := json.Unmarshal(task.Config, &params); err != nil {
+			return nil, err
+		}
+		return params["msg"], nil
+	})
+
+	tests := []struct {
+		name    string
+		config  string
+		want    interface{}
+		wantErr string
+	}{
+		{"dispatch", `{"action":"echo","params":{"msg":"hi"}}`, "hi", ""},
+		{"string config", `"{\"action\":\"echo\",\"params\":{\"msg\":\"s\"}}"`, "s", ""},
+		{"missing action", `{"params":{}}`, nil, "未指定 action"},
+		{"unknown action", `{"action":"nope"}`, nil, "未注册的自定义任务"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e.mutex.RLock()
+			handler := e.handlers[TaskTypeCustom]
+			e.mutex.RUnlock()
+			if handler == nil {
+				t.Fatal("custom 任务没有注册处理器")
+			}
+			got, err := handler(context.Background(), &protocol.TaskRequestPayload{TaskID: 1, Type: TaskTypeCustom, Config: json.RawMessage(tt.config)})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskExecutorSubmit(t *testing.T) {
+	useTestAgentUUID()
+	tests := []struct {
+		name       string
+		taskType   string
+		handler    TaskHandler
+		wantStatus []protocol.TaskStatus
+		wantError  string
+	}{
+		{"completed", "echo", func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+			return "ok", nil
+		}, []protocol.TaskStatus{protocol.TaskStatusRunning, protocol.TaskStatusCompleted}, ""},
+		{"failed", "echo", func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+			return nil, errors.New("boom")
+		}, []protocol.TaskStatus{protocol.TaskStatusRunning, protocol.TaskStatusFailed}, "boom"},
+		{"panic recovered", "echo", func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+			panic("handler bug")
+		}, []protocol.TaskStatus{protocol.TaskStatusRunning, protocol.TaskStatusFailed}, "panic"},
+		{"unknown type", "nope", nil, []protocol.TaskStatus{protocol.TaskStatusFailed}, "未注册的任务类型"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newResultRecorder()
+			e := NewTaskExecutor(recorder.send)
+			if tt.handler != nil {
+				e.RegisterHandler("echo", tt.handler)
+			}
+			if err := e.Submit(taskRequest(7, tt.taskType)); err != nil {
+				t.Fatal(err)
+			}
+			var last *protocol.TaskResultPayload
+			for _, status := range tt.wantStatus {
+				last = recorder.next(t)
+				if last.TaskID != 7 || last.Status != status {
+					t.Fatalf("result = %+v, want status %s", last, status)
+				}
+			}
+			if !strings.Contains(last.Error, tt.wantError) || (tt.wantError == "" && last.Result != "ok") {
+				t.Fatalf("final result = %+v, want error %q", last, tt.wantError)
+			}
+			e.Stop()
+		})
+	}
+}
+
+func TestTaskExecutorDuplicate(t *testing.T) {
+	useTestAgentUUID()
+	recorder := newResultRecorder()
+	e := NewTaskExecutor(recorder.send)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	e.RegisterHandler("block", func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+		calls.Add(1)
+		<-release
+		return nil, nil
+	})
+
+	if err := e.Submit(taskRequest(1, "block")); err != nil {
+		t.Fatal(err)
+	}
+	recorder.next(t) // running
+	// 同一任务执行期间的重复请求被忽略
+	if err := e.Submit(taskRequest(1, "block")); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if result := recorder.next(t); result.Status != protocol.TaskStatusCompleted {
+		t.Fatalf("result = %+v", result)
+	}
+	e.Stop()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler called %d times, want 1", n)
+	}
+}
+
+func TestTaskExecutorStop(t *testing.T) {
+	useTestAgentUUID()
+	recorder := newResultRecorder()
+	e := NewTaskExecutor(recorder.send)
+	e.RegisterHandler("wait", func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	if err := e.Submit(taskRequest(1, "wait")); err != nil {
+		t.Fatal(err)
+	}
+	recorder.next(t) // running
+
+	stopped := make(chan struct{})
+	go func() {
+		e.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop 未取消正在执行的任务")
+	}
+	if result := recorder.next(t); result.Status != protocol.TaskStatusFailed || !strings.Contains(result.Error, context.Canceled.Error()) {
+		t.Fatalf("result = %+v", result)
+	}
+	if err := e.Submit(taskRequest(2, "wait")); !errors.Is(err, ErrExecutorStopped) {
+		t.Fatalf("Submit after Stop = %v, want %v", err, ErrExecutorStopped)
+	}
+}
+
+// TestTaskExecutorSubmitDuringStop 在 -race 下检查与 Stop 并发的 Submit：Stop 返回后不再有任务在执行
+func TestTaskExecutorSubmitDuringStop(t *testing.T) {
+	useTestAgentUUID()
+	e := NewTaskExecutor(func(*protocol.Message) error { return nil })
+	var active atomic.Int32
+	e.RegisterHandler("work", func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+		active.Add(1)
+		defer active.Add(-1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for id := int64(i * 1000); id < int64(i*1000+50); id++ {
+				if err := e.Submit(taskRequest(id, "work")); err != nil && !errors.Is(err, ErrExecutorStopped) {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	time.Sleep(time.Millisecond)
+	e.Stop()
+	if n := active.Load(); n != 0 {
+		t.Fatalf("Stop 返回后仍有 %d 个任务在执行", n)
+	}
+	wg.Wait()
+	if n := active.Load(); n != 0 {
+		t.Fatalf("Stop 之后启动了 %d 个任务", n)
+	}
+}
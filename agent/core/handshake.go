@@ -0,0 +1,425 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Version 是 Agent 的构建版本，发布时通过 -ldflags "-X agent/core.Version=x.y.z" 注入
+var Version = "dev"
+
+const (
+	// helloTimeout 是等待 Hub 回复 HELLO 的时长，超时视为不支持握手的旧版 Hub
+	helloTimeout = 5 * time.Second
+	// authTimeout 是等待 AUTH_OK/AUTH_FAIL 的时长
+	authTimeout = 10 * time.Second
+)
+
+var (
+	errAuthTimeout = errors.New("等待认证结果超时")
+
+	// ErrChallengeUnsupported 不是永久错误：Hub 升级后重连即可认证
+	ErrChallengeUnsupported = errors.New("Hub 未下发认证挑战, 而配置不允许明文发送密钥 (auth.allowPlaintextKey), 请升级 Hub")
+)
+
+// permanentError 标记重试无法解决的错误，如配置错误
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string   { return e.err.Error() }
+func (e *permanentError) Unwrap() error   { return e.err }
+func (e *permanentError) Permanent() bool { return true }
+
+// AuthError 表示 Hub 以 AUTH_FAIL 拒绝了认证
+type AuthError struct {
+	Reason     protocol.AuthFailReason
+	Message    string
+	Unverified bool // 要求签名而 AUTH_FAIL 在签名校验启用前收到，可能是伪造的
+}
+
+func (e *AuthError) Error() string {
+	reason := string(e.Reason)
+	if e.Unverified {
+		reason += ", 未经签名校验"
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("认证被 Hub 拒绝 (原因: %s)", reason)
+	}
+	return fmt.Sprintf("认证被 Hub 拒绝 (原因: %s): %s", reason, e.Message)
+}
+
+// Permanent 判断重试能否解决该错误，未经校验的拒绝总是重试
+func (e *AuthError) Permanent() bool {
+	return !e.Unverified && e.Reason.Permanent()
+}
+
+// authError 将 AUTH_FAIL 消息转换为 *AuthError
+func authError(msg *protocol.Message) *AuthError {
+	var result protocol.AuthResultPayload
+	if err := msg.DecodePayload(&result); err != nil {
+		logger.Error("解析认证结果失败:", err)
+	}
+	return &AuthError{Reason: result.Reason, Message: result.Message}
+}
+
+// Capabilities 是与 Hub 协商出的能力集合
+type Capabilities struct {
+	ProtocolVersion uint8
+	HubVersion      string
+	Codec           protocol.Codec
+	Compressor      protocol.Compressor // nil 表示不压缩
+	Features        []string
+	MaxFrameSize    uint32 // Hub 可接受的单帧负载上限（字节），0 表示未声明
+	Legacy          bool   // Hub 未回复 HELLO，按旧版协议通信
+
+	challenge string                // Hub 下发的认证挑战，仅用于本连接的认证
+	cipher    *protocol.FrameCipher // Agent→Hub 的负载加密密钥，未协商加密时为 nil
+}
+
+// Supports 判断 Hub 是否同意启用 feature
+func (c Capabilities) Supports(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyCapabilities 返回不支持握手的旧版 Hub 所具备的能力：JSON 负载、不压缩，支持任务下发
+func legacyCapabilities() Capabilities {
+	return Capabilities{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Codec:           protocol.JSONCodec,
+		Features:        []string{protocol.FeatureTasks},
+		Legacy:          true,
+	}
+}
+
+// Capabilities 返回最近一次握手协商出的能力，尚未完成握手时为零值
+func (c *Client) Capabilities() Capabilities {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.caps
+}
+
+// AdvertiseFeature 声明本端支持 feature，从下一次握手起通告给 Hub
+func (c *Client) AdvertiseFeature(feature string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, f := range c.features {
+		if f == feature {
+			return
+		}
+	}
+	c.features = append(c.features, feature)
+}
+
+// localHello 构造本端通告的能力，编码格式和压缩算法按偏好排列；exchange 不为 nil 时通告负载加密
+func (c *Client) localHello(exchange *keyExchange) *protocol.HelloPayload {
+	hello := &protocol.HelloPayload{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Version:         Version,
+	}
+
+	codec := c.configuredCodec()
+	hello.Codecs = append(hello.Codecs, codec.Name())
+	if codec.ID() != protocol.CodecJSON {
+		hello.Codecs = append(hello.Codecs, protocol.JSONCodec.Name())
+	}
+	if compressor, ok := protocol.CompressorByName(c.cfg.Hub.Compression); ok {
+		hello.Compression = append(hello.Compression, compressor.Name())
+	}
+
+	if c.executor != nil {
+		hello.Features = append(hello.Features, protocol.FeatureTasks)
+	}
+	if c.acks != nil {
+		hello.Features = append(hello.Features, protocol.FeatureAcks)
+	}
+	if c.signing != nil {
+		hello.Features = append(hello.Features, protocol.FeatureSignedFrames)
+	}
+	if c.needsEnrollment() {
+		hello.Features = append(hello.Features, protocol.FeatureEnroll)
+	}
+	hello.Features = append(hello.Features, protocol.FeatureRotate, protocol.FeatureHeartbeatEcho)
+	if exchange != nil {
+		hello.Features = append(hello.Features, protocol.FeatureEncryption)
+		hello.KeyShare = exchange.keyShare()
+	}
+	c.mutex.RLock()
+	hello.Features = append(hello.Features, c.features...)
+	c.mutex.RUnlock()
+
+	if c.cfg.Agent.MaxFrameSize > 0 {
+		hello.MaxFrameSize = uint32(c.cfg.Agent.MaxFrameSize) << 10
+	} else {
+		hello.MaxFrameSize = protocol.DefaultMaxPayloadSize
+	}
+	return hello
+}
+
+// negotiate 根据 Hub 的回复确定本连接的能力，Hub 选择了本端未通告的项时忽略该项
+func negotiate(local, remote *protocol.HelloPayload) Capabilities {
+	caps := Capabilities{
+		ProtocolVersion: remote.ProtocolVersion,
+		HubVersion:      remote.Version,
+		Codec:           protocol.JSONCodec,
+		MaxFrameSize:    remote.MaxFrameSize,
+		challenge:       remote.Nonce,
+	}
+	if caps.ProtocolVersion == 0 || caps.ProtocolVersion > local.ProtocolVersion {
+		caps.ProtocolVersion = local.ProtocolVersion
+	}
+
+	if len(remote.Codecs) > 0 && contains(local.Codecs, remote.Codecs[0]) {
+		if codec, ok := protocol.CodecByName(remote.Codecs[0]); ok {
+			caps.Codec = codec
+		}
+	}
+	if len(remote.Compression) > 0 && contains(local.Compression, remote.Compression[0]) {
+		if compressor, ok := protocol.CompressorByName(remote.Compression[0]); ok {
+			caps.Compressor = compressor
+		}
+	}
+	for _, f := range remote.Features {
+		if contains(local.Features, f) && !caps.Supports(f) {
+			caps.Features = append(caps.Features, f)
+		}
+	}
+	return caps
+}
+
+// handshake 发送 HELLO 并等待 Hub 回复，确定本连接的能力。
+// HELLO 始终以不压缩的 JSON 发送，Hub 超时未回复时按旧版协议继续。
+// Hub 可能在此阶段就以 AUTH_FAIL 拒绝连接，例如 Agent 版本过旧。
+// Hub 同意负载加密时，此后双方的帧都加密，包括注册和认证消息。
+func (c *Client) handshake(queue *sendQueue, control <-chan *protocol.Message, exchange *keyExchange) (Capabilities, error) {
+	local := c.localHello(exchange)
+	logger.Info("正在发送握手消息...")
+	logger.Debug("握手消息内容:", local)
+	if err := c.enqueue(queue, protocol.EncodeOptions{}, protocol.NewMessage(protocol.MessageTypeHello, local)); err != nil {
+		return Capabilities{}, err
+	}
+
+	timer := time.NewTimer(helloTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-control:
+		if msg.Header.Type == protocol.MessageTypeAuthFail {
+			return Capabilities{}, c.unverified(authError(msg))
+		}
+		remote, ok := msg.Payload.(*protocol.HelloPayload)
+		if !ok {
+			return Capabilities{}, fmt.Errorf("握手阶段收到意外的消息: %s", msg.Header.Type)
+		}
+		caps := negotiate(local, remote)
+		if c.signing != nil && !caps.Supports(protocol.FeatureSignedFrames) {
+			return Capabilities{}, ErrSigningUnsupported
+		}
+		if err := c.negotiateEncryption(&caps, exchange); err != nil {
+			return Capabilities{}, err
+		}
+		logger.Info("握手完成, Hub 版本:", caps.HubVersion, "编码格式:", caps.Codec.Name(), "功能:", caps.Features)
+		return caps, nil
+	case <-timer.C:
+		if c.signing != nil {
+			return Capabilities{}, ErrSigningUnsupported
+		}
+		if c.encryption != nil && c.encryption.required {
+			return Capabilities{}, ErrEncryptionUnsupported
+		}
+		logger.Warn("Hub 未回复握手消息, 按旧版协议通信")
+		return legacyCapabilities(), nil
+	case <-queue.done:
+		return Capabilities{}, c.unverified(connectionLost(control))
+	case <-c.stop:
+		return Capabilities{}, ErrConnectionLost
+	}
+}
+
+// unverified 标记握手阶段收到的 AUTH_FAIL：要求签名时 Hub 同意签名之前的帧都未经校验，
+// 中间人可以借此让 Agent 停止重连或丢弃凭据，因此只按可重试的错误处理
+func (c *Client) unverified(err error) error {
+	var authErr *AuthError
+	if c.signing != nil && errors.As(err, &authErr) {
+		authErr.Unverified = true
+	}
+	return err
+}
+
+// applyCapabilities 将协商结果应用到 conn 上并进入认证阶段，conn 已不是当前连接时返回 false
+func (c *Client) applyCapabilities(conn net.Conn, caps Capabilities) (protocol.EncodeOptions, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != conn || c.transitionLocked(StateAuthenticating, nil) != nil {
+		return protocol.EncodeOptions{}, false
+	}
+	c.caps = caps
+	c.encoding = protocol.EncodeOptions{
+		Codec:             caps.Codec,
+		Compressor:        caps.Compressor,
+		CompressThreshold: c.cfg.Hub.CompressThreshold,
+		MaxPayloadSize:    caps.MaxFrameSize,
+		Cipher:            caps.cipher,
+	}
+	return c.encoding, true
+}
+
+// authPayload 构造认证消息：Hub 下发了挑战时以 MAC 应答，密钥不出现在线路和日志中；
+// 否则仅在配置允许时以明文发送密钥，未配置时只允许不回复握手的旧版 Hub。
+// 启用 mTLS 且未配置密钥时由客户端证书完成认证。
+// 已注册的 Agent 以专属凭据代替共享密钥。
+func (c *Client) authPayload(caps Capabilities) (*protocol.AuthPayload, error) {
+	auth := &protocol.AuthPayload{
+		UUID:  GetAgentUUID(),
+		Alias: c.cfg.Agent.Alias,
+	}
+	key := c.authKey()
+	c.mutex.RLock()
+	tlsConfig := c.tlsConfigLocked()
+	clientCert := tlsConfig != nil && len(tlsConfig.Certificates) > 0
+	c.mutex.RUnlock()
+	if key == "" && clientCert {
+		// 未配置共享密钥时仅以 mTLS 客户端证书认证
+		return auth, nil
+	}
+	if caps.challenge != "" {
+		auth.Nonce = caps.challenge
+		auth.Timestamp = time.Now().Unix()
+		auth.MAC = protocol.AuthMAC(key, auth.Nonce, auth.UUID, auth.Timestamp)
+		return auth, nil
+	}
+	if !plaintextAllowed(c.cfg.Auth.AllowPlaintextKey, caps) {
+		return nil, ErrChallengeUnsupported
+	}
+	if caps.Legacy {
+		logger.Warn("旧版 Hub 不支持挑战-应答认证, 以明文发送密钥; 升级 Hub 后请设置 auth.allowPlaintextKey: false")
+	} else {
+		logger.Warn("Hub 未下发认证挑战, 以明文发送密钥")
+	}
+	auth.Key = key
+	return auth, nil
+}
+
+// plaintextAllowed 判断 Hub 未下发挑战时能否以明文发送密钥，allow 为 auth.allowPlaintextKey
+func plaintextAllowed(allow *bool, caps Capabilities) bool {
+	if allow != nil {
+		return *allow
+	}
+	return caps.Legacy
+}
+
+// authenticate 发送认证消息并等待 Hub 的 AUTH_OK/AUTH_FAIL。
+// 旧版 Hub 不回复认证结果，认证失败时直接断开连接，因此不等待。
+func (c *Client) authenticate(queue *sendQueue, control <-chan *protocol.Message, caps Capabilities, encoding protocol.EncodeOptions) error {
+	auth, err := c.authPayload(caps)
+	if err != nil {
+		return err
+	}
+	logger.Info("正在发送认证消息...")
+
+	if err := c.enqueue(queue, encoding, protocol.NewMessage(protocol.MessageTypeAuth, auth)); err != nil {
+		return fmt.Errorf("发送认证消息失败: %v", err)
+	}
+	if caps.Legacy {
+		return nil
+	}
+
+	timer := time.NewTimer(authTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-control:
+			switch msg.Header.Type {
+			case protocol.MessageTypeAuthOK:
+				logger.Info("认证成功")
+				return nil
+			case protocol.MessageTypeAuthFail:
+				return authError(msg)
+			}
+			logger.Warn("等待认证结果时收到意外的消息:", msg.Header.Type)
+		case <-timer.C:
+			return errAuthTimeout
+		case <-queue.done:
+			return connectionLost(control)
+		case <-c.stop:
+			return ErrConnectionLost
+		}
+	}
+}
+
+// connectionLost 在握手阶段连接断开时调用；Hub 通常先发送 AUTH_FAIL 再关闭连接，
+// 此时返回认证错误而不是 ErrConnectionLost
+func connectionLost(control <-chan *protocol.Message) error {
+	for {
+		select {
+		case msg := <-control:
+			if msg.Header.Type == protocol.MessageTypeAuthFail {
+				return authError(msg)
+			}
+		default:
+			return ErrConnectionLost
+		}
+	}
+}
+
+// deliverControl 将握手阶段 Hub 的回复（HELLO、ENROLL_OK、AUTH_OK、AUTH_FAIL）交给等待中的 connect
+func (c *Client) deliverControl(msg *protocol.Message) {
+	c.mutex.RLock()
+	ch := c.control
+	c.mutex.RUnlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- msg:
+	default:
+		logger.Warn("忽略多余的握手回复:", msg.Header.Type)
+	}
+}
+
+// fail 在遇到重试无法解决的错误时停止重连，Done 返回的 channel 随之关闭
+func (c *Client) fail(err error) {
+	c.failOnce.Do(func() {
+		logger.Error("遇到无法通过重试解决的错误, 停止重连:", err)
+		c.mutex.Lock()
+		c.failErr = err
+		c.mutex.Unlock()
+		close(c.failed)
+	})
+}
+
+// Done 返回在客户端因不可重试的错误（如认证被永久拒绝）停止重连时关闭的 channel
+func (c *Client) Done() <-chan struct{} {
+	return c.failed
+}
+
+// Err 返回导致客户端停止重连的错误，Done 关闭前为 nil
+func (c *Client) Err() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.failErr
+}
+
+// ackingEnabled 判断上报消息是否需要等待 Hub 确认：本端启用且 Hub 同意
+func (c *Client) ackingEnabled() bool {
+	return c.acks != nil && c.Capabilities().Supports(protocol.FeatureAcks)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"agent/config"
+	"agent/protocol"
+	"errors"
+	"testing"
+)
+
+// useTestAgentUUID 固定 Agent UUID，避免测试在工作目录下生成 data/agent.uuid
+func useTestAgentUUID() string {
+	agentUUIDOnce.Do(func() { agentUUID = "test-agent" })
+	return agentUUID
+}
+
+func TestAuthPayload(t *testing.T) {
+	uuid := useTestAgentUUID()
+	yes, no := true, false
+
+	tests := []struct {
+		name      string
+		allow     *bool
+		caps      Capabilities
+		wantKey   bool
+		wantMAC   bool
+		wantError error
+	}{
+		{"challenge", nil, Capabilities{challenge: "n0nce"}, false, true, nil},
+		{"challenge ignores plaintext option", &yes, Capabilities{challenge: "n0nce"}, false, true, nil},
+		{"legacy hub by default", nil, Capabilities{Legacy: true}, true, false, nil},
+		{"legacy hub forbidden", &no, Capabilities{Legacy: true}, false, false, ErrChallengeUnsupported},
+		{"hub without challenge", nil, Capabilities{}, false, false, ErrChallengeUnsupported},
+		{"hub without challenge allowed", &yes, Capabilities{}, true, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Auth.Key = "secret"
+			cfg.Auth.AllowPlaintextKey = tt.allow
+			c := NewClient(cfg)
+
+			auth, err := c.authPayload(tt.caps)
+			if !errors.Is(err, tt.wantError) {
+				t.Fatalf("err = %v, want %v", err, tt.wantError)
+			}
+			if err != nil {
+				var permanent interface{ Permanent() bool }
+				if errors.As(err, &permanent) && permanent.Permanent() {
+					t.Fatal("Hub 升级后应能重连成功, 不应为永久错误")
+				}
+				return
+			}
+			if (auth.Key == "secret") != tt.wantKey {
+				t.Fatalf("plaintext key sent = %v, want %v", auth.Key != "", tt.wantKey)
+			}
+			if tt.wantMAC {
+				if auth.Key != "" || auth.Nonce != tt.caps.challenge || auth.UUID != uuid {
+					t.Fatalf("unexpected challenge response %+v", auth)
+				}
+				if !protocol.VerifyAuthMAC("secret", auth) {
+					t.Fatal("MAC 校验失败")
+				}
+			} else if auth.MAC != "" {
+				t.Fatalf("unexpected MAC %q", auth.MAC)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"agent/logger"
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	// connectionAttemptDelay 是 RFC 8305 中上一次尝试未完成时启动下一次尝试前的等待
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// familyCache 记录每个 Hub 上次连接成功的地址族，下一次连接时优先尝试
+type familyCache struct {
+	mutex    sync.Mutex
+	families map[string]string // Hub 名称 -> ipv4/ipv6
+}
+
+func (f *familyCache) preferred(hub string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.families[hub]
+}
+
+func (f *familyCache) remember(hub, family string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.families == nil {
+		f.families = make(map[string]string)
+	}
+	f.families[hub] = family
+}
+
+// snapshot 返回记录的副本
+func (f *familyCache) snapshot() map[string]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	families := make(map[string]string, len(f.families))
+	for hub, family := range f.families {
+		families[hub] = family
+	}
+	return families
+}
+
+// dialGroups 将依次尝试的地址分组，每组一次连接尝试。hub.protocol 为 auto 时，
+// 同一 Hub 的相邻地址（如 DNS 发现展开的 A/AAAA 记录）合为一组竞速，其余情况每个地址一组。
+func (c *Client) dialGroups(targets []hubTarget) [][]hubTarget {
+	var groups [][]hubTarget
+	for _, target := range targets {
+		last := len(groups) - 1
+		if c.happyEyeballs() && last >= 0 && groups[last][0].serverName == target.serverName {
+			groups[last] = append(groups[last], target)
+			continue
+		}
+		groups = append(groups, []hubTarget{target})
+	}
+	return groups
+}
+
+// happyEyeballs 判断是否按 RFC 8305 让两个地址族竞速，只在 hub.protocol 为 auto 时启用
+func (c *Client) happyEyeballs() bool {
+	return c.cfg.Hub.Protocol == "auto"
+}
+
+// dialHub 建立到一组地址的 TCP 连接。经由代理时依次通过代理连接；未启用 auto 时直接连接；
+// auto 时解析出两个地址族的所有地址，按 RFC 8305 交替排列并每隔 connectionAttemptDelay 启动下一次尝试，
+// 采用最先建立的连接。
+func (c *Client) dialHub(group []hubTarget) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	if c.useProxy(group[0]) {
+		var firstErr error
+		for _, target := range group {
+			conn, err := c.proxy.DialContext(ctx, "tcp", target.endpoint)
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+
+	if !c.happyEyeballs() {
+		return c.dialer.DialContext(ctx, c.network(), group[0].endpoint)
+	}
+
+	hub := group[0].serverName
+	var candidates []string
+	for _, target := range group {
+		addrs, err := resolveEndpoint(ctx, target.endpoint)
+		if err != nil {
+			logger.Error("解析地址失败:", target.endpoint, err)
+			continue
+		}
+		// DNS 发现时 hub.address 经系统解析的结果可能与已展开的地址重复
+		for _, addr := range addrs {
+			if !slices.Contains(candidates, addr) {
+				candidates = append(candidates, addr)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, &net.DNSError{Err: "没有可用的地址", Name: hub}
+	}
+
+	conn, err := raceDial(ctx, c.dialer, interleaveFamilies(candidates, c.families.preferred(hub)))
+	if err != nil {
+		return nil, err
+	}
+	family := endpointFamily(conn.RemoteAddr().String())
+	logger.Info("已连接到 " + conn.RemoteAddr().String() + ", 地址族: " + family)
+	c.families.remember(hub, family)
+	return conn, nil
+}
+
+// useProxy 判断是否经由代理连接 target，按连接地址及证书名称匹配 noProxy
+func (c *Client) useProxy(target hubTarget) bool {
+	if c.proxy == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(target.endpoint)
+	if err != nil {
+		host = target.endpoint
+	}
+	return !c.proxy.bypass(host) && !c.proxy.bypass(target.serverName)
+}
+
+// resolveEndpoint 将 host:port 展开为所有 IP 地址，host 为 IP 时原样返回
+func resolveEndpoint(ctx context.Context, endpoint string) ([]string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{endpoint}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// interleaveFamilies 交替排列两个地址族的地址，以 preferred 开头；没有记录时以第一个地址的地址族开头
+func interleaveFamilies(addrs []string, preferred string) []string {
+	if preferred == "" {
+		preferred = endpointFamily(addrs[0])
+	}
+	var first, second []string
+	for _, addr := range addrs {
+		if endpointFamily(addr) == preferred {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	ordered := make([]string, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			ordered = append(ordered, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			ordered = append(ordered, second[0])
+			second = second[1:]
+		}
+	}
+	return ordered
+}
+
+func endpointFamily(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return familyIPv6
+	}
+	return familyIPv4
+}
+
+// raceDial 依次启动到 addrs 的连接：上一次尝试失败或 connectionAttemptDelay 内未完成时启动下一次，
+// 返回最先建立的连接并关闭其余连接；全部失败时返回第一个错误。
+func raceDial(ctx context.Context, dialer Dialer, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭取消前已经建立的其余连接
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			logger.Debug("连接尝试失败:", r.err)
+			if next < len(addrs) {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"agent/config"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConn 只实现 raceDial 和 dialHub 用到的方法
+type fakeConn struct {
+	net.Conn
+	addr   *net.TCPAddr
+	closed atomic.Bool
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.addr }
+func (c *fakeConn) Close() error         { c.closed.Store(true); return nil }
+
+// fakeDial 描述到一个地址的连接尝试：耗时 delay 后成功，fail 时失败
+type fakeDial struct {
+	delay time.Duration
+	fail  bool
+}
+
+// fakeDialer 按地址模拟连接，不理会 ctx 的取消，以模拟取消前已经建立的连接
+type fakeDialer struct {
+	dials map[string]fakeDial
+	begin time.Time
+
+	mutex   sync.Mutex
+	started map[string]time.Duration // 各地址开始尝试的时间
+	order   []string
+	conns   map[string]*fakeConn
+}
+
+func newFakeDialer(dials map[string]fakeDial) *fakeDialer {
+	return &fakeDialer{
+		dials:   dials,
+		begin:   time.Now(),
+		started: make(map[string]time.Duration),
+		conns:   make(map[string]*fakeConn),
+	}
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.started[addr] = time.Since(d.begin)
+	d.order = append(d.order, addr)
+	d.mutex.Unlock()
+
+	dial := d.dials[addr]
+	time.Sleep(dial.delay)
+	if dial.fail {
+		return nil, errors.New("refused: " + addr)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &fakeConn{addr: tcpAddr}
+	d.mutex.Lock()
+	d.conns[addr] = conn
+	d.mutex.Unlock()
+	return conn, nil
+}
+
+func (d *fakeDialer) startedAt(addr string) (time.Duration, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	at, ok := d.started[addr]
+	return at, ok
+}
+
+func (d *fakeDialer) conn(addr string) *fakeConn {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.conns[addr]
+}
+
+func TestRaceDial(t *testing.T) {
+	const (
+		v6 = "[2001:db8::1]:9527"
+		v4 = "192.0.2.1:9527"
+	)
+	tests := []struct {
+		name      string
+		dials     map[string]fakeDial
+		want      string   // 采用的连接，为空时应全部失败
+		wantErr   string   // 全部失败时返回的第一个错误
+		notDialed []string // 不应尝试的地址
+		staggered []string // 应在 connectionAttemptDelay 之后才开始的地址
+		immediate []string // 应在前一次失败后立即开始的地址
+		closed    []string // 应被关闭的落选连接
+	}{
+		{
+			name:      "first wins",
+			dials:     map[string]fakeDial{v6: {delay: 10 * time.Millisecond}, v4: {}},
+			want:      v6,
+			notDialed: []string{v4},
+		},
+		{
+			name:      "stagger",
+			dials:     map[string]fakeDial{v6: {delay: 400 * time.Millisecond}, v4: {delay: 10 * time.Millisecond}},
+			want:      v4,
+			staggered: []string{v4},
+			closed:    []string{v6},
+		},
+		{
+			name:      "failure starts next",
+			dials:     map[string]fakeDial{v6: {delay: 10 * time.Millisecond, fail: true}, v4: {delay: 10 * time.Millisecond}},
+			want:      v4,
+			immediate: []string{v4},
+		},
+		{
+			name:    "all fail",
+			dials:   map[string]fakeDial{v6: {fail: true}, v4: {delay: 10 * time.Millisecond, fail: true}},
+			wantErr: "refused: " + v6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDialer(tt.dials)
+			conn, err := raceDial(context.Background(), d, []string{v6, v4})
+			if tt.want == "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn != d.conn(tt.want) {
+				t.Fatalf("conn = %v, want %s", conn.RemoteAddr(), tt.want)
+			}
+			if conn.(*fakeConn).closed.Load() {
+				t.Fatal("采用的连接被关闭")
+			}
+
+			for _, addr := range tt.notDialed {
+				if _, ok := d.startedAt(addr); ok {
+					t.Fatalf("%s 不应被尝试", addr)
+				}
+			}
+			for _, addr := range tt.staggered {
+				if at, _ := d.startedAt(addr); at < connectionAttemptDelay-10*time.Millisecond {
+					t.Fatalf("%s 在 %v 开始, 应等待 %v", addr, at, connectionAttemptDelay)
+				}
+			}
+			for _, addr := range tt.immediate {
+				if at, _ := d.startedAt(addr); at >= connectionAttemptDelay/2 {
+					t.Fatalf("%s 在 %v 才开始, 前一次失败后应立即尝试", addr, at)
+				}
+			}
+			for _, addr := range tt.closed {
+				deadline := time.Now().Add(2 * time.Second)
+				for {
+					if c := d.conn(addr); c != nil && c.closed.Load() {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("落选的连接 %s 未关闭", addr)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := []string{"[2001:db8::1]:1", "[2001:db8::2]:1", "[2001:db8::3]:1", "192.0.2.1:1", "192.0.2.2:1"}
+	tests := []struct {
+		name      string
+		addrs     []string
+		preferred string
+		want      []string
+	}{
+		{"first address family", addrs, "", []string{"[2001:db8::1]:1", "192.0.2.1:1", "[2001:db8::2]:1", "192.0.2.2:1", "[2001:db8::3]:1"}},
+		{"remembered ipv4", addrs, familyIPv4, []string{"192.0.2.1:1", "[2001:db8::1]:1", "192.0.2.2:1", "[2001:db8::2]:1", "[2001:db8::3]:1"}},
+		{"single family", []string{"192.0.2.1:1", "192.0.2.2:1"}, familyIPv6, []string{"192.0.2.1:1", "192.0.2.2:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interleaveFamilies(tt.addrs, tt.preferred); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialGroups(t *testing.T) {
+	targets := []hubTarget{
+		{"[2001:db8::1]:9527", "hub.example.test"},
+		{"192.0.2.1:9527", "hub.example.test"},
+		{"backup.example.test:9527", "backup.example.test"},
+	}
+	tests := []struct {
+		protocol string
+		want     []int // 各组的大小
+	}{
+		{"auto", []int{2, 1}},
+		{"ipv4", []int{1, 1, 1}},
+		{"ipv6", []int{1, 1, 1}},
+		{"", []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run("protocol "+tt.protocol, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Hub.Protocol = tt.protocol
+			groups := NewClient(cfg).dialGroups(targets)
+			var sizes []int
+			for _, group := range groups {
+				sizes = append(sizes, len(group))
+			}
+			if !reflect.DeepEqual(sizes, tt.want) {
+				t.Fatalf("groups = %v, want sizes %v", groups, tt.want)
+			}
+		})
+	}
+}
+
+// TestDialHubFamilyMemory 确认连接成功的地址族被记住，下一次连接先尝试该地址族
+func TestDialHubFamilyMemory(t *testing.T) {
+	const (
+		v6 = "[2001:db8::1]:9527"
+		v4 = "192.0.2.1:9527"
+	)
+	cfg := &config.Config{}
+	cfg.Hub.Protocol = "auto"
+	c := NewClient(cfg)
+	group := []hubTarget{{v6, "hub.example.test"}, {v4, "hub.example.test"}}
+
+	d := newFakeDialer(map[string]fakeDial{v6: {fail: true}, v4: {}})
+	c.dialer = d
+	conn, err := c.dialHub(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d.order[0] != v6 {
+		t.Fatalf("没有记录时应以第一个地址的地址族开头, order = %v", d.order)
+	}
+	if family := c.families.preferred("hub.example.test"); family != familyIPv4 {
+		t.Fatalf("preferred = %q, want %q", family, familyIPv4)
+	}
+
+	d = newFakeDialer(map[string]fakeDial{v6: {}, v4: {}})
+	c.dialer = d
+	conn, err = c.dialHub(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !reflect.DeepEqual(d.order, []string{v4}) {
+		t.Fatalf("order = %v, 应先尝试上次成功的 IPv4", d.order)
+	}
+}
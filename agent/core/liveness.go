@@ -0,0 +1,223 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeatMisses = 3
+	// defaultReadTimeout 是未协商心跳回显时的读取超时，期间未收到任何数据即视为断线
+	defaultReadTimeout = 30 * time.Second
+	// jitterGain 是 RFC 3550 中抖动估计的平滑系数
+	jitterGain = 16
+)
+
+// liveness 记录当前连接上尚未收到回显的心跳并统计往返时延。
+// 时延以本地记录的发送时间计算，不依赖 Hub 的时钟。
+type liveness struct {
+	mutex   sync.Mutex
+	seq     uint64
+	pending map[uint64]time.Time // 心跳序号 -> 发送时间
+
+	hasRTT bool
+	rtt    time.Duration
+	jitter float64 // 毫秒
+
+	// 自上一次 stats 以来的统计
+	samples       uint64
+	lost          uint64
+	sum, min, max time.Duration
+}
+
+// reset 在新连接就绪时丢弃上一个连接上未回显的心跳，序号继续递增，迟到的旧回显因此被忽略
+func (l *liveness) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.pending = nil
+}
+
+// sent 为即将发送的心跳分配序号并记录发送时间
+func (l *liveness) sent(now time.Time) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.pending == nil {
+		l.pending = make(map[uint64]time.Time)
+	}
+	l.seq++
+	l.pending[l.seq] = now
+	return l.seq
+}
+
+// dead 判断未回显的心跳是否已达到 limit 个。每个心跳间隔只发送一个心跳，
+// 因此在发送下一个心跳前调用时，未回显的心跳数即连续错过的回显数；判定失联时这些心跳计为丢失。
+func (l *liveness) dead(limit int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.pending) < limit {
+		return false
+	}
+	l.lost += uint64(len(l.pending))
+	l.pending = nil
+	return true
+}
+
+// echoed 处理序号为 seq 的心跳回显，返回往返时延。回显按发送顺序到达，
+// 更早的心跳仍未回显说明 Hub 没有回显它们，计为丢失。
+func (l *liveness) echoed(seq uint64, now time.Time) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sentAt, ok := l.pending[seq]
+	if !ok {
+		return 0, false
+	}
+	for s := range l.pending {
+		if s < seq {
+			l.lost++
+		}
+		if s <= seq {
+			delete(l.pending, s)
+		}
+	}
+
+	rtt := now.Sub(sentAt)
+	if l.hasRTT {
+		delta := float64(rtt-l.rtt) / float64(time.Millisecond)
+		if delta < 0 {
+			delta = -delta
+		}
+		l.jitter += (delta - l.jitter) / jitterGain
+	}
+	l.hasRTT = true
+	l.rtt = rtt
+
+	if l.samples == 0 || rtt < l.min {
+		l.min = rtt
+	}
+	if rtt > l.max {
+		l.max = rtt
+	}
+	l.samples++
+	l.sum += rtt
+	return rtt, true
+}
+
+// stats 返回链路质量并开始新的统计周期，从未收到回显且没有丢失时返回 nil
+func (l *liveness) stats() *protocol.LinkStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.hasRTT && l.lost == 0 {
+		return nil
+	}
+	stats := &protocol.LinkStats{
+		RTT:     milliseconds(l.rtt),
+		Jitter:  l.jitter,
+		Samples: l.samples,
+		Lost:    l.lost,
+	}
+	if l.samples > 0 {
+		stats.RTTAvg = milliseconds(l.sum / time.Duration(l.samples))
+		stats.RTTMin = milliseconds(l.min)
+		stats.RTTMax = milliseconds(l.max)
+	}
+	l.samples, l.lost = 0, 0
+	l.sum, l.min, l.max = 0, 0, 0
+	return stats
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// echoEnabled 判断 conn 上是否以心跳回显检测 Hub 存活：WebSocket 的 pong 总是原样带回 ping 的负载，
+// TCP 连接需要 Hub 在握手中同意心跳回显。握手完成前不启用。
+func (c *Client) echoEnabled(conn net.Conn) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.state != StateReady || c.conn != conn {
+		return false
+	}
+	if _, ok := conn.(*wsConn); ok {
+		return true
+	}
+	return c.caps.Supports(protocol.FeatureHeartbeatEcho)
+}
+
+func (c *Client) heartbeatMisses() int {
+	if c.cfg.Agent.HeartbeatMisses > 0 {
+		return c.cfg.Agent.HeartbeatMisses
+	}
+	return defaultHeartbeatMisses
+}
+
+// readTimeout 返回 conn 的读取超时。启用心跳回显后由心跳协程判定 Hub 失联，
+// 读取超时只在心跳协程失效时兜底，放宽到 heartbeatMisses+1 个心跳间隔。
+func (c *Client) readTimeout(conn net.Conn) time.Duration {
+	if !c.echoEnabled(conn) {
+		return defaultReadTimeout
+	}
+	timeout := time.Duration(c.cfg.Agent.HeartbeatInterval) * time.Second * time.Duration(c.heartbeatMisses()+1)
+	if timeout < defaultReadTimeout {
+		return defaultReadTimeout
+	}
+	return timeout
+}
+
+// sendHeartbeat 在 conn 上发送一次心跳。启用心跳回显时先检查已连续错过的回显数，达到上限即断开连接。
+// Hub 依据 HEARTBEAT 消息更新 Agent 的在线状态，WebSocket 连接同样发送；WebSocket 上的回显由 ping 承载，
+// 心跳消息本身不带序号，Hub 回显的心跳因此被忽略。
+func (c *Client) sendHeartbeat(conn net.Conn) {
+	heartbeat := &protocol.HeartbeatPayload{UUID: GetAgentUUID()}
+	if c.echoEnabled(conn) {
+		if misses := c.heartbeatMisses(); c.liveness.dead(misses) {
+			err := fmt.Errorf("连续 %d 次未收到心跳回显", misses)
+			logger.Error(err, ", 判定 Hub 失联")
+			c.handleDisconnect(conn, err)
+			return
+		}
+		now := time.Now()
+		seq := c.liveness.sent(now)
+		if ws, ok := conn.(*wsConn); ok {
+			// ping 的负载为 JSON 编码的心跳消息，pong 原样带回，用于测量往返时延
+			data, err := json.Marshal(&protocol.HeartbeatPayload{UUID: heartbeat.UUID, Seq: seq, SentAt: now.UnixMilli()})
+			if err == nil {
+				err = ws.ping(data)
+			}
+			if err != nil {
+				logger.Error("发送 ping 失败:", err)
+			}
+		} else {
+			heartbeat.Seq = seq
+			heartbeat.SentAt = now.UnixMilli()
+		}
+	}
+
+	if err := c.Send(protocol.NewMessage(protocol.MessageTypeHeartbeat, heartbeat)); err != nil && err != ErrNotConnected {
+		logger.Error("发送心跳失败:", err)
+	}
+}
+
+// linkStats 返回链路质量统计并附上当前连接是否加密；没有统计且连接未就绪时返回 nil
+func (c *Client) linkStats() *protocol.LinkStats {
+	stats := c.liveness.stats()
+	if stats == nil {
+		if c.State() != StateReady {
+			return nil
+		}
+		stats = &protocol.LinkStats{}
+	}
+	stats.Encrypted = c.encrypted()
+	return stats
+}
+
+// heartbeatEchoed 处理 Hub 发回的心跳
+func (c *Client) heartbeatEchoed(heartbeat *protocol.HeartbeatPayload) {
+	if rtt, ok := c.liveness.echoed(heartbeat.Seq, time.Now()); ok {
+		logger.Debug("心跳往返时延:", rtt)
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"agent/config"
+	"agent/protocol"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLinkStatsEncrypted(t *testing.T) {
+	cipher, err := protocol.NewFrameCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		state         State
+		cipher        *protocol.FrameCipher
+		echoed        bool
+		wantNil       bool
+		wantEncrypted bool
+	}{
+		{"encrypted", StateReady, cipher, false, false, true},
+		{"plaintext", StateReady, nil, false, false, false},
+		{"plaintext with rtt", StateReady, nil, true, false, false},
+		{"disconnected", StateDisconnected, cipher, false, true, false},
+		{"disconnected keeps rtt", StateDisconnected, cipher, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{state: tt.state}
+			c.caps.cipher = tt.cipher
+			if tt.echoed {
+				now := time.Now()
+				c.liveness.echoed(c.liveness.sent(now), now.Add(time.Millisecond))
+			}
+			stats := c.linkStats()
+			if (stats == nil) != tt.wantNil {
+				t.Fatalf("stats = %+v, want nil %v", stats, tt.wantNil)
+			}
+			if stats != nil && stats.Encrypted != tt.wantEncrypted {
+				t.Fatalf("Encrypted = %v, want %v", stats.Encrypted, tt.wantEncrypted)
+			}
+			if got := c.Metrics().Encrypted; got != tt.wantEncrypted {
+				t.Fatalf("Metrics().Encrypted = %v, want %v", got, tt.wantEncrypted)
+			}
+		})
+	}
+}
+
+// readHeartbeat 从 r 读出下一个帧并解码为心跳
+func readHeartbeat(t *testing.T, r io.Reader) *protocol.HeartbeatPayload {
+	t.Helper()
+	parser := protocol.NewMessageParser()
+	buf := make([]byte, 4096)
+	for !parser.HasCompleteMessage() {
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parser.Append(buf[:n])
+	}
+	msg, err := parser.ParseMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Type != protocol.MessageTypeHeartbeat {
+		t.Fatalf("type = %v, want heartbeat", msg.Header.Type)
+	}
+	var heartbeat protocol.HeartbeatPayload
+	if err := msg.DecodePayload(&heartbeat); err != nil {
+		t.Fatal(err)
+	}
+	return &heartbeat
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	uuid := useTestAgentUUID()
+
+	tests := []struct {
+		name      string
+		websocket bool
+		echo      bool // Hub 同意心跳回显
+		wantSeq   uint64
+		wantPing  bool
+	}{
+		{"tcp", false, false, 0, false},
+		{"tcp with echo", false, true, 1, false},
+		{"websocket", true, false, 0, true},
+		{"websocket with echo", true, true, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// hub 为 Hub 一端读取心跳消息的连接，pings 收到 Agent 的 ping 负载
+			var conn net.Conn
+			var hub io.Reader
+			pings := make(chan string, 1)
+			if tt.websocket {
+				frames := make(chan []byte, 1)
+				server := newWSHub(t, "/agent", func(ws *websocket.Conn) {
+					ws.SetPingHandler(func(data string) error {
+						pings <- data
+						return nil
+					})
+					if _, data, err := ws.ReadMessage(); err == nil {
+						frames <- data
+					}
+				})
+				var err error
+				if conn, err = server.upgrade(t, NewClient(&config.Config{})); err != nil {
+					t.Fatal(err)
+				}
+				hub = readerFunc(func(p []byte) (int, error) {
+					select {
+					case data := <-frames:
+						return copy(p, data), nil
+					case <-time.After(5 * time.Second):
+						return 0, io.ErrNoProgress
+					}
+				})
+			} else {
+				var peer net.Conn
+				conn, peer = net.Pipe()
+				hub = peer
+				defer peer.Close()
+			}
+			defer conn.Close()
+
+			c := NewClient(&config.Config{})
+			c.state = StateReady
+			c.conn = conn
+			c.queue = newSendQueue(8)
+			if tt.echo {
+				c.caps.Features = []string{protocol.FeatureHeartbeatEcho}
+			}
+			go c.writeLoop(conn, c.queue)
+			defer c.queue.close()
+
+			c.sendHeartbeat(conn)
+
+			heartbeat := readHeartbeat(t, hub)
+			if heartbeat.UUID != uuid || heartbeat.Seq != tt.wantSeq || (heartbeat.SentAt != 0) != (tt.wantSeq != 0) {
+				t.Fatalf("heartbeat = %+v, want seq %d", heartbeat, tt.wantSeq)
+			}
+			if !tt.wantPing {
+				return
+			}
+			// WebSocket 连接总是以 ping 携带心跳序号，pong 用于测量往返时延
+			select {
+			case data := <-pings:
+				var ping protocol.HeartbeatPayload
+				if err := json.Unmarshal([]byte(data), &ping); err != nil || ping.Seq != 1 || ping.SentAt == 0 {
+					t.Fatalf("ping = %q, %v", data, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WebSocket 连接未发送 ping")
+			}
+		})
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,33 @@
+package core
+
+import "sync/atomic"
+
+// Metrics 是客户端运行指标的快照
+type Metrics struct {
+	RejectedUnsigned  uint64            // 因缺少签名被丢弃的 Hub 帧
+	RejectedSignature uint64            // 签名校验失败的 Hub 帧
+	RejectedReplay    uint64            // 签名序号重复或超出防重放窗口的 Hub 帧
+	RejectedEncrypted uint64            // 解密失败或协商加密后未加密的 Hub 帧，每次都会断开连接
+	HubFamilies       map[string]string // 各 Hub 上次连接成功的地址族（ipv4/ipv6），hub.protocol 为 auto 时下次优先尝试
+	Encrypted         bool              // 当前连接是否协商了负载加密，preferred 模式下 Hub 不支持时为 false
+}
+
+// clientMetrics 是 Client 内部的计数器，可被多个协程并发更新
+type clientMetrics struct {
+	rejectedUnsigned  atomic.Uint64
+	rejectedSignature atomic.Uint64
+	rejectedReplay    atomic.Uint64
+	rejectedEncrypted atomic.Uint64
+}
+
+// Metrics 返回当前的运行指标
+func (c *Client) Metrics() Metrics {
+	return Metrics{
+		RejectedUnsigned:  c.metrics.rejectedUnsigned.Load(),
+		RejectedSignature: c.metrics.rejectedSignature.Load(),
+		RejectedReplay:    c.metrics.rejectedReplay.Load(),
+		RejectedEncrypted: c.metrics.rejectedEncrypted.Load(),
+		HubFamilies:       c.families.snapshot(),
+		Encrypted:         c.encrypted(),
+	}
+}
@@ -0,0 +1,532 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 离线缓存以段文件的形式保存在数据目录中，每条记录的格式为:
+//
+//	length(4) | crc32(4) | seq(8) | timestamp(4) | type(2) | payload
+//
+// length 和 crc32 覆盖 seq 之后的全部内容。段文件以首条记录的序号命名，
+// 写满 segmentSize 后切换到新段；已投递或超出容量、时限的段整体删除。
+//
+// 每条记录写入后立即 fsync，Append 返回即已落盘。游标不单独 fsync，
+// 异常退出时最多重新投递最近确认的少量记录，由 Hub 按 Seq 去重。
+const (
+	outboxSegmentExt      = ".seg"
+	outboxCorruptExt      = ".corrupt"
+	outboxCursorFile      = "cursor"
+	outboxRecordHeader    = 8
+	outboxRecordFixedBody = 8 + 4 + 2
+	defaultSegmentSize    = 1 << 20
+	// maxOutboxRecordSize 是单条记录（不含 length、crc32）的上限，写入与读取使用同一限制
+	maxOutboxRecordSize = defaultSegmentSize
+)
+
+// ErrOutboxRecordTooLarge 表示消息超出单条离线缓存记录的上限
+var ErrOutboxRecordTooLarge = errors.New("离线缓存记录过大")
+
+// outboxCorruption 表示段文件中间出现无法解析的记录，其后的数据无法恢复
+type outboxCorruption struct {
+	offset int64
+	err    error
+}
+
+func (e *outboxCorruption) Error() string {
+	return fmt.Sprintf("偏移 %d 处的记录损坏: %v", e.offset, e.err)
+}
+
+// OutboxRecord 是离线缓存中的一条待投递消息
+type OutboxRecord struct {
+	Seq       uint64
+	Type      protocol.MessageType
+	Timestamp uint32
+	Payload   json.RawMessage
+}
+
+// Message 将记录还原为携带原始时间戳和序号的消息。
+// 记录以 JSON 保存，已知类型先解码为结构体，以便按连接的编码格式重新编码。
+func (r *OutboxRecord) Message() *protocol.Message {
+	var payload interface{} = r.Payload
+	if typed := protocol.NewPayload(r.Type); typed != nil {
+		if err := json.Unmarshal(r.Payload, typed); err == nil {
+			payload = typed
+		}
+	}
+	return &protocol.Message{
+		Header: protocol.MessageHeader{
+			Type:      r.Type,
+			Version:   protocol.ProtocolVersion,
+			Timestamp: r.Timestamp,
+			Seq:       r.Seq,
+		},
+		Payload: payload,
+	}
+}
+
+type outboxSegment struct {
+	path     string
+	firstSeq uint64
+	lastSeq  uint64
+	size     int64
+	modTime  time.Time
+}
+
+// Outbox 是基于段文件的预写式离线缓存，保证上报消息在 Hub 不可达期间不丢失
+type Outbox struct {
+	dir         string
+	maxBytes    int64
+	maxAge      time.Duration
+	segmentSize int64
+	mutex       sync.Mutex
+	segments    []*outboxSegment
+	active      *os.File
+	nextSeq     uint64
+	cursor      uint64 // 已确认投递的最大序号
+	readHint    outboxReadHint
+	notify      chan struct{}
+}
+
+// outboxReadHint 记录上次 Pending 读到的位置，避免每次都从段首开始扫描
+type outboxReadHint struct {
+	path   string
+	offset int64
+	seq    uint64
+}
+
+// OpenOutbox 打开（或创建）dir 下的离线缓存并恢复序号
+func OpenOutbox(dir string, maxBytes int64, maxAge time.Duration) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建离线缓存目录失败: %v", err)
+	}
+
+	o := &Outbox{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		maxAge:      maxAge,
+		segmentSize: defaultSegmentSize,
+		notify:      make(chan struct{}, 1),
+	}
+	if o.maxBytes > 0 && o.segmentSize > o.maxBytes/4 {
+		o.segmentSize = o.maxBytes / 4
+	}
+
+	if err := o.loadCursor(); err != nil {
+		return nil, err
+	}
+	if err := o.loadSegments(); err != nil {
+		return nil, err
+	}
+
+	o.nextSeq = o.cursor + 1
+	if n := len(o.segments); n > 0 && o.segments[n-1].lastSeq >= o.nextSeq {
+		o.nextSeq = o.segments[n-1].lastSeq + 1
+	}
+
+	o.mutex.Lock()
+	o.pruneLocked()
+	o.mutex.Unlock()
+
+	logger.Info("离线缓存已打开:", dir, "待投递记录:", o.nextSeq-1-o.cursor)
+	return o, nil
+}
+
+func (o *Outbox) loadCursor() error {
+	data, err := os.ReadFile(filepath.Join(o.dir, outboxCursorFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取离线缓存游标失败: %v", err)
+	}
+	if len(data) == 8 {
+		o.cursor = binary.BigEndian.Uint64(data)
+	}
+	return nil
+}
+
+// loadSegments 扫描所有段文件，截断因异常退出而写了一半的记录。
+// 记录损坏时保留损坏前的记录，并将原段文件复制为 .corrupt 以便排查。
+func (o *Outbox) loadSegments() error {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return fmt.Errorf("读取离线缓存目录失败: %v", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != outboxSegmentExt {
+			continue
+		}
+		seg := &outboxSegment{path: filepath.Join(o.dir, file.Name())}
+		validSize, err := o.scanSegment(seg)
+		var corruption *outboxCorruption
+		if errors.As(err, &corruption) {
+			logger.Error(fmt.Sprintf("离线缓存段 %s 损坏, 丢弃其后 %d 字节: %v", file.Name(), seg.size-validSize, err))
+			if err := copyFile(seg.path, seg.path+outboxCorruptExt); err != nil {
+				logger.Error("保存损坏的离线缓存段失败:", err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("读取离线缓存段 %s 失败: %v", file.Name(), err)
+		}
+		if validSize < seg.size && corruption == nil {
+			logger.Warn("离线缓存段尾部不完整, 截断至", validSize, "字节:", file.Name())
+		}
+		if validSize < seg.size {
+			if err := os.Truncate(seg.path, validSize); err != nil {
+				return fmt.Errorf("截断离线缓存段失败: %v", err)
+			}
+			seg.size = validSize
+		}
+		if seg.lastSeq == 0 {
+			os.Remove(seg.path)
+			continue
+		}
+		o.segments = append(o.segments, seg)
+	}
+
+	sort.Slice(o.segments, func(i, j int) bool {
+		return o.segments[i].firstSeq < o.segments[j].firstSeq
+	})
+	return nil
+}
+
+// scanSegment 读取段文件的序号范围，返回最后一条完整记录的结束位置。
+// 末尾写了一半的记录视为异常退出的正常结果；其余无法解析的记录返回 *outboxCorruption。
+func (o *Outbox) scanSegment(seg *outboxSegment) (int64, error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	seg.size = stat.Size()
+	seg.modTime = stat.ModTime()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		rec, n, err := readOutboxRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, &outboxCorruption{offset: offset, err: err}
+		}
+		if seg.firstSeq == 0 {
+			seg.firstSeq = rec.Seq
+		}
+		seg.lastSeq = rec.Seq
+		offset += n
+	}
+}
+
+// Append 写入一条待投递消息并返回其序号
+func (o *Outbox) Append(msgType protocol.MessageType, timestamp uint32, payload interface{}) (uint64, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("序列化离线缓存记录失败: %v", err)
+	}
+	if outboxRecordFixedBody+len(payloadBytes) > maxOutboxRecordSize {
+		return 0, fmt.Errorf("%w: %s 消息 %d 字节", ErrOutboxRecordTooLarge, msgType, len(payloadBytes))
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	seq := o.nextSeq
+	if err := o.rotateLocked(seq); err != nil {
+		return 0, err
+	}
+
+	body := make([]byte, outboxRecordFixedBody+len(payloadBytes))
+	binary.BigEndian.PutUint64(body[0:8], seq)
+	binary.BigEndian.PutUint32(body[8:12], timestamp)
+	binary.BigEndian.PutUint16(body[12:14], uint16(protocol.CodeOf(msgType)))
+	copy(body[outboxRecordFixedBody:], payloadBytes)
+
+	record := make([]byte, outboxRecordHeader+len(body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	copy(record[outboxRecordHeader:], body)
+
+	seg := o.segments[len(o.segments)-1]
+	if _, err := o.active.Write(record); err != nil {
+		// 去掉写了一半的记录，否则其后追加的记录都无法读取
+		o.active.Truncate(seg.size)
+		return 0, fmt.Errorf("写入离线缓存失败: %v", err)
+	}
+	if err := o.active.Sync(); err != nil {
+		o.active.Truncate(seg.size)
+		return 0, fmt.Errorf("写入离线缓存失败: %v", err)
+	}
+
+	if seg.firstSeq == 0 {
+		seg.firstSeq = seq
+	}
+	seg.lastSeq = seq
+	seg.size += int64(len(record))
+	seg.modTime = time.Now()
+	o.nextSeq++
+
+	o.pruneLocked()
+	notify(o.notify)
+	return seq, nil
+}
+
+// rotateLocked 在没有可写段或当前段已满时创建新段
+func (o *Outbox) rotateLocked(seq uint64) error {
+	if o.active != nil {
+		seg := o.segments[len(o.segments)-1]
+		if seg.size < o.segmentSize {
+			return nil
+		}
+		o.active.Sync()
+		o.active.Close()
+		o.active = nil
+	}
+
+	if n := len(o.segments); n > 0 && o.segments[n-1].size < o.segmentSize {
+		// 重启后继续追加到未写满的最后一段
+		seg := o.segments[n-1]
+		file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("打开离线缓存段失败: %v", err)
+		}
+		o.active = file
+		return nil
+	}
+
+	path := filepath.Join(o.dir, fmt.Sprintf("%016x%s", seq, outboxSegmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("创建离线缓存段失败: %v", err)
+	}
+	o.active = file
+	o.segments = append(o.segments, &outboxSegment{path: path, modTime: time.Now()})
+	// 新段的目录项同样需要落盘，否则异常退出后整个段可能丢失
+	syncDir(o.dir)
+	return nil
+}
+
+// pruneLocked 删除已投递、过期或超出容量上限的段，当前写入段除外
+func (o *Outbox) pruneLocked() {
+	var total int64
+	for _, seg := range o.segments {
+		total += seg.size
+	}
+
+	for len(o.segments) > 1 {
+		seg := o.segments[0]
+		switch {
+		case seg.lastSeq <= o.cursor:
+		case o.maxAge > 0 && time.Since(seg.modTime) > o.maxAge:
+			logger.Warn("离线缓存段已过期, 丢弃序号", seg.firstSeq, "-", seg.lastSeq)
+		case o.maxBytes > 0 && total > o.maxBytes:
+			logger.Warn("离线缓存超出容量上限, 丢弃序号", seg.firstSeq, "-", seg.lastSeq)
+		default:
+			return
+		}
+
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			logger.Error("删除离线缓存段失败:", seg.path, err)
+			return
+		}
+		total -= seg.size
+		o.segments = o.segments[1:]
+		if seg.lastSeq > o.cursor {
+			o.cursor = seg.lastSeq
+			o.saveCursorLocked()
+		}
+	}
+}
+
+// Pending 返回序号大于 after 的最多 limit 条记录
+func (o *Outbox) Pending(after uint64, limit int) ([]*OutboxRecord, error) {
+	o.mutex.Lock()
+	if after < o.cursor {
+		after = o.cursor
+	}
+	var paths []string
+	for _, seg := range o.segments {
+		if seg.lastSeq > after {
+			paths = append(paths, seg.path)
+		}
+	}
+	hint := o.readHint
+	o.mutex.Unlock()
+
+	var records []*OutboxRecord
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return records, fmt.Errorf("读取离线缓存段失败: %v", err)
+		}
+
+		var offset int64
+		if hint.path == path && hint.seq <= after {
+			if _, err := file.Seek(hint.offset, io.SeekStart); err == nil {
+				offset = hint.offset
+			}
+		}
+
+		reader := bufio.NewReader(file)
+		for len(records) < limit {
+			rec, n, err := readOutboxRecord(reader)
+			if err != nil {
+				// 末尾可能是正在写入的记录；其余错误说明段在打开后损坏
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					logger.Error(fmt.Sprintf("读取离线缓存段 %s 失败, 跳过其余记录: %v", filepath.Base(path), &outboxCorruption{offset: offset, err: err}))
+				}
+				break
+			}
+			offset += n
+			if rec.Seq > after {
+				records = append(records, rec)
+				hint = outboxReadHint{path: path, offset: offset, seq: rec.Seq}
+			}
+		}
+		file.Close()
+
+		if len(records) >= limit {
+			break
+		}
+	}
+
+	o.mutex.Lock()
+	o.readHint = hint
+	o.mutex.Unlock()
+	return records, nil
+}
+
+// Ack 标记序号不大于 seq 的记录已投递
+func (o *Outbox) Ack(seq uint64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if seq <= o.cursor {
+		return
+	}
+	o.cursor = seq
+	o.saveCursorLocked()
+	o.pruneLocked()
+}
+
+// Cursor 返回已确认投递的最大序号
+func (o *Outbox) Cursor() uint64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.cursor
+}
+
+// Notify 返回有新记录写入时收到通知的 channel
+func (o *Outbox) Notify() <-chan struct{} {
+	return o.notify
+}
+
+func (o *Outbox) saveCursorLocked() {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, o.cursor)
+	path := filepath.Join(o.dir, outboxCursorFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		logger.Error("保存离线缓存游标失败:", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		logger.Error("保存离线缓存游标失败:", err)
+	}
+}
+
+// Close 刷新并关闭当前写入段
+func (o *Outbox) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.active == nil {
+		return nil
+	}
+	o.active.Sync()
+	err := o.active.Close()
+	o.active = nil
+	return err
+}
+
+// readOutboxRecord 读取一条记录，返回记录及其占用的字节数
+func readOutboxRecord(reader *bufio.Reader) (*OutboxRecord, int64, error) {
+	header := make([]byte, outboxRecordHeader)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < outboxRecordFixedBody || length > maxOutboxRecordSize {
+		return nil, 0, fmt.Errorf("记录长度非法: %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, fmt.Errorf("记录校验失败")
+	}
+
+	msgType, ok := protocol.TypeOf(protocol.TypeCode(binary.BigEndian.Uint16(body[12:14])))
+	if !ok {
+		return nil, 0, fmt.Errorf("未知的消息类型编码")
+	}
+	return &OutboxRecord{
+		Seq:       binary.BigEndian.Uint64(body[0:8]),
+		Timestamp: binary.BigEndian.Uint32(body[8:12]),
+		Type:      msgType,
+		Payload:   json.RawMessage(body[outboxRecordFixedBody:]),
+	}, int64(outboxRecordHeader) + int64(length), nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// isReportable 判断消息是否需要经由离线缓存可靠投递
+func isReportable(t protocol.MessageType) bool {
+	return t == protocol.MessageTypeSystemInfo || t == protocol.MessageTypeTaskResult
+}
+
+// outboxDir 返回离线缓存目录，未配置时使用数据目录下的 outbox
+func outboxDir(dir string) string {
+	if strings.TrimSpace(dir) == "" {
+		return filepath.Join("data", "outbox")
+	}
+	return dir
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"agent/protocol"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOutboxRecovery(t *testing.T) {
+	tests := []struct {
+		name        string
+		damage      func(t *testing.T, path string, size int64)
+		wantSeqs    []uint64
+		wantCorrupt bool
+	}{
+		{"intact", func(*testing.T, string, int64) {}, []uint64{1, 2, 3}, false},
+		{"torn tail", func(t *testing.T, path string, size int64) {
+			appendBytes(t, path, []byte{0, 0, 0, 40, 1, 2})
+		}, []uint64{1, 2, 3}, false},
+		{"crc mismatch", func(t *testing.T, path string, size int64) {
+			// 翻转第二条记录负载中的一个字节
+			flipByte(t, path, size/3+size/6)
+		}, []uint64{1}, true},
+		{"bad length", func(t *testing.T, path string, size int64) {
+			flipByte(t, path, size/3)
+		}, []uint64{1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o, err := OpenOutbox(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := o.Append(protocol.MessageTypeSystemInfo, 1, map[string]int{"n": i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			seg := o.segments[0]
+			path, size := seg.path, seg.size
+			o.Close()
+
+			tt.damage(t, path, size)
+
+			o, err = OpenOutbox(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer o.Close()
+			records, err := o.Pending(0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var seqs []uint64
+			for _, rec := range records {
+				seqs = append(seqs, rec.Seq)
+			}
+			if !equalSeqs(seqs, tt.wantSeqs) {
+				t.Fatalf("seqs = %v, want %v", seqs, tt.wantSeqs)
+			}
+			if _, err := os.Stat(path + outboxCorruptExt); (err == nil) != tt.wantCorrupt {
+				t.Fatalf("corrupt copy exists = %v, want %v", err == nil, tt.wantCorrupt)
+			}
+
+			// 截断后追加的记录必须可读
+			seq, err := o.Append(protocol.MessageTypeSystemInfo, 1, "next")
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, _ = o.Pending(seq-1, 10)
+			if len(records) != 1 || records[0].Seq != seq {
+				t.Fatalf("appended record not readable after recovery: %v", records)
+			}
+		})
+	}
+}
+
+func TestOutboxAppendTooLarge(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"fits", maxOutboxRecordSize - outboxRecordFixedBody - 2, false},
+		{"too large", maxOutboxRecordSize, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// JSON 字符串带两个引号
+			_, err := o.Append(protocol.MessageTypeSystemInfo, 1, strings.Repeat("a", tt.size))
+			if got := errors.Is(err, ErrOutboxRecordTooLarge); got != tt.wantErr {
+				t.Fatalf("err = %v, want too large %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func equalSeqs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
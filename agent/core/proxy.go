@@ -0,0 +1,265 @@
+package core
+
+import (
+	"agent/config"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer 建立到 Hub 的 TCP 连接，代理、TLS 及其它传输都叠加在它返回的连接上。
+// 默认为 net.Dialer，可通过 Client.SetDialer 替换。
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxyDialer 经由 hub.proxy 配置的代理连接 Hub，noProxy 中的地址直接连接
+type proxyDialer struct {
+	url     *url.URL
+	noProxy []string
+	// dialer 连接代理服务器本身，隧道在其返回的连接上以 HTTP CONNECT 或 SOCKS5 建立
+	dialer Dialer
+	// lookup 在本地解析主机名，供 socks5（而非 socks5h）使用
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// newProxyDialer 按 hub.proxy 及 HTTPS_PROXY/ALL_PROXY/NO_PROXY 环境变量创建代理，未配置代理时返回 nil。
+// forward 用于连接代理服务器本身。
+func newProxyDialer(cfg *config.Config, forward Dialer) (*proxyDialer, error) {
+	pc := cfg.Hub.Proxy
+	raw := pc.URL
+	switch raw {
+	case "none":
+		return nil, nil
+	case "":
+		raw = getenv("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+		if raw == "" {
+			return nil, nil
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		// 与 curl 一致，没有 scheme 的地址视为 HTTP 代理
+		if u, err = url.Parse("http://" + raw); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("无效的代理地址: %s", raw)
+		}
+	}
+	if pc.Username != "" {
+		u.User = url.UserPassword(pc.Username, pc.Password)
+	}
+
+	d := &proxyDialer{url: u, noProxy: pc.NoProxy, lookup: net.DefaultResolver.LookupIPAddr}
+	if len(d.noProxy) == 0 {
+		for _, entry := range strings.Split(getenv("NO_PROXY", "no_proxy"), ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				d.noProxy = append(d.noProxy, entry)
+			}
+		}
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		d.dialer = &connectDialer{proxy: u, forward: forward}
+	case "socks5", "socks5h":
+		socks, err := proxy.FromURL(u, forwardDialer{forward})
+		if err != nil {
+			return nil, err
+		}
+		d.dialer = socks.(proxy.ContextDialer)
+	default:
+		return nil, fmt.Errorf("不支持的代理类型: %s", u.Scheme)
+	}
+	return d, nil
+}
+
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// String 返回不含密码的代理地址，用于日志
+func (d *proxyDialer) String() string {
+	u := *d.url
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	return u.String()
+}
+
+// bypass 判断 host 是否在 noProxy 中：* 表示所有地址，IP 或 CIDR 按地址匹配，
+// 其余按域名匹配（example.com 与 .example.com 都匹配其子域名）
+func (d *proxyDialer) bypass(host string) bool {
+	ip := net.ParseIP(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range d.noProxy {
+		entry = strings.ToLower(entry)
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContext 通过代理连接 addr。SOCKS5（socks5h）及 HTTP 代理由代理服务器解析主机名，
+// socks5 按惯例在本地解析后以 IP 连接，依次尝试解析出的每个地址。
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	addrs := []string{addr}
+	if d.url.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			ips, err := d.lookup(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			addrs = addrs[:0]
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+
+	var firstErr error
+	for _, target := range addrs {
+		conn, err := d.dialer.DialContext(ctx, "tcp", target)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "没有可用的地址", Name: addr}
+	}
+	return nil, fmt.Errorf("经由代理 %s 连接失败: %w", d, firstErr)
+}
+
+// forwardDialer 将 Dialer 适配为 x/net/proxy 的 Dialer
+type forwardDialer struct {
+	Dialer
+}
+
+func (f forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, addr)
+}
+
+// connectDialer 通过 HTTP CONNECT 建立隧道，https:// 代理与代理服务器之间使用 TLS
+type connectDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// 隧道建立前的读写受 ctx 的截止时间约束
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// 2xx 的 CONNECT 应答没有正文，之后的数据属于隧道，不能读取 resp.Body
+	if resp.StatusCode/100 != 2 {
+		conn.Close()
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, errors.New("代理要求认证 (407), 请检查 hub.proxy 的用户名和密码")
+		}
+		return nil, fmt.Errorf("代理拒绝 CONNECT: %s", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// 代理在应答后紧接着转发了 Hub 的数据
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读出 CONNECT 应答之后已缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// SetDialer 替换连接 Hub 及代理服务器使用的 Dialer，须在 Start 之前调用
+func (c *Client) SetDialer(dialer Dialer) {
+	c.dialer = dialer
+}
@@ -0,0 +1,241 @@
+package core
+
+import (
+	"agent/config"
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveProxy 在本地监听，每个连接交由 handle 处理
+func serveProxy(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echo 回显隧道中的数据，模拟 Hub
+func echo(conn net.Conn, reader io.Reader) {
+	io.Copy(conn, reader)
+}
+
+// dialThroughProxy 经由代理连接 addr 并确认隧道可以双向传输数据
+func dialThroughProxy(t *testing.T, cfg *config.Config, addr string, greeting string) error {
+	t.Helper()
+	d, err := newProxyDialer(cfg, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	want := greeting + "ping"
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("tunnel data = %q, want %q", got, want)
+	}
+	return nil
+}
+
+func TestConnectProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		greeting string // 代理紧随应答转发的 Hub 数据
+		wantErr  string
+	}{
+		{"200", "200 Connection established", "", ""},
+		{"other 2xx", "204 No Content", "", ""},
+		{"data after response", "200 OK", "hello", ""},
+		{"auth required", "407 Proxy Authentication Required", "", "407"},
+		{"forbidden", "403 Forbidden", "", "403"},
+	}
+	for _, tt := range tests {
+		tt := tt // 代理协程可能在子测试结束后才退出
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var target, auth string
+			proxyAddr := serveProxy(t, func(conn net.Conn) {
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				mutex.Lock()
+				target, auth = req.Host, req.Header.Get("Proxy-Authorization")
+				mutex.Unlock()
+				io.WriteString(conn, "HTTP/1.1 "+tt.status+"\r\n\r\n"+tt.greeting)
+				if strings.HasPrefix(tt.status, "2") {
+					echo(conn, reader)
+				}
+			})
+
+			cfg := &config.Config{}
+			cfg.Hub.Proxy.URL = "http://" + proxyAddr
+			cfg.Hub.Proxy.Username = "user"
+			cfg.Hub.Proxy.Password = "pass"
+			err := dialThroughProxy(t, cfg, "hub.example.test:9527", tt.greeting)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if target != "hub.example.test:9527" {
+				t.Fatalf("CONNECT target = %q", target)
+			}
+			if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")); auth != want {
+				t.Fatalf("Proxy-Authorization = %q, want %q", auth, want)
+			}
+		})
+	}
+}
+
+// serveSOCKS5 是不要求认证的 SOCKS5 代理，refuse 中的目标返回连接被拒绝，其余回显隧道数据
+func serveSOCKS5(t *testing.T, refuse map[string]bool, requested chan<- string) string {
+	return serveProxy(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		var greeting [2]byte
+		if _, err := io.ReadFull(reader, greeting[:]); err != nil || greeting[0] != 5 {
+			return
+		}
+		if _, err := io.ReadFull(reader, make([]byte, greeting[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		var header [4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil || header[1] != 1 {
+			return
+		}
+		var host string
+		switch header[3] {
+		case 1:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(reader, ip)
+			host = net.IP(ip).String()
+		case 4:
+			ip := make([]byte, net.IPv6len)
+			io.ReadFull(reader, ip)
+			host = net.IP(ip).String()
+		case 3:
+			length, _ := reader.ReadByte()
+			name := make([]byte, length)
+			io.ReadFull(reader, name)
+			host = string(name)
+		}
+		var port [2]byte
+		if _, err := io.ReadFull(reader, port[:]); err != nil {
+			return
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+		requested <- addr
+
+		reply := byte(0)
+		if refuse[addr] {
+			reply = 5
+		}
+		conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+		if reply == 0 {
+			echo(conn, reader)
+		}
+	})
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	ips := []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}
+
+	tests := []struct {
+		name          string
+		scheme        string
+		refuse        []string
+		wantRequested []string
+		wantErr       bool
+	}{
+		{"socks5h sends hostname", "socks5h", nil, []string{"hub.example.test:9527"}, false},
+		{"socks5 resolves locally", "socks5", nil, []string{"192.0.2.1:9527"}, false},
+		{"socks5 tries next address", "socks5", []string{"192.0.2.1:9527"}, []string{"192.0.2.1:9527", "[2001:db8::1]:9527"}, false},
+		{"socks5 all refused", "socks5", []string{"192.0.2.1:9527", "[2001:db8::1]:9527"}, []string{"192.0.2.1:9527", "[2001:db8::1]:9527"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refuse := make(map[string]bool)
+			for _, addr := range tt.refuse {
+				refuse[addr] = true
+			}
+			requested := make(chan string, 4)
+			proxyAddr := serveSOCKS5(t, refuse, requested)
+
+			cfg := &config.Config{}
+			cfg.Hub.Proxy.URL = tt.scheme + "://" + proxyAddr
+			d, err := newProxyDialer(cfg, &net.Dialer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				return ips, nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := d.DialContext(ctx, "tcp", "hub.example.test:9527")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				conn.Write([]byte("ping"))
+				got := make([]byte, 4)
+				if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+					t.Fatalf("tunnel data = %q, %v", got, err)
+				}
+				conn.Close()
+			}
+
+			for _, want := range tt.wantRequested {
+				if got := <-requested; got != want {
+					t.Fatalf("requested %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"agent/logger"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+const (
+	defaultReconnectInterval    = time.Second
+	defaultReconnectMaxInterval = 5 * time.Minute
+	backoffMultiplier           = 2
+)
+
+// backoff 计算重连前的等待时间：上限为 min(max, initial*2^attempt)，
+// 实际等待在 [0, 上限] 内均匀随机（full jitter），避免大量 Agent 在 Hub 重启后同时重连。
+// 只在连接管理协程中使用。
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	if initial <= 0 {
+		initial = defaultReconnectInterval
+	}
+	if max <= 0 {
+		max = defaultReconnectMaxInterval
+	}
+	if max < initial {
+		max = initial
+	}
+	return &backoff{initial: initial, max: max}
+}
+
+// next 返回下一次重连前的等待时间
+func (b *backoff) next() time.Duration {
+	ceiling := b.initial
+	for i := 0; i < b.attempt && ceiling < b.max; i++ {
+		ceiling *= backoffMultiplier
+	}
+	if ceiling > b.max {
+		ceiling = b.max
+	}
+	b.attempt++
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// reset 在连接成功后重新从初始间隔开始
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// FailoverStrategy 决定每一轮重连尝试 Hub 地址的顺序。
+// 方法只在连接管理协程中调用，实现无需加锁。
+type FailoverStrategy interface {
+	// Order 返回本轮尝试的地址顺序，addresses 为配置的主地址及备用地址，不应修改
+	Order(addresses []string) []string
+	// Connected 在连接到 addr 并通过认证后调用
+	Connected(addr string)
+}
+
+// NewFailoverStrategy 按名称创建故障转移策略: priority（默认）, round_robin, random, sticky
+func NewFailoverStrategy(name string) (FailoverStrategy, error) {
+	switch name {
+	case "", "priority":
+		return priorityStrategy{}, nil
+	case "round_robin":
+		return &roundRobinStrategy{}, nil
+	case "random":
+		return randomStrategy{}, nil
+	case "sticky":
+		return &stickyStrategy{}, nil
+	}
+	return nil, fmt.Errorf("未知的故障转移策略: %s", name)
+}
+
+// priorityStrategy 始终按配置顺序尝试，主地址优先
+type priorityStrategy struct{}
+
+func (priorityStrategy) Order(addresses []string) []string { return addresses }
+func (priorityStrategy) Connected(string)                  {}
+
+// roundRobinStrategy 每一轮从下一个地址开始尝试
+type roundRobinStrategy struct {
+	next int
+}
+
+func (s *roundRobinStrategy) Order(addresses []string) []string {
+	if len(addresses) == 0 {
+		return addresses
+	}
+	start := s.next % len(addresses)
+	s.next = start + 1
+	return append(append([]string(nil), addresses[start:]...), addresses[:start]...)
+}
+
+func (s *roundRobinStrategy) Connected(string) {}
+
+// randomStrategy 每一轮以随机顺序尝试，将负载分散到各个 Hub
+type randomStrategy struct{}
+
+func (randomStrategy) Order(addresses []string) []string {
+	order := append([]string(nil), addresses...)
+	rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	return order
+}
+
+func (randomStrategy) Connected(string) {}
+
+// stickyStrategy 优先尝试上次成功连接的地址，其余按配置顺序
+type stickyStrategy struct {
+	lastGood string
+}
+
+func (s *stickyStrategy) Order(addresses []string) []string {
+	return moveToFront(addresses, s.lastGood)
+}
+
+func (s *stickyStrategy) Connected(addr string) {
+	s.lastGood = addr
+}
+
+// moveToFront 返回将 addr 移到首位的副本，addr 不在列表中时按原顺序
+func moveToFront(addresses []string, addr string) []string {
+	order := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		if a == addr {
+			order = append(order, a)
+		}
+	}
+	if len(order) == 0 {
+		return addresses
+	}
+	for _, a := range addresses {
+		if a != addr {
+			order = append(order, a)
+		}
+	}
+	return order
+}
+
+// SetFailoverStrategy 替换 hub.failover.strategy 配置的故障转移策略，须在 Start 之前调用
+func (c *Client) SetFailoverStrategy(strategy FailoverStrategy) {
+	c.failover = strategy
+}
+
+// dialOrderLocked 返回本轮尝试的地址顺序，targets 的第一个为主地址，探测到主地址恢复后的一轮优先尝试主地址。
+// 调用方需持有 mutex。
+func (c *Client) dialOrderLocked(targets []hubTarget) []hubTarget {
+	if len(targets) == 0 {
+		return nil
+	}
+	byEndpoint := make(map[string]hubTarget, len(targets))
+	for _, t := range targets {
+		byEndpoint[t.endpoint] = t
+	}
+	order := c.failover.Order(endpoints(targets))
+	if c.preferPrimary {
+		c.preferPrimary = false
+		order = moveToFront(order, targets[0].endpoint)
+	}
+
+	ordered := make([]hubTarget, 0, len(order))
+	for _, endpoint := range order {
+		if t, ok := byEndpoint[endpoint]; ok {
+			ordered = append(ordered, t)
+		}
+	}
+	return ordered
+}
+
+// network 返回按 hub.protocol 配置选择的网络类型
+func (c *Client) network() string {
+	switch c.cfg.Hub.Protocol {
+	case "ipv6":
+		return "tcp6"
+	case "ipv4":
+		return "tcp4"
+	}
+	return "tcp"
+}
+
+// waitReconnect 等待下一次重连，Stop 或遇到不可重试的错误时立即返回 false
+func (c *Client) waitReconnect() bool {
+	delay := c.backoff.next()
+	logger.Info("将在", delay.Round(time.Millisecond), "后重连")
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.stop:
+		return false
+	case <-c.failed:
+		return false
+	}
+}
+
+// primaryProbe 在连接到备用地址期间定期探测主地址，主地址可以连接时断开当前连接并切换回主地址
+func (c *Client) primaryProbe(interval time.Duration) {
+	logger.Info("主地址探测启动, 间隔:", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.RLock()
+		conn, addr, ready := c.conn, c.addr, c.state == StateReady
+		c.mutex.RUnlock()
+		if !ready {
+			continue
+		}
+		// 启用地址发现时主地址可能随 DNS 变化
+		groups := c.dialGroups(c.discovery.resolve())
+		if len(groups) == 0 {
+			continue
+		}
+		// hub.protocol 为 auto 时主地址展开为一组地址，连接到其中任一地址都已是主地址
+		primary := groups[0][0].endpoint
+		if slices.Contains(endpoints(groups[0]), addr) {
+			continue
+		}
+
+		// 与正常连接一样经由代理或竞速连接
+		probe, err := c.dialHub(groups[0])
+		if err != nil {
+			logger.Debug("主地址仍不可用:", primary, err)
+			continue
+		}
+		probe.Close()
+
+		logger.Info("主地址已恢复, 切换回主地址:", primary)
+		c.mutex.Lock()
+		c.preferPrimary = true
+		c.mutex.Unlock()
+		c.handleDisconnect(conn, errors.New("切换回主地址 "+primary))
+	}
+}
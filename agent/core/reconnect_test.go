@@ -0,0 +1,214 @@
+package core
+
+import (
+	"agent/config"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  time.Duration
+		max      time.Duration
+		attempt  int
+		ceiling  time.Duration
+		wantInit time.Duration
+	}{
+		{"first attempt", time.Second, time.Minute, 0, time.Second, time.Second},
+		{"doubles", time.Second, time.Minute, 3, 8 * time.Second, time.Second},
+		{"capped", time.Second, time.Minute, 10, time.Minute, time.Second},
+		{"no overflow", time.Second, time.Minute, 1000, time.Minute, time.Second},
+		{"defaults", 0, 0, 100, defaultReconnectMaxInterval, defaultReconnectInterval},
+		{"max below initial", 10 * time.Second, time.Second, 5, 10 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBackoff(tt.initial, tt.max)
+			if b.initial != tt.wantInit {
+				t.Fatalf("initial = %v, want %v", b.initial, tt.wantInit)
+			}
+			var longest time.Duration
+			for i := 0; i < 200; i++ {
+				b.attempt = tt.attempt
+				d := b.next()
+				if d < 0 || d > tt.ceiling {
+					t.Fatalf("next() = %v, want within [0, %v]", d, tt.ceiling)
+				}
+				if b.attempt != tt.attempt+1 {
+					t.Fatalf("attempt = %d, want %d", b.attempt, tt.attempt+1)
+				}
+				longest = max(longest, d)
+			}
+			// full jitter 在整个区间内取值，而不是固定的间隔
+			if longest < tt.ceiling/2 {
+				t.Fatalf("200 次等待都不超过 %v, 上限为 %v", longest, tt.ceiling)
+			}
+		})
+	}
+
+	b := newBackoff(time.Second, time.Minute)
+	b.attempt = 10
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Fatalf("reset 后 next() = %v, want within [0, 1s]", d)
+	}
+}
+
+func TestFailoverStrategies(t *testing.T) {
+	addresses := []string{"a", "b", "c"}
+	tests := []struct {
+		strategy  string
+		connected map[int]string // 第 i 轮之前成功连接的地址
+		want      [][]string     // 各轮的尝试顺序
+	}{
+		{"priority", map[int]string{1: "b"}, [][]string{{"a", "b", "c"}, {"a", "b", "c"}}},
+		{"round_robin", nil, [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}}},
+		{"sticky", map[int]string{1: "b", 3: "x"}, [][]string{{"a", "b", "c"}, {"b", "a", "c"}, {"b", "a", "c"}, {"a", "b", "c"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			s, err := NewFailoverStrategy(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for round, want := range tt.want {
+				if addr, ok := tt.connected[round]; ok {
+					s.Connected(addr)
+				}
+				if got := s.Order(addresses); !reflect.DeepEqual(got, want) {
+					t.Fatalf("round %d: order = %v, want %v", round, got, want)
+				}
+			}
+			if !reflect.DeepEqual(addresses, []string{"a", "b", "c"}) {
+				t.Fatalf("Order 修改了传入的地址: %v", addresses)
+			}
+		})
+	}
+
+	t.Run("random", func(t *testing.T) {
+		s, _ := NewFailoverStrategy("random")
+		got := s.Order(addresses)
+		sorted := append([]string(nil), got...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(sorted, addresses) {
+			t.Fatalf("order = %v 不是 %v 的排列", got, addresses)
+		}
+	})
+
+	if _, err := NewFailoverStrategy("least_loaded"); err == nil {
+		t.Fatal("未知的策略应返回错误")
+	}
+}
+
+func TestDialOrderPreferPrimary(t *testing.T) {
+	targets := []hubTarget{{"a:1", "a"}, {"b:1", "b"}, {"c:1", "c"}}
+	c := NewClient(&config.Config{})
+	c.failover = &roundRobinStrategy{next: 1}
+	c.preferPrimary = true
+
+	if got := endpoints(c.dialOrderLocked(targets)); !reflect.DeepEqual(got, []string{"a:1", "b:1", "c:1"}) {
+		t.Fatalf("探测到主地址恢复后应先尝试主地址, order = %v", got)
+	}
+	// 只影响一轮
+	if got := endpoints(c.dialOrderLocked(targets)); !reflect.DeepEqual(got, []string{"c:1", "a:1", "b:1"}) {
+		t.Fatalf("order = %v", got)
+	}
+}
+
+// TestPrimaryProbe 确认只有连接在备用地址且主地址可以连接时才断开当前连接
+func TestPrimaryProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		onPrimary  bool
+		primaryUp  bool
+		wantSwitch bool
+	}{
+		{"on backup, primary recovered", false, true, true},
+		{"on backup, primary down", false, false, false},
+		{"on primary", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepted := make(chan struct{}, 16)
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+					accepted <- struct{}{}
+				}
+			}()
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			if tt.primaryUp {
+				defer ln.Close()
+			} else {
+				ln.Close()
+			}
+
+			cfg := &config.Config{}
+			cfg.Hub.Address = "127.0.0.1"
+			cfg.Hub.Port, _ = strconv.Atoi(port)
+			cfg.Hub.BackupAddresses = []string{"backup.example.test"}
+			c := NewClient(cfg)
+			c.dialer = &net.Dialer{}
+			if c.discovery, err = newDiscovery(cfg, nil); err != nil {
+				t.Fatal(err)
+			}
+			current, peer := net.Pipe()
+			defer peer.Close()
+			c.conn = current
+			c.state = StateReady
+			c.addr = net.JoinHostPort("backup.example.test", port)
+			if tt.onPrimary {
+				c.addr = ln.Addr().String()
+			}
+
+			done := make(chan struct{})
+			go func() {
+				c.primaryProbe(10 * time.Millisecond)
+				close(done)
+			}()
+			defer func() {
+				close(c.stop)
+				<-done
+			}()
+
+			select {
+			case <-c.reconnect:
+				if !tt.wantSwitch {
+					t.Fatal("不应断开当前连接")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.wantSwitch {
+					t.Fatal("主地址恢复后未切换")
+				}
+			}
+
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			if tt.wantSwitch {
+				if c.conn != nil || c.state != StateDisconnected || !c.preferPrimary {
+					t.Fatalf("conn = %v, state = %v, preferPrimary = %v", c.conn, c.state, c.preferPrimary)
+				}
+				return
+			}
+			if c.conn != current || c.state != StateReady || c.preferPrimary {
+				t.Fatalf("conn = %v, state = %v, preferPrimary = %v", c.conn, c.state, c.preferPrimary)
+			}
+			if tt.onPrimary && len(accepted) > 0 {
+				t.Fatal("已连接主地址时不应探测")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"agent/protocol"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrConnectionLost = errors.New("连接已断开, 请求未得到响应")
+
+// requestResult 是请求的响应或失败原因
+type requestResult struct {
+	msg *protocol.Message
+	err error
+}
+
+// requestRouter 为请求分配关联 ID，并把带关联 ID 的响应投递给等待中的调用方
+type requestRouter struct {
+	mutex   sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan requestResult
+}
+
+func newRequestRouter() *requestRouter {
+	return &requestRouter{
+		nextID:  1,
+		pending: make(map[uint64]chan requestResult),
+	}
+}
+
+// register 为消息分配关联 ID，返回接收响应的 channel
+func (r *requestRouter) register(msg *protocol.Message) chan requestResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id := r.nextID
+	r.nextID++
+	msg.Header.CorrelationID = id
+	ch := make(chan requestResult, 1)
+	r.pending[id] = ch
+	return ch
+}
+
+// cancel 移除等待中的请求
+func (r *requestRouter) cancel(id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.pending, id)
+}
+
+// deliver 将响应交给对应的请求，没有等待者时返回 false
+func (r *requestRouter) deliver(msg *protocol.Message) bool {
+	r.mutex.Lock()
+	ch, exists := r.pending[msg.Header.CorrelationID]
+	delete(r.pending, msg.Header.CorrelationID)
+	r.mutex.Unlock()
+
+	if !exists {
+		return false
+	}
+	ch <- requestResult{msg: msg}
+	return true
+}
+
+// failAll 以 err 结束所有等待中的请求
+func (r *requestRouter) failAll(err error) {
+	r.mutex.Lock()
+	pending := r.pending
+	r.pending = make(map[uint64]chan requestResult)
+	r.mutex.Unlock()
+
+	for _, ch := range pending {
+		ch <- requestResult{err: err}
+	}
+}
+
+// Request 发送消息并等待 Hub 返回带相同关联 ID 的响应，ctx 结束时放弃等待
+func (c *Client) Request(ctx context.Context, msg *protocol.Message) (*protocol.Message, error) {
+	ch := c.requests.register(msg)
+	id := msg.Header.CorrelationID
+
+	if err := c.SendContext(ctx, msg); err != nil {
+		c.requests.cancel(id)
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		c.requests.cancel(id)
+		return nil, ctx.Err()
+	case result := <-ch:
+		return result.msg, result.err
+	}
+}
+
+// Call 以通用 REQ/RESP 消息调用 Hub 的 method，并将结果解码到 result（可为 nil）。
+// Hub 支持的 method 见其 TCPServer.handleRequest。
+func (c *Client) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	req := &protocol.RequestPayload{Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("序列化请求参数失败: %v", err)
+		}
+		req.Params = data
+	}
+
+	resp, err := c.Request(ctx, protocol.NewMessage(protocol.MessageTypeRequest, req))
+	if err != nil {
+		return err
+	}
+
+	var payload protocol.ResponsePayload
+	if err := resp.DecodePayload(&payload); err != nil {
+		return fmt.Errorf("解析响应失败: %v", err)
+	}
+	if payload.Error != "" {
+		return fmt.Errorf("Hub 返回错误: %s", payload.Error)
+	}
+	if result != nil && len(payload.Result) > 0 {
+		if err := json.Unmarshal(payload.Result, result); err != nil {
+			return fmt.Errorf("解析响应结果失败: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"agent/config"
+	"agent/protocol"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func response(id uint64, payload *protocol.ResponsePayload) *protocol.Message {
+	msg := protocol.NewMessage(protocol.MessageTypeResponse, payload)
+	msg.Header.CorrelationID = id
+	return msg
+}
+
+func TestRequestRouter(t *testing.T) {
+	t.Run("deliver", func(t *testing.T) {
+		r := newRequestRouter()
+		first := protocol.NewMessage(protocol.MessageTypeRequest, nil)
+		second := protocol.NewMessage(protocol.MessageTypeRequest, nil)
+		ch1, ch2 := r.register(first), r.register(second)
+		if first.Header.CorrelationID == second.Header.CorrelationID {
+			t.Fatalf("关联 ID 重复: %d", first.Header.CorrelationID)
+		}
+
+		resp := response(second.Header.CorrelationID, &protocol.ResponsePayload{})
+		if !r.deliver(resp) {
+			t.Fatal("deliver 应找到等待中的请求")
+		}
+		if result := <-ch2; result.msg != resp || result.err != nil {
+			t.Fatalf("result = %+v", result)
+		}
+		select {
+		case result := <-ch1:
+			t.Fatalf("响应投递给了其他请求: %+v", result)
+		default:
+		}
+		// 同一关联 ID 只投递一次
+		if r.deliver(resp) {
+			t.Fatal("重复的响应不应再次投递")
+		}
+	})
+
+	t.Run("unknown id", func(t *testing.T) {
+		r := newRequestRouter()
+		if r.deliver(response(42, &protocol.ResponsePayload{})) {
+			t.Fatal("没有等待者时 deliver 应返回 false")
+		}
+	})
+
+	t.Run("reply after cancel", func(t *testing.T) {
+		r := newRequestRouter()
+		msg := protocol.NewMessage(protocol.MessageTypeRequest, nil)
+		ch := r.register(msg)
+		r.cancel(msg.Header.CorrelationID)
+		if r.deliver(response(msg.Header.CorrelationID, &protocol.ResponsePayload{})) {
+			t.Fatal("取消后到达的响应不应投递")
+		}
+		select {
+		case result := <-ch:
+			t.Fatalf("取消的请求收到了结果: %+v", result)
+		default:
+		}
+	})
+
+	t.Run("failAll", func(t *testing.T) {
+		r := newRequestRouter()
+		chs := []chan requestResult{
+			r.register(protocol.NewMessage(protocol.MessageTypeRequest, nil)),
+			r.register(protocol.NewMessage(protocol.MessageTypeRequest, nil)),
+		}
+		r.failAll(ErrConnectionLost)
+		for _, ch := range chs {
+			if result := <-ch; result.err != ErrConnectionLost || result.msg != nil {
+				t.Fatalf("result = %+v", result)
+			}
+		}
+		if len(r.pending) != 0 {
+			t.Fatalf("pending = %v", r.pending)
+		}
+	})
+}
+
+// readyClient 返回处于 Ready 状态、尚未连接的 Client，发出的帧留在 c.queue 中
+func readyClient() *Client {
+	c := NewClient(&config.Config{})
+	c.state = StateReady
+	c.queue = newSendQueue(0)
+	return c
+}
+
+// popRequest 取出 c 发出的下一条 REQ 并解码
+func popRequest(t *testing.T, c *Client) (*protocol.Message, *protocol.RequestPayload) {
+	t.Helper()
+	frame, ok := c.queue.pop()
+	if !ok {
+		t.Fatal("发送队列已关闭")
+	}
+	parser := protocol.NewMessageParser()
+	parser.Append(frame.data)
+	msg, err := parser.ParseMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req protocol.RequestPayload
+	if err := msg.DecodePayload(&req); err != nil {
+		t.Fatal(err)
+	}
+	return msg, &req
+}
+
+func TestRequestTimeout(t *testing.T) {
+	c := readyClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	msg := protocol.NewMessage(protocol.MessageTypeRequest, &protocol.RequestPayload{Method: "config"})
+	if _, err := c.Request(ctx, msg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(c.requests.pending) != 0 {
+		t.Fatalf("超时的请求未移除: %v", c.requests.pending)
+	}
+	// 超时后才到达的响应被忽略
+	if outcome := c.dispatch(response(msg.Header.CorrelationID, &protocol.ResponsePayload{})); !strings.HasPrefix(outcome, "ignored") {
+		t.Fatalf("outcome = %s", outcome)
+	}
+}
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   protocol.ResponsePayload
+		want    map[string]int
+		wantErr string
+	}{
+		{"result", protocol.ResponsePayload{Result: json.RawMessage(`{"heartbeatInterval":30}`)}, map[string]int{"heartbeatInterval": 30}, ""},
+		{"hub error", protocol.ResponsePayload{Error: "未知的方法: config"}, nil, "未知的方法"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := readyClient()
+			// 模拟 Hub：以相同的关联 ID 回复 RESP
+			go func() {
+				msg, req := popRequest(t, c)
+				if req.Method != "config" || string(req.Params) != `{"uuid":"x"}` {
+					t.Errorf("request = %+v", req)
+				}
+				reply := tt.reply
+				c.handleMessage(response(msg.Header.CorrelationID, &reply))
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var got map[string]int
+			err := c.Call(ctx, "config", map[string]string{"uuid": "x"}, &got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["heartbeatInterval"] != tt.want["heartbeatInterval"] {
+				t.Fatalf("result = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDispatchCorrelated 确认只有 RESP 交给等待中的请求，其他类型即使关联 ID 相同也按类型处理
+func TestDispatchCorrelated(t *testing.T) {
+	c := readyClient()
+	req := protocol.NewMessage(protocol.MessageTypeRequest, nil)
+	ch := c.requests.register(req)
+
+	heartbeat := protocol.NewMessage(protocol.MessageTypeHeartbeat, &protocol.HeartbeatPayload{})
+	heartbeat.Header.CorrelationID = req.Header.CorrelationID
+	if outcome := c.dispatch(heartbeat); outcome == outcomeDelivered {
+		t.Fatalf("HEART 不应作为响应投递")
+	}
+	select {
+	case result := <-ch:
+		t.Fatalf("请求收到了非响应消息: %+v", result)
+	default:
+	}
+
+	resp := response(req.Header.CorrelationID, &protocol.ResponsePayload{})
+	if outcome := c.dispatch(resp); outcome != outcomeDelivered {
+		t.Fatalf("outcome = %s, want %s", outcome, outcomeDelivered)
+	}
+	if result := <-ch; result.msg != resp {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestRequestConnectionLost(t *testing.T) {
+	c := readyClient()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Request(context.Background(), protocol.NewMessage(protocol.MessageTypeRequest, nil))
+		done <- err
+	}()
+	popRequest(t, c)
+	c.requests.failAll(ErrConnectionLost)
+	if err := <-done; err != ErrConnectionLost {
+		t.Fatalf("err = %v, want %v", err, ErrConnectionLost)
+	}
+}
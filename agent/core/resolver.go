@@ -0,0 +1,309 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout     = 3 * time.Second
+	dnsUDPSize     = 1232
+	resolvConfPath = "/etc/resolv.conf"
+	// systemResolverTTL 是系统解析器不提供 TTL 时结果的缓存时长
+	systemResolverTTL = time.Minute
+)
+
+var errNoRecords = errors.New("没有匹配的 DNS 记录")
+
+// Resolver 解析 Hub 地址，返回的 TTL 决定结果的缓存时长。
+// 默认直接查询 DNS 服务器以取得记录的 TTL，可通过 Client.SetResolver 替换（如测试中使用固定的记录）。
+type Resolver interface {
+	// LookupSRV 查询 SRV 记录，不需要排序
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+	// LookupHost 查询主机名的所有 A/AAAA 记录
+	LookupHost(ctx context.Context, host string) ([]string, time.Duration, error)
+}
+
+// NewResolver 返回查询 servers（host 或 host:port）的解析器；servers 为空时使用 /etc/resolv.conf 中的服务器，
+// 无法读取时使用系统解析器，结果按固定时长缓存。直接查询失败时改用系统解析器，
+// 以便 /etc/hosts 中的条目及 resolv.conf 的 search 域名仍然生效。
+func NewResolver(servers []string) Resolver {
+	if len(servers) == 0 {
+		servers = systemNameservers()
+	}
+	if len(servers) == 0 {
+		return systemResolver{}
+	}
+	r := &dnsResolver{fallback: systemResolver{}}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r
+}
+
+// systemNameservers 读取 /etc/resolv.conf 中的 nameserver
+func systemNameservers() []string {
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// systemResolver 使用 Go 的系统解析器，无法取得 TTL
+type systemResolver struct{}
+
+func (systemResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return records, systemResolverTTL, err
+}
+
+func (systemResolver) LookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	return addrs, systemResolverTTL, err
+}
+
+// dnsResolver 直接向 DNS 服务器发送递归查询，依次尝试各服务器；应答被截断时改用 TCP
+type dnsResolver struct {
+	servers  []string
+	fallback Resolver // 所有服务器都查询失败时使用，为 nil 时不回退
+}
+
+// LookupSRV 查询 SRV 记录，失败时改用 fallback，两者都失败时返回直接查询的错误
+func (r *dnsResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	records, ttl, err := r.lookupSRV(ctx, name)
+	if err != nil && r.fallback != nil {
+		if fallback, fallbackTTL, fallbackErr := r.fallback.LookupSRV(ctx, name); fallbackErr == nil && len(fallback) > 0 {
+			return fallback, fallbackTTL, nil
+		}
+	}
+	return records, ttl, err
+}
+
+// LookupHost 查询 A/AAAA 记录，失败时改用 fallback，两者都失败时返回直接查询的错误
+func (r *dnsResolver) LookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	addrs, ttl, err := r.lookupHost(ctx, host)
+	if err != nil && r.fallback != nil {
+		if fallback, fallbackTTL, fallbackErr := r.fallback.LookupHost(ctx, host); fallbackErr == nil && len(fallback) > 0 {
+			return fallback, fallbackTTL, nil
+		}
+	}
+	return addrs, ttl, err
+}
+
+func (r *dnsResolver) lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	answers, ttl, err := r.lookup(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records []*net.SRV
+	for _, answer := range answers {
+		if srv, ok := answer.Body.(*dnsmessage.SRVResource); ok {
+			records = append(records, &net.SRV{
+				Target:   srv.Target.String(),
+				Port:     srv.Port,
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+			})
+		}
+	}
+	return records, ttl, nil
+}
+
+// lookupHost 分别查询 A 与 AAAA 记录，任一类型有结果即可
+func (r *dnsResolver) lookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	var addrs []string
+	var ttl time.Duration
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, answerTTL, err := r.lookup(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]).String())
+			}
+		}
+		if len(addrs) == len(answers) || answerTTL < ttl {
+			ttl = answerTTL
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = errNoRecords
+		}
+		return nil, 0, lastErr
+	}
+	return addrs, ttl, nil
+}
+
+// lookup 返回应答中 qtype 类型的记录及其中最小的 TTL
+func (r *dnsResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("无效的域名 %s: %v", name, err)
+	}
+
+	var lastErr error
+	for _, server := range r.servers {
+		msg, err := r.exchange(ctx, server, qname, qtype)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", server, err)
+			continue
+		}
+		switch msg.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, 0, fmt.Errorf("%s: 域名不存在", name)
+		default:
+			lastErr = fmt.Errorf("%s: %v", server, msg.RCode)
+			continue
+		}
+
+		var answers []dnsmessage.Resource
+		var ttl uint32
+		for _, answer := range msg.Answers {
+			if answer.Header.Type != qtype {
+				continue
+			}
+			if len(answers) == 0 || answer.Header.TTL < ttl {
+				ttl = answer.Header.TTL
+			}
+			answers = append(answers, answer)
+		}
+		if len(answers) == 0 {
+			return nil, 0, fmt.Errorf("%s: %w", name, errNoRecords)
+		}
+		return answers, time.Duration(ttl) * time.Second, nil
+	}
+	return nil, 0, lastErr
+}
+
+// exchange 向 server 发送一次查询，应答被截断时以 TCP 重新查询
+func (r *dnsResolver) exchange(ctx context.Context, server string, qname dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	id := uint16(rand.Intn(1 << 16))
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	msg, err := roundTrip(ctx, "udp", server, query, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Truncated {
+		return roundTrip(ctx, "tcp", server, query, id)
+	}
+	return msg, nil
+}
+
+// roundTrip 发送查询并读取 ID 匹配的应答；TCP 上的消息带 2 字节长度前缀
+func roundTrip(ctx context.Context, network, server string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	stream := network == "tcp"
+	if stream {
+		framed := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		copy(framed[2:], query)
+		query = framed
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	for {
+		var buf []byte
+		if stream {
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return nil, err
+			}
+			buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return nil, err
+			}
+		} else {
+			buf = make([]byte, dnsUDPSize)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			buf = buf[:n]
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf); err != nil {
+			return nil, err
+		}
+		// 丢弃不匹配的 UDP 应答（如迟到的旧查询应答）
+		if msg.ID != id || !msg.Response {
+			if stream {
+				return nil, errors.New("DNS 应答 ID 不匹配")
+			}
+			continue
+		}
+		return &msg, nil
+	}
+}
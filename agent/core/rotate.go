@@ -0,0 +1,184 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// rotate 处理 Hub 下发的新凭据：写在现有凭据旁边后以新凭据重连，
+// 通过认证后才替换现有凭据，失败时回退（见 rotationSucceeded、rotationFailed）
+func (c *Client) rotate(msg *protocol.Message) error {
+	if !c.Capabilities().Supports(protocol.FeatureRotate) {
+		logger.Warn("Hub 未协商凭据轮换功能, 忽略 ROTATE")
+		return errors.New("未协商凭据轮换功能")
+	}
+	payload, ok := msg.Payload.(*protocol.RotatePayload)
+	if !ok || (payload.Secret == "" && payload.Certificate == "") {
+		logger.Error("ROTATE 消息中没有新凭据")
+		return errors.New("没有新凭据")
+	}
+
+	cred, err := c.rotatedCredential(payload)
+	if err != nil {
+		logger.Error("无法使用 Hub 下发的新凭据:", err)
+		return err
+	}
+	if err := c.credentials.SavePending(cred); err != nil {
+		logger.Error("保存新凭据失败:", err)
+		return err
+	}
+	if err := c.setPendingCredential(cred); err != nil {
+		logger.Error("无法使用 Hub 下发的新凭据:", err)
+		c.credentials.DiscardPending()
+		return err
+	}
+
+	logger.Info("收到新凭据, 重新连接以启用")
+	c.handleDisconnect(nil, errors.New("重新连接以启用新凭据"))
+	return nil
+}
+
+// rotatedCredential 以 payload 中的新项替换当前凭据的对应项。
+// 续签的证书沿用当前私钥：已注册的 Agent 使用凭据中的私钥，否则使用 hub.tls.key。
+func (c *Client) rotatedCredential(payload *protocol.RotatePayload) (*Credential, error) {
+	c.mutex.RLock()
+	cred := &Credential{}
+	if c.credential != nil {
+		*cred = *c.credential
+	}
+	tlsEnabled := c.tlsConfig != nil
+	c.mutex.RUnlock()
+
+	if cred.Secret == "" {
+		cred.Secret = c.cfg.Auth.Key
+	}
+	if payload.Secret != "" {
+		cred.Secret = payload.Secret
+	}
+	if payload.Certificate != "" {
+		if !tlsEnabled {
+			return nil, errors.New("未启用 TLS, 无法使用新证书")
+		}
+		if cred.PrivateKey == "" {
+			key, err := os.ReadFile(c.cfg.Hub.TLS.Key)
+			if err != nil {
+				return nil, fmt.Errorf("读取客户端私钥失败: %v", err)
+			}
+			cred.PrivateKey = string(key)
+		}
+		cred.Certificate = payload.Certificate
+	}
+	cred.IssuedAt = time.Now()
+
+	// 提前校验证书与私钥是否匹配，避免以无效凭据重连
+	if _, err := cred.tlsCertificate(); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// setPendingCredential 设置下一次连接尝试使用的新凭据
+func (c *Client) setPendingCredential(cred *Credential) error {
+	cert, err := cred.tlsCertificate()
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pending = cred
+	c.pendingTLS = nil
+	c.pendingFailures = 0
+	if cert != nil && c.tlsConfig != nil {
+		c.pendingTLS = c.tlsConfig.Clone()
+		c.pendingTLS.Certificates = []tls.Certificate{*cert}
+	}
+	return nil
+}
+
+// tlsConfigLocked 返回本次连接使用的 TLS 配置，轮换中的新证书优先，调用方需持有 mutex
+func (c *Client) tlsConfigLocked() *tls.Config {
+	if c.pendingTLS != nil {
+		return c.pendingTLS
+	}
+	return c.tlsConfig
+}
+
+// rotationPending 判断下一次连接是否以轮换中的新凭据尝试
+func (c *Client) rotationPending() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pending != nil
+}
+
+// rotationSucceeded 在新凭据通过认证后以其替换现有凭据
+func (c *Client) rotationSucceeded() {
+	if err := c.credentials.PromotePending(); err != nil {
+		// 新凭据仍留在原处，下次启动时会再次尝试
+		logger.Error("替换凭据文件失败:", err)
+	}
+
+	c.mutex.Lock()
+	c.credential = c.pending
+	if c.pendingTLS != nil {
+		c.tlsConfig = c.pendingTLS
+	}
+	c.pending = nil
+	c.pendingTLS = nil
+	c.pendingFailures = 0
+	c.mutex.Unlock()
+	logger.Info("凭据轮换完成")
+}
+
+// maxPendingAuthFailures 是以新凭据认证失败的上限。
+// Hub 不认识新凭据时以原凭据派生的密钥为 AUTH_FAIL 签名，Agent 以新凭据派生的密钥校验不通过，
+// 只会看到未经校验的拒绝或认证超时、连接断开，因此认证失败累计达到上限后同样认定新凭据无效。
+const maxPendingAuthFailures = 3
+
+// credentialRejected 判断 err 是否为 Hub 对凭据本身的拒绝（经签名校验的 AUTH_FAIL）
+func credentialRejected(err error) bool {
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.Unverified {
+		return false
+	}
+	switch authErr.Reason {
+	case protocol.AuthFailBadKey, protocol.AuthFailRevoked:
+		return true
+	}
+	return false
+}
+
+// pendingAuthFailed 记录一次以新凭据认证失败，返回是否应放弃新凭据：
+// 经签名校验的拒绝立即放弃，其他失败累计 maxPendingAuthFailures 次后放弃
+func (c *Client) pendingAuthFailed(err error) bool {
+	if credentialRejected(err) {
+		return true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pendingFailures++
+	logger.Warn(fmt.Sprintf("以新凭据认证失败 %d/%d 次: %v", c.pendingFailures, maxPendingAuthFailures, err))
+	return c.pendingFailures >= maxPendingAuthFailures
+}
+
+// rotationFailed 丢弃未通过认证的新凭据，之后以原凭据重连。
+// 返回的错误总是可重试的，新凭据被拒绝不代表原凭据失效。
+func (c *Client) rotationFailed(err error) error {
+	c.mutex.Lock()
+	c.pending = nil
+	c.pendingTLS = nil
+	c.pendingFailures = 0
+	c.mutex.Unlock()
+
+	if discardErr := c.credentials.DiscardPending(); discardErr != nil {
+		logger.Error("删除新凭据失败:", discardErr)
+	}
+	logger.Warn("新凭据未能通过认证, 回退到原凭据:", err)
+	return fmt.Errorf("新凭据未能通过认证: %v", err)
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"agent/config"
+	"agent/protocol"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCredentialRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad key", &AuthError{Reason: protocol.AuthFailBadKey}, true},
+		{"revoked", fmt.Errorf("认证失败: %w", &AuthError{Reason: protocol.AuthFailRevoked}), true},
+		{"unverified bad key", &AuthError{Reason: protocol.AuthFailBadKey, Unverified: true}, false},
+		{"banned", &AuthError{Reason: protocol.AuthFailBanned}, false},
+		{"replay", &AuthError{Reason: protocol.AuthFailReplay}, false},
+		{"connection lost", ErrConnectionLost, false},
+		{"auth timeout", errAuthTimeout, false},
+		{"tls", &permanentError{errors.New("Hub 证书校验失败")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := credentialRejected(tt.err); got != tt.want {
+				t.Fatalf("credentialRejected(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingAuthFailed(t *testing.T) {
+	rejected := &AuthError{Reason: protocol.AuthFailBadKey}
+	unverified := &AuthError{Reason: protocol.AuthFailBadKey, Unverified: true}
+
+	tests := []struct {
+		name     string
+		failures []error
+		want     []bool
+	}{
+		{"verified rejection", []error{rejected}, []bool{true}},
+		{"unverified rejections", []error{unverified, unverified, unverified}, []bool{false, false, true}},
+		// 新凭据派生的密钥校验不了 Hub 签名的 AUTH_FAIL，该帧被丢弃后只看到认证超时或连接断开
+		{"dropped auth fail", []error{errAuthTimeout, ErrConnectionLost, errAuthTimeout}, []bool{false, false, true}},
+		{"rejection after failures", []error{errAuthTimeout, rejected}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(&config.Config{})
+			if err := c.setPendingCredential(&Credential{Secret: "next"}); err != nil {
+				t.Fatal(err)
+			}
+			for i, err := range tt.failures {
+				if got := c.pendingAuthFailed(err); got != tt.want[i] {
+					t.Fatalf("failure %d (%v): pendingAuthFailed = %v, want %v", i, err, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRotationFailed(t *testing.T) {
+	c := NewClient(&config.Config{})
+	c.credentials = newCredentialStore(t.TempDir())
+	next := &Credential{Secret: "next"}
+	if err := c.credentials.SavePending(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setPendingCredential(next); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxPendingAuthFailures-1; i++ {
+		c.pendingAuthFailed(errAuthTimeout)
+	}
+
+	// 新的轮换重新计数
+	if err := c.setPendingCredential(next); err != nil {
+		t.Fatal(err)
+	}
+	if c.pendingAuthFailed(errAuthTimeout) {
+		t.Fatal("重新下发的新凭据应重新计数")
+	}
+
+	err := c.rotationFailed(errAuthTimeout)
+	if _, ok := err.(*permanentError); ok || err == nil {
+		t.Fatalf("err = %v, 应为可重试的错误", err)
+	}
+	if c.rotationPending() || c.pendingFailures != 0 {
+		t.Fatal("rotationFailed 应丢弃新凭据")
+	}
+	if cred, err := c.credentials.LoadPending(); err != nil || cred != nil {
+		t.Fatalf("新凭据文件未删除: %v, %v", cred, err)
+	}
+}
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"agent/logger"
+	"agent/protocol"
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrNotConnected = errors.New("未连接到服务器")
+	ErrQueueFull    = errors.New("发送队列已满")
+)
+
+// Priority 决定消息在发送队列中的先后顺序
+type Priority int
+
+const (
+	PriorityHigh   Priority = iota // 认证、心跳等控制消息
+	PriorityNormal                 // 任务结果等业务消息
+	PriorityLow                    // 系统信息等批量数据
+	priorityLevels
+)
+
+const defaultSendQueueSize = 256
+
+// priorityOf 返回消息类型的默认发送优先级
+func priorityOf(t protocol.MessageType) Priority {
+	switch t {
+	case protocol.MessageTypeAuth, protocol.MessageTypeHeartbeat:
+		return PriorityHigh
+	case protocol.MessageTypeSystemInfo, protocol.MessageTypeStaticInfo:
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+// outboundFrame 是已编码、等待写入连接的消息
+type outboundFrame struct {
+	msgType  protocol.MessageType
+	priority Priority
+	data     []byte
+	written  func() // 写入连接成功后回调，可为 nil
+	evicted  func() // 被挤出队列时回调，可为 nil
+	durable  bool   // 离线缓存记录，不会被挤出队列
+}
+
+// sendQueue 是每个连接独占的有界优先级队列，由唯一的写协程消费
+type sendQueue struct {
+	mutex    sync.Mutex
+	frames   [priorityLevels][]*outboundFrame
+	size     int
+	capacity int
+	ready    chan struct{} // 有新消息时通知写协程
+	space    chan struct{} // 有空位时通知等待中的发送方
+	done     chan struct{}
+	closed   bool
+}
+
+func newSendQueue(capacity int) *sendQueue {
+	if capacity <= 0 {
+		capacity = defaultSendQueueSize
+	}
+	return &sendQueue{
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// push 非阻塞入队；队列已满时高优先级消息会挤掉最旧的低优先级消息
+func (q *sendQueue) push(frame *outboundFrame) error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return ErrNotConnected
+	}
+	var evicted *outboundFrame
+	if q.size >= q.capacity {
+		if evicted = q.evictLocked(frame.priority); evicted == nil {
+			q.mutex.Unlock()
+			return ErrQueueFull
+		}
+	}
+
+	q.frames[frame.priority] = append(q.frames[frame.priority], frame)
+	q.size++
+	notify(q.ready)
+	q.mutex.Unlock()
+
+	// 回调可能重新入队，须在释放锁后调用
+	if evicted != nil && evicted.evicted != nil {
+		evicted.evicted()
+	}
+	return nil
+}
+
+// pushWait 阻塞入队，直到有空位、ctx 结束或队列关闭
+func (q *sendQueue) pushWait(ctx context.Context, frame *outboundFrame) error {
+	for {
+		err := q.push(frame)
+		if err != ErrQueueFull {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.done:
+			return ErrNotConnected
+		case <-q.space:
+		}
+	}
+}
+
+// evictLocked 丢弃一条比 p 优先级更低的最旧消息以腾出空位并返回该消息，没有可丢弃的消息时返回 nil。
+// 离线缓存记录不会被丢弃。
+func (q *sendQueue) evictLocked(p Priority) *outboundFrame {
+	for level := priorityLevels - 1; level > p; level-- {
+		for i, frame := range q.frames[level] {
+			if frame.durable {
+				continue
+			}
+			q.frames[level] = append(q.frames[level][:i], q.frames[level][i+1:]...)
+			q.size--
+			logger.Warn("发送队列已满, 丢弃消息:", frame.msgType)
+			return frame
+		}
+	}
+	return nil
+}
+
+// pop 按优先级取出下一条消息，队列关闭后返回 false
+func (q *sendQueue) pop() (*outboundFrame, bool) {
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return nil, false
+		}
+		for level := range q.frames {
+			if len(q.frames[level]) == 0 {
+				continue
+			}
+			frame := q.frames[level][0]
+			q.frames[level][0] = nil
+			q.frames[level] = q.frames[level][1:]
+			q.size--
+			q.mutex.Unlock()
+			notify(q.space)
+			return frame, true
+		}
+		q.mutex.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-q.done:
+		}
+	}
+}
+
+// close 关闭队列并丢弃未发送的消息
+func (q *sendQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for level := range q.frames {
+		q.frames[level] = nil
+	}
+	q.size = 0
+	close(q.done)
+}
+
+// notify 向容量为 1 的信号 channel 非阻塞地发送通知
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"agent/config"
+	"agent/protocol"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendQueuePriority(t *testing.T) {
+	q := newSendQueue(8)
+	for _, msgType := range []protocol.MessageType{
+		protocol.MessageTypeSystemInfo,
+		protocol.MessageTypeTaskResult,
+		protocol.MessageTypeStaticInfo,
+		protocol.MessageTypeHeartbeat,
+		protocol.MessageTypeTaskResult,
+		protocol.MessageTypeAuth,
+	} {
+		if err := q.push(&outboundFrame{msgType: msgType, priority: priorityOf(msgType), data: []byte(msgType)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 控制消息先于业务消息，批量数据最后，同一优先级内按入队顺序
+	want := []protocol.MessageType{
+		protocol.MessageTypeHeartbeat,
+		protocol.MessageTypeAuth,
+		protocol.MessageTypeTaskResult,
+		protocol.MessageTypeTaskResult,
+		protocol.MessageTypeSystemInfo,
+		protocol.MessageTypeStaticInfo,
+	}
+	for i, msgType := range want {
+		frame, ok := q.pop()
+		if !ok || frame.msgType != msgType {
+			t.Fatalf("pop %d = %v, want %s", i, frame, msgType)
+		}
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  []Priority
+		push    Priority
+		closed  bool
+		wantErr error
+	}{
+		{"space left", []Priority{PriorityNormal}, PriorityNormal, false, nil},
+		{"full of same priority", []Priority{PriorityNormal, PriorityNormal}, PriorityNormal, false, ErrQueueFull},
+		{"bulk cannot evict", []Priority{PriorityHigh, PriorityNormal}, PriorityLow, false, ErrQueueFull},
+		{"heartbeat evicts bulk", []Priority{PriorityNormal, PriorityLow}, PriorityHigh, false, nil},
+		{"closed", nil, PriorityHigh, true, ErrNotConnected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue(2)
+			for _, p := range tt.queued {
+				if err := q.push(&outboundFrame{priority: p}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.closed {
+				q.close()
+			}
+			if err := q.push(&outboundFrame{priority: tt.push}); err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !tt.closed && q.size > q.capacity {
+				t.Fatalf("size = %d exceeds capacity %d", q.size, q.capacity)
+			}
+		})
+	}
+}
+
+func TestSendQueueEviction(t *testing.T) {
+	tests := []struct {
+		name        string
+		queued      *outboundFrame
+		wantErr     error
+		wantEvicted bool
+	}{
+		{"notifies owner", &outboundFrame{priority: PriorityLow}, nil, true},
+		{"durable kept", &outboundFrame{priority: PriorityLow, durable: true}, ErrQueueFull, false},
+		{"same priority kept", &outboundFrame{priority: PriorityHigh}, ErrQueueFull, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue(1)
+			evicted := false
+			tt.queued.evicted = func() { evicted = true }
+			if err := q.push(tt.queued); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.push(&outboundFrame{priority: PriorityHigh}); err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if evicted != tt.wantEvicted {
+				t.Fatalf("evicted = %v, want %v", evicted, tt.wantEvicted)
+			}
+		})
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		release func(q *sendQueue, cancel context.CancelFunc)
+		wantErr error
+	}{
+		{"space freed", func(q *sendQueue, cancel context.CancelFunc) { q.pop() }, nil},
+		{"ctx cancelled", func(q *sendQueue, cancel context.CancelFunc) { cancel() }, context.Canceled},
+		{"queue closed", func(q *sendQueue, cancel context.CancelFunc) { q.close() }, ErrNotConnected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(&config.Config{})
+			c.state = StateReady
+			c.queue = newSendQueue(1)
+			if err := c.Send(protocol.NewMessage(protocol.MessageTypeTaskResult, "first")); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Send(protocol.NewMessage(protocol.MessageTypeTaskResult, "second")); err != ErrQueueFull {
+				t.Fatalf("Send on full queue = %v, want %v", err, ErrQueueFull)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- c.SendContext(ctx, protocol.NewMessage(protocol.MessageTypeTaskResult, "waiting"))
+			}()
+			select {
+			case err := <-done:
+				t.Fatalf("SendContext 在队列已满时返回: %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			tt.release(c.queue, cancel)
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("SendContext 未被唤醒")
+			}
+		})
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	full := newSendQueue(1)
+	if err := full.push(&outboundFrame{priority: PriorityNormal}); err != nil {
+		t.Fatal(err)
+	}
+	empty := newSendQueue(1)
+
+	pushed := make(chan error, 1)
+	go func() { pushed <- full.pushWait(context.Background(), &outboundFrame{priority: PriorityNormal}) }()
+	popped := make(chan bool, 1)
+	go func() {
+		_, ok := empty.pop()
+		popped <- ok
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// 关闭连接时阻塞中的发送方与写协程都应返回
+	full.close()
+	empty.close()
+	select {
+	case err := <-pushed:
+		if err != ErrNotConnected {
+			t.Fatalf("pushWait = %v, want %v", err, ErrNotConnected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("关闭队列未唤醒阻塞的发送方")
+	}
+	select {
+	case ok := <-popped:
+		if ok {
+			t.Fatal("pop 在队列关闭后应返回 false")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("关闭队列未唤醒写协程")
+	}
+}
+
+// TestSendQueueConcurrent 以多个阻塞的生产者和唯一的写协程检查队列，应配合 -race 运行
+func TestSendQueueConcurrent(t *testing.T) {
+	const producers, perProducer = 8, 100
+	q := newSendQueue(4)
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for {
+			if _, ok := q.pop(); !ok {
+				received <- n
+				return
+			}
+			n++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perProducer; j++ {
+				if err := q.pushWait(context.Background(), &outboundFrame{priority: PriorityNormal}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// close 会丢弃未发送的消息，等写协程取完再关闭
+	for {
+		q.mutex.Lock()
+		size := q.size
+		q.mutex.Unlock()
+		if size == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.close()
+	if n := <-received; n != producers*perProducer {
+		t.Fatalf("received %d frames, want %d", n, producers*perProducer)
+	}
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"agent/config"
+	"agent/protocol"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// 防重放窗口的默认及最大长度（帧）
+const (
+	defaultReplayWindow = 64
+	maxReplayWindow     = 64
+)
+
+var (
+	errFrameUnsigned     = errors.New("帧未签名")
+	errFrameBadSignature = errors.New("帧签名校验失败")
+	errFrameReplayed     = errors.New("签名序号重复或超出防重放窗口")
+	errFrameLateHello    = errors.New("握手阶段之外或重复的 HELLO")
+
+	// ErrSigningUnsupported 不是永久错误：签名启用前的 HELLO 未经校验，可能是中间人伪造的降级
+	ErrSigningUnsupported = errors.New("Hub 不支持帧签名, 而配置要求签名 (hub.signing.mode)")
+)
+
+// signingConfig 是解析后的 hub.signing 配置
+type signingConfig struct {
+	algorithm protocol.SignAlgorithm
+	publicKey ed25519.PublicKey // 仅 ed25519
+	window    uint64
+}
+
+// newSigningConfig 解析 hub.signing 配置，未要求签名时返回 nil。
+// hasKey 表示是否有可用于派生 HMAC 签名密钥的密钥（auth.key、专属凭据或注册令牌）。
+func newSigningConfig(cfg *config.Config, hasKey bool) (*signingConfig, error) {
+	sc := cfg.Hub.Signing
+	switch sc.Mode {
+	case "", "off":
+		return nil, nil
+	case "required":
+	default:
+		return nil, fmt.Errorf("未知的签名模式: %s", sc.Mode)
+	}
+
+	signing := &signingConfig{window: defaultReplayWindow}
+	if sc.Window > 0 {
+		signing.window = uint64(sc.Window)
+	}
+	if signing.window > maxReplayWindow {
+		signing.window = maxReplayWindow
+	}
+
+	switch sc.Algorithm {
+	case "", "hmac":
+		if !hasKey {
+			return nil, errors.New("hmac 帧签名需要配置 auth.key、注册令牌或已注册的专属凭据")
+		}
+		signing.algorithm = protocol.SignHMACSHA256
+	case "ed25519":
+		key, err := base64.StdEncoding.DecodeString(sc.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("无效的 Hub Ed25519 公钥 (hub.signing.publicKey)")
+		}
+		signing.algorithm = protocol.SignEd25519
+		signing.publicKey = key
+	default:
+		return nil, fmt.Errorf("未知的签名算法: %s", sc.Algorithm)
+	}
+	return signing, nil
+}
+
+// frameGuard 校验一个连接上 Hub 帧的签名和签名序号，只在该连接的 receiveLoop 中使用。
+// 握手回复中 Hub 同意签名后才开始校验，此前只放行握手阶段的第一个 HELLO 和 AUTH_FAIL；
+// 这些帧未经校验，据此得出的错误都不是永久错误，见 Client.unverified。
+type frameGuard struct {
+	signing     *signingConfig
+	authKey     string
+	verifier    protocol.FrameVerifier
+	window      replayWindow
+	helloSeen   bool
+	handshaking func() bool // 连接是否处于握手阶段
+}
+
+func (c *Client) newFrameGuard(conn net.Conn) *frameGuard {
+	if c.signing == nil {
+		return nil
+	}
+	return &frameGuard{
+		signing: c.signing,
+		authKey: c.signingKey(),
+		window:  replayWindow{size: c.signing.window},
+		handshaking: func() bool {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			return c.conn == conn && c.state == StateHandshaking
+		},
+	}
+}
+
+// check 校验 msg，返回非 nil 时调用方应丢弃该消息
+func (g *frameGuard) check(msg *protocol.Message) error {
+	if msg.Header.Type == protocol.MessageTypeHello {
+		// HELLO 决定签名密钥，注入的 HELLO 不能重新设定或撤销签名
+		if g.helloSeen || !g.handshaking() {
+			return errFrameLateHello
+		}
+		g.helloSeen = true
+		if hello, ok := msg.Payload.(*protocol.HelloPayload); ok {
+			g.arm(hello)
+		}
+		return nil
+	}
+	if g.verifier == nil {
+		if msg.Header.Type == protocol.MessageTypeAuthFail {
+			return nil
+		}
+		return errFrameUnsigned
+	}
+
+	sig := msg.Signature
+	if sig == nil {
+		return errFrameUnsigned
+	}
+	if sig.Algorithm != g.verifier.Algorithm() || !g.verifier.Verify(sig.Data, sig.Value) {
+		return errFrameBadSignature
+	}
+	if !g.window.accept(msg.Header.SignSeq) {
+		return errFrameReplayed
+	}
+	return nil
+}
+
+// arm 在 Hub 同意签名时以会话挑战创建校验器
+func (g *frameGuard) arm(hello *protocol.HelloPayload) {
+	if hello.Nonce == "" || !contains(hello.Features, protocol.FeatureSignedFrames) {
+		return
+	}
+	switch g.signing.algorithm {
+	case protocol.SignHMACSHA256:
+		g.verifier = protocol.NewHMACFrameSigner(protocol.SessionSigningKey(g.authKey, hello.Nonce))
+	case protocol.SignEd25519:
+		g.verifier = protocol.NewEd25519FrameVerifier(g.signing.publicKey, []byte(hello.Nonce))
+	}
+}
+
+// countReject 按原因累计被丢弃的帧
+func (m *clientMetrics) countReject(err error) {
+	switch err {
+	case errFrameUnsigned, errFrameLateHello:
+		m.rejectedUnsigned.Add(1)
+	case errFrameBadSignature:
+		m.rejectedSignature.Add(1)
+	case errFrameReplayed:
+		m.rejectedReplay.Add(1)
+	}
+}
+
+// replayWindow 是滑动窗口防重放：接受大于已见最大序号的帧，
+// 以及窗口内尚未出现过的序号；seen 的第 i 位表示序号 highest-i 已出现
+type replayWindow struct {
+	size    uint64
+	highest uint64
+	seen    uint64
+}
+
+func (w *replayWindow) accept(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > w.highest {
+		if shift := seq - w.highest; shift >= 64 {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.highest = seq
+		return true
+	}
+	offset := w.highest - seq
+	if offset >= w.size || w.seen&(1<<offset) != 0 {
+		return false
+	}
+	w.seen |= 1 << offset
+	return true
+}
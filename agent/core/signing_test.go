@@ -0,0 +1,145 @@
+package core
+
+import (
+	"agent/protocol"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		size uint64
+		seqs []uint64
+		want []bool
+	}{
+		{"in order", 64, []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"duplicate", 64, []uint64{1, 2, 2, 1}, []bool{true, true, false, false}},
+		{"zero", 64, []uint64{0, 1}, []bool{false, true}},
+		{"reordered within window", 64, []uint64{5, 3, 4, 1, 3}, []bool{true, true, true, true, false}},
+		{"too old", 4, []uint64{10, 7, 6}, []bool{true, true, false}},
+		{"large jump clears history", 64, []uint64{1, 200, 1, 137, 136}, []bool{true, true, false, true, false}},
+		{"full window", 64, []uint64{100, 37, 36}, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := replayWindow{size: tt.size}
+			for i, seq := range tt.seqs {
+				if got := w.accept(seq); got != tt.want[i] {
+					t.Fatalf("accept(%d) #%d = %v, want %v", seq, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFrameGuard(t *testing.T) {
+	const key, nonce = "secret", "n0nce"
+	signer := protocol.NewHMACFrameSigner(protocol.SessionSigningKey(key, nonce))
+	forged := protocol.NewHMACFrameSigner(protocol.SessionSigningKey("other", nonce))
+
+	hello := func(features ...string) *protocol.Message {
+		return protocol.NewMessage(protocol.MessageTypeHello, &protocol.HelloPayload{Nonce: nonce, Features: features})
+	}
+	signed := func(signer *protocol.HMACFrameSigner, seq uint64) *protocol.Message {
+		msg := protocol.NewMessage(protocol.MessageTypeConfig, nil)
+		msg.Header.SignSeq = seq
+		data := []byte(fmt.Sprintf("frame %d", seq))
+		msg.Signature = &protocol.FrameSignature{Algorithm: protocol.SignHMACSHA256, Data: data, Value: signer.Sign(data)}
+		return msg
+	}
+	authFail := protocol.NewMessage(protocol.MessageTypeAuthFail, &protocol.AuthResultPayload{Reason: protocol.AuthFailBanned})
+	unsigned := protocol.NewMessage(protocol.MessageTypeConfig, nil)
+
+	type step struct {
+		msg         *protocol.Message
+		handshaking bool
+		want        error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"signed session", []step{
+			{hello(protocol.FeatureSignedFrames), true, nil},
+			{signed(signer, 1), false, nil},
+			{signed(signer, 2), false, nil},
+		}},
+		{"unsigned before hello", []step{
+			{unsigned, true, errFrameUnsigned},
+			{authFail, true, nil},
+		}},
+		{"unsigned after hello", []step{
+			{hello(protocol.FeatureSignedFrames), true, nil},
+			{unsigned, false, errFrameUnsigned},
+		}},
+		{"forged signature", []step{
+			{hello(protocol.FeatureSignedFrames), true, nil},
+			{signed(forged, 1), false, errFrameBadSignature},
+		}},
+		{"replayed frame", []step{
+			{hello(protocol.FeatureSignedFrames), true, nil},
+			{signed(signer, 1), false, nil},
+			{signed(signer, 1), false, errFrameReplayed},
+		}},
+		{"second hello cannot disarm", []step{
+			{hello(protocol.FeatureSignedFrames), true, nil},
+			{hello(), true, errFrameLateHello},
+			{unsigned, false, errFrameUnsigned},
+		}},
+		{"second hello cannot arm", []step{
+			{hello(), true, nil},
+			{hello(protocol.FeatureSignedFrames), true, errFrameLateHello},
+		}},
+		{"hello outside handshake", []step{
+			{hello(protocol.FeatureSignedFrames), false, errFrameLateHello},
+			{hello(protocol.FeatureSignedFrames), true, nil},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handshaking := false
+			g := &frameGuard{
+				signing:     &signingConfig{algorithm: protocol.SignHMACSHA256, window: defaultReplayWindow},
+				authKey:     key,
+				window:      replayWindow{size: defaultReplayWindow},
+				handshaking: func() bool { return handshaking },
+			}
+			for i, s := range tt.steps {
+				handshaking = s.handshaking
+				if err := g.check(s.msg); err != s.want {
+					t.Fatalf("step %d (%s): err = %v, want %v", i, s.msg.Header.Type, err, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnverifiedAuthFail(t *testing.T) {
+	tests := []struct {
+		name          string
+		signing       bool
+		reason        protocol.AuthFailReason
+		wantPermanent bool
+	}{
+		{"banned without signing", false, protocol.AuthFailBanned, true},
+		{"banned before signing", true, protocol.AuthFailBanned, false},
+		{"revoked before signing", true, protocol.AuthFailRevoked, false},
+		{"replay", false, protocol.AuthFailReplay, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{}
+			if tt.signing {
+				c.signing = &signingConfig{}
+			}
+			msg := protocol.NewMessage(protocol.MessageTypeAuthFail, &protocol.AuthResultPayload{Reason: tt.reason})
+			err := c.unverified(authError(msg))
+			var permanent interface{ Permanent() bool }
+			if got := errors.As(err, &permanent) && permanent.Permanent(); got != tt.wantPermanent {
+				t.Fatalf("permanent = %v, want %v (%v)", got, tt.wantPermanent, err)
+			}
+		})
+	}
+}
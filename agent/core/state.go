@@ -0,0 +1,161 @@
+package core
+
+import (
+	"agent/logger"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// State 是客户端与 Hub 连接的状态
+type State int
+
+const (
+	StateDisconnected   State = iota // 未连接，等待重连
+	StateDialing                     // 正在建立连接（TCP、TLS 及 WebSocket 握手）
+	StateHandshaking                 // 已连接，正在交换 HELLO 协商能力
+	StateAuthenticating              // 正在注册或认证
+	StateReady                       // 认证通过，可以发送业务消息
+	StateDraining                    // 正在停止：关闭连接并等待后台协程退出
+	StateStopped                     // 已停止，不再变化
+)
+
+var stateNames = map[State]string{
+	StateDisconnected:   "disconnected",
+	StateDialing:        "dialing",
+	StateHandshaking:    "handshaking",
+	StateAuthenticating: "authenticating",
+	StateReady:          "ready",
+	StateDraining:       "draining",
+	StateStopped:        "stopped",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// ErrInvalidTransition 表示请求的状态转换不被允许
+var ErrInvalidTransition = errors.New("非法的状态转换")
+
+// transitions 列出每个状态允许转换到的状态。除 Stopped 外任何状态都可以进入 Draining；
+// 连接建立后的任一阶段失败都回到 Disconnected。
+var transitions = map[State][]State{
+	StateDisconnected:   {StateDialing, StateDraining},
+	StateDialing:        {StateHandshaking, StateDisconnected, StateDraining},
+	StateHandshaking:    {StateAuthenticating, StateDisconnected, StateDraining},
+	StateAuthenticating: {StateReady, StateDisconnected, StateDraining},
+	StateReady:          {StateDisconnected, StateDraining},
+	StateDraining:       {StateStopped},
+}
+
+func canTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// stateEvent 是一次状态转换，err 为导致转换的错误（如断线原因），可为 nil
+type stateEvent struct {
+	from, to State
+	err      error
+}
+
+// stateNotifier 按发生顺序将状态转换通知订阅者。状态在持有 Client.mutex 时转换，
+// 回调则在单独的协程中调用，订阅者可以在回调中访问 Client 而不会死锁。
+type stateNotifier struct {
+	mutex    sync.Mutex
+	handlers []func(from, to State, err error)
+	events   []stateEvent
+	running  bool
+	wg       sync.WaitGroup
+}
+
+func (n *stateNotifier) subscribe(fn func(from, to State, err error)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.handlers = append(n.handlers, fn)
+}
+
+// push 记录一次转换，没有正在投递的协程时启动一个
+func (n *stateNotifier) push(event stateEvent) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.events = append(n.events, event)
+	if !n.running {
+		n.running = true
+		n.wg.Add(1)
+		go n.run()
+	}
+}
+
+func (n *stateNotifier) run() {
+	defer n.wg.Done()
+	for {
+		n.mutex.Lock()
+		if len(n.events) == 0 {
+			n.running = false
+			n.mutex.Unlock()
+			return
+		}
+		event := n.events[0]
+		n.events = n.events[1:]
+		handlers := n.handlers
+		n.mutex.Unlock()
+
+		for _, fn := range handlers {
+			n.call(fn, event)
+		}
+	}
+}
+
+// call 调用一个订阅者，订阅者 panic 不影响其余订阅者及后续通知
+func (n *stateNotifier) call(fn func(from, to State, err error), event stateEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("状态订阅者发生panic:", r)
+		}
+	}()
+	fn(event.from, event.to, event.err)
+}
+
+// wait 等待已记录的转换全部投递完毕
+func (n *stateNotifier) wait() {
+	n.wg.Wait()
+}
+
+// transitionLocked 将连接状态转换为 to，err 为转换的原因。非法的转换被拒绝，状态保持不变。
+// 调用方需持有 mutex。
+func (c *Client) transitionLocked(to State, err error) error {
+	from := c.state
+	if !canTransition(from, to) {
+		logger.Warn(fmt.Sprintf("拒绝非法的状态转换: %s -> %s", from, to))
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	c.state = to
+	if err != nil {
+		logger.Info(fmt.Sprintf("连接状态: %s -> %s (%v)", from, to, err))
+	} else {
+		logger.Info(fmt.Sprintf("连接状态: %s -> %s", from, to))
+	}
+	c.notifier.push(stateEvent{from: from, to: to, err: err})
+	return nil
+}
+
+// State 返回当前的连接状态
+func (c *Client) State() State {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.state
+}
+
+// OnStateChange 订阅连接状态的转换。fn 在单独的协程中按转换发生的顺序调用，err 为转换的原因
+// （如断线时的错误），可为 nil；fn 不应长时间阻塞，否则会推迟后续通知。Stop 返回前 Stopped 已通知完毕。
+func (c *Client) OnStateChange(fn func(old, new State, err error)) {
+	c.notifier.subscribe(fn)
+}
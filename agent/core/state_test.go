@@ -0,0 +1,264 @@
+package core
+
+import (
+	"agent/config"
+	"agent/protocol"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var allStates = []State{
+	StateDisconnected, StateDialing, StateHandshaking, StateAuthenticating,
+	StateReady, StateDraining, StateStopped,
+}
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]State]bool{
+		{StateDisconnected, StateDialing}:        true,
+		{StateDisconnected, StateDraining}:       true,
+		{StateDialing, StateHandshaking}:         true,
+		{StateDialing, StateDisconnected}:        true,
+		{StateDialing, StateDraining}:            true,
+		{StateHandshaking, StateAuthenticating}:  true,
+		{StateHandshaking, StateDisconnected}:    true,
+		{StateHandshaking, StateDraining}:        true,
+		{StateAuthenticating, StateReady}:        true,
+		{StateAuthenticating, StateDisconnected}: true,
+		{StateAuthenticating, StateDraining}:     true,
+		{StateReady, StateDisconnected}:          true,
+		{StateReady, StateDraining}:              true,
+		{StateDraining, StateStopped}:            true,
+	}
+	for _, from := range allStates {
+		for _, to := range allStates {
+			want := allowed[[2]State{from, to}]
+			t.Run(from.String()+"->"+to.String(), func(t *testing.T) {
+				if got := canTransition(from, to); got != want {
+					t.Fatalf("canTransition = %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestTransitionLocked(t *testing.T) {
+	cause := errors.New("connection reset")
+	tests := []struct {
+		name      string
+		from      State
+		to        State
+		err       error
+		wantState State
+		wantError bool
+	}{
+		{"dial", StateDisconnected, StateDialing, nil, StateDialing, false},
+		{"lost with cause", StateReady, StateDisconnected, cause, StateDisconnected, false},
+		{"skip handshake", StateDialing, StateReady, nil, StateDialing, true},
+		{"leave stopped", StateStopped, StateDisconnected, nil, StateStopped, true},
+		{"self", StateReady, StateReady, nil, StateReady, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{state: tt.from}
+			var events []stateEvent
+			c.OnStateChange(func(old, new State, err error) {
+				events = append(events, stateEvent{old, new, err})
+			})
+
+			err := c.transitionLocked(tt.to, tt.err)
+			if (err != nil) != tt.wantError || (err != nil && !errors.Is(err, ErrInvalidTransition)) {
+				t.Fatalf("err = %v, want error %v", err, tt.wantError)
+			}
+			if c.state != tt.wantState {
+				t.Fatalf("state = %v, want %v", c.state, tt.wantState)
+			}
+			c.notifier.wait()
+			var want []stateEvent
+			if !tt.wantError {
+				want = []stateEvent{{tt.from, tt.to, tt.err}}
+			}
+			if len(events) != len(want) || (len(want) > 0 && events[0] != want[0]) {
+				t.Fatalf("events = %v, want %v", events, want)
+			}
+		})
+	}
+}
+
+func TestStateNotifier(t *testing.T) {
+	var n stateNotifier
+	var got []State
+	n.subscribe(func(old, new State, err error) {
+		panic("subscriber bug")
+	})
+	n.subscribe(func(old, new State, err error) {
+		got = append(got, new)
+	})
+	for _, s := range allStates[1:] {
+		n.push(stateEvent{to: s})
+	}
+	n.wait()
+	if len(got) != len(allStates)-1 {
+		t.Fatalf("got %v", got)
+	}
+	for i, s := range got {
+		if s != allStates[i+1] {
+			t.Fatalf("订阅者应按发生顺序收到通知, got %v", got)
+		}
+	}
+}
+
+// fakeHub 按脚本应答 Agent：回复 HELLO，对 AUTH 回复 authReply，之后关闭连接
+type fakeHub struct {
+	ln        net.Listener
+	authReply *protocol.Message // 为 nil 时不回复 AUTH
+}
+
+func (h *fakeHub) serve() {
+	for {
+		conn, err := h.ln.Accept()
+		if err != nil {
+			return
+		}
+		go h.handle(conn)
+	}
+}
+
+func (h *fakeHub) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	parser := protocol.NewMessageParser()
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		parser.Append(buf[:n])
+		for parser.HasCompleteMessage() {
+			msg, err := parser.ParseMessage()
+			if err != nil || msg == nil {
+				return
+			}
+			var reply *protocol.Message
+			switch msg.Header.Type {
+			case protocol.MessageTypeHello:
+				reply = protocol.NewMessage(protocol.MessageTypeHello, &protocol.HelloPayload{
+					ProtocolVersion: 1,
+					Codecs:          []string{"json"},
+					Nonce:           "n0nce",
+				})
+			case protocol.MessageTypeAuth:
+				if h.authReply == nil {
+					return
+				}
+				reply = h.authReply
+			default:
+				continue
+			}
+			data, err := reply.Encode()
+			if err != nil {
+				return
+			}
+			conn.Write(data)
+			if reply == h.authReply {
+				// 让 Agent 处理完应答后再断开
+				time.Sleep(100 * time.Millisecond)
+				return
+			}
+		}
+	}
+}
+
+// TestClientStates 以脚本化的 Hub 驱动 Client，检查完整的状态转换序列
+func TestClientStates(t *testing.T) {
+	useTestAgentUUID()
+	authOK := protocol.NewMessage(protocol.MessageTypeAuthOK, &protocol.AuthResultPayload{})
+	authFail := protocol.NewMessage(protocol.MessageTypeAuthFail, &protocol.AuthResultPayload{Reason: protocol.AuthFailInternal})
+
+	tests := []struct {
+		name        string
+		unreachable bool
+		authReply   *protocol.Message
+		want        []State // Stop 之前的转换目标
+	}{
+		{"ready then hub closes", false, authOK, []State{StateDialing, StateHandshaking, StateAuthenticating, StateReady, StateDisconnected}},
+		{"auth rejected", false, authFail, []State{StateDialing, StateHandshaking, StateAuthenticating, StateDisconnected}},
+		{"hub unreachable", true, nil, []State{StateDialing, StateDisconnected}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hub := &fakeHub{ln: ln, authReply: tt.authReply}
+			go hub.serve()
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			if tt.unreachable {
+				ln.Close()
+			} else {
+				defer ln.Close()
+			}
+
+			cfg := &config.Config{}
+			cfg.Hub.Address = "127.0.0.1"
+			cfg.Hub.Port, _ = strconv.Atoi(port)
+			cfg.Auth.Key = "secret"
+			cfg.Auth.CredentialDir = t.TempDir()
+			cfg.Agent.HeartbeatInterval = 60
+			cfg.Agent.SystemInfoInterval = 60
+			// 断线后不在测试期间重连
+			cfg.Agent.ReconnectInterval = 60
+			c := NewClient(cfg)
+			c.SetCollector(NewCollector(cfg))
+
+			var mutex sync.Mutex
+			var events []stateEvent
+			changed := make(chan struct{}, 16)
+			c.OnStateChange(func(old, new State, err error) {
+				mutex.Lock()
+				events = append(events, stateEvent{old, new, err})
+				mutex.Unlock()
+				changed <- struct{}{}
+			})
+			if err := c.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.After(5 * time.Second)
+			for done := false; !done; {
+				select {
+				case <-changed:
+					mutex.Lock()
+					done = len(events) >= len(tt.want)
+					mutex.Unlock()
+				case <-deadline:
+					t.Fatalf("等待状态转换超时, events = %v", events)
+				}
+			}
+			c.Stop()
+
+			want := append(tt.want, StateDraining, StateStopped)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(events) != len(want) {
+				t.Fatalf("events = %v, want targets %v", events, want)
+			}
+			from := StateDisconnected
+			for i, event := range events {
+				if event.from != from || event.to != want[i] {
+					t.Fatalf("event %d = %s -> %s, want %s -> %s", i, event.from, event.to, from, want[i])
+				}
+				from = event.to
+			}
+			// 断线的转换带有原因
+			if last := events[len(tt.want)-1]; last.err == nil {
+				t.Fatalf("转换 %s -> %s 缺少原因", last.from, last.to)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"agent/protocol"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// 内置任务类型，与 Hub 端 TaskType 保持一致
+const (
+	TaskTypeSystemCheck     = "system_check"
+	TaskTypePerformanceTest = "performance_test"
+	TaskTypeNetworkTest     = "network_test"
+	TaskTypeCustom          = "custom"
+)
+
+// RegisterBuiltinTaskHandlers 注册内置任务处理器。custom 任务按配置中的 action 分发给
+// 插件通过 RegisterCustomAction 注册的处理器
+func RegisterBuiltinTaskHandlers(e *TaskExecutor, collector *Collector) {
+	e.RegisterHandler(TaskTypeSystemCheck, systemCheckHandler(collector))
+	e.RegisterHandler(TaskTypePerformanceTest, performanceTestHandler)
+	e.RegisterHandler(TaskTypeNetworkTest, networkTestHandler)
+	e.RegisterHandler(TaskTypeCustom, e.customHandler)
+}
+
+// customHandler 处理 custom 任务，配置为 {"action": "...", "params": {...}}，
+// params 作为任务配置交给 action 对应的处理器
+func (e *TaskExecutor) customHandler(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+	var config struct {
+		Action string          `json:"action"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := decodeTaskConfig(task.Config, &config); err != nil {
+		return nil, err
+	}
+	if config.Action == "" {
+		return nil, fmt.Errorf("自定义任务未指定 action")
+	}
+
+	e.mutex.RLock()
+	handler, exists := e.actions[config.Action]
+	e.mutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("未注册的自定义任务: %s", config.Action)
+	}
+	sub := *task
+	sub.Config = config.Params
+	return handler(ctx, &sub)
+}
+
+// decodeTaskConfig 解析任务配置，Hub 可能将配置序列化为字符串后再下发
+func decodeTaskConfig(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		raw = json.RawMessage(str)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("解析任务配置失败: %v", err)
+	}
+	return nil
+}
+
+// systemCheckHandler 采集一次完整的静态与动态系统信息
+func systemCheckHandler(collector *Collector) TaskHandler {
+	return func(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+		staticInfo, err := collector.collectStaticInfo()
+		if err != nil {
+			return nil, fmt.Errorf("采集静态系统信息失败: %v", err)
+		}
+		dynamicInfo, err := collector.collectDynamicInfo()
+		if err != nil {
+			return nil, fmt.Errorf("采集动态系统信息失败: %v", err)
+		}
+		return map[string]interface{}{
+			"static":  staticInfo,
+			"dynamic": dynamicInfo,
+		}, nil
+	}
+}
+
+// performanceTestHandler 在指定时长内执行哈希计算以评估 CPU 性能
+func performanceTestHandler(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+	config := struct {
+		Duration int `json:"duration"` // 测试时长（秒）
+	}{Duration: 5}
+	if err := decodeTaskConfig(task.Config, &config); err != nil {
+		return nil, err
+	}
+	if config.Duration <= 0 || config.Duration > 60 {
+		config.Duration = 5
+	}
+
+	deadline := time.Now().Add(time.Duration(config.Duration) * time.Second)
+	block := make([]byte, 4096)
+	var hashes uint64
+	start := time.Now()
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		for i := 0; i < 1000; i++ {
+			sum := sha256.Sum256(block)
+			copy(block, sum[:])
+			hashes++
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+
+	return map[string]interface{}{
+		"duration":        elapsed,
+		"hashes":          hashes,
+		"hashesPerSecond": float64(hashes) / elapsed,
+	}, nil
+}
+
+// networkTestHandler 对目标地址发起 TCP 连接并记录延迟
+func networkTestHandler(ctx context.Context, task *protocol.TaskRequestPayload) (interface{}, error) {
+	config := struct {
+		Targets []string `json:"targets"` // host:port 列表
+		Count   int      `json:"count"`   // 每个目标的探测次数
+		Timeout int      `json:"timeout"` // 单次探测超时（秒）
+	}{Count: 3, Timeout: 5}
+	if err := decodeTaskConfig(task.Config, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Targets) == 0 {
+		return nil, fmt.Errorf("未指定探测目标")
+	}
+	if config.Count <= 0 {
+		config.Count = 3
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5
+	}
+
+	type probeResult struct {
+		Target    string    `json:"target"`
+		Success   int       `json:"success"`
+		Failed    int       `json:"failed"`
+		LatencyMs []float64 `json:"latencyMs"`
+		Error     string    `json:"error,omitempty"`
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(config.Timeout) * time.Second}
+	results := make([]probeResult, 0, len(config.Targets))
+	for _, target := range config.Targets {
+		result := probeResult{Target: target}
+		for i := 0; i < config.Count; i++ {
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, "tcp", target)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				result.Failed++
+				result.Error = err.Error()
+				continue
+			}
+			conn.Close()
+			result.Success++
+			result.LatencyMs = append(result.LatencyMs, float64(time.Since(start).Microseconds())/1000)
+		}
+		results = append(results, result)
+	}
+
+	return map[string]interface{}{
+		"results": results,
+	}, nil
+}
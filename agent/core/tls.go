@@ -0,0 +1,125 @@
+package core
+
+import (
+	"agent/config"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+var errPinMismatch = errors.New("Hub 证书公钥与配置的 SPKI pin 不匹配")
+
+// newTLSConfig 根据 hub.tls 配置构造 TLS 客户端配置，未启用时返回 nil
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tc := cfg.Hub.TLS
+	if !tc.Enabled {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		ServerName: tc.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch tc.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		conf.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("不支持的 TLS 最低版本: %s", tc.MinVersion)
+	}
+
+	if tc.CA != "" {
+		pem, err := os.ReadFile(tc.CA)
+		if err != nil {
+			return nil, fmt.Errorf("读取 CA 证书失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA 证书 %s 中没有有效的 PEM 证书", tc.CA)
+		}
+		conf.RootCAs = pool
+	}
+
+	if tc.Cert != "" || tc.Key != "" {
+		cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端证书失败: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if tc.Pin != "" {
+		pin, err := parsePin(tc.Pin)
+		if err != nil {
+			return nil, err
+		}
+		// 证书链校验之后再比对叶子证书的公钥，pin 是额外的约束而不是替代
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errPinMismatch
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if sum != pin {
+				return errPinMismatch
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+// parsePin 解析 "sha256/<base64>" 或 "<base64>" 形式的 SPKI pin
+func parsePin(s string) ([sha256.Size]byte, error) {
+	var pin [sha256.Size]byte
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256/"))
+	if err != nil || len(raw) != sha256.Size {
+		return pin, fmt.Errorf("无效的 SPKI pin: %s", s)
+	}
+	copy(pin[:], raw)
+	return pin, nil
+}
+
+// handshakeTLS 在已建立的 TCP 连接上完成 TLS 握手，未配置服务器名称时使用 addr。
+// 证书校验失败时返回的错误不可重试。
+func handshakeTLS(conn net.Conn, conf *tls.Config, addr string) (net.Conn, error) {
+	conf = conf.Clone()
+	if conf.ServerName == "" {
+		conf.ServerName = addr
+	}
+
+	tlsConn := tls.Client(conn, conf)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		if isVerificationError(err) {
+			return nil, &permanentError{fmt.Errorf("Hub 证书校验失败: %w", err)}
+		}
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// isVerificationError 判断 TLS 握手错误是否源于证书校验，这类错误重连无法解决
+func isVerificationError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) ||
+		errors.Is(err, errPinMismatch)
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"agent/config"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI 是测试用的 CA 及其签发的证书
+type testPKI struct {
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPEM  []byte
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testPKI{caCert: cert, caKey: key, caPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue 签发证书，server 为 true 时签发 127.0.0.1 与 hub.test 的服务器证书，否则签发客户端证书
+func (p *testPKI) issue(t *testing.T, server bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.Subject.CommonName = "hub.test"
+		tmpl.DNSNames = []string{"hub.test"}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writePEM 将证书及私钥写入临时目录，返回证书与私钥的路径
+func writePEM(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certPath, keyPath
+}
+
+func spkiPin(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// serveTLS 在本地端口接受一个 TLS 连接并完成握手，返回监听地址
+func serveTLS(t *testing.T, conf *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHandshakeTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	serverCert := pki.issue(t, true)
+	clientCert := pki.issue(t, false)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caPath, pki.caPEM, 0600)
+	otherCA := filepath.Join(t.TempDir(), "other.pem")
+	os.WriteFile(otherCA, other.caPEM, 0600)
+	certPath, keyPath := writePEM(t, clientCert)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(pki.caCert)
+	plain := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	mutual := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs})
+
+	tests := []struct {
+		name          string
+		addr          string
+		configure     func(tc *config.Config)
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{"trusted ca", plain, func(*config.Config) {}, false, false},
+		{"matching pin", plain, func(c *config.Config) { c.Hub.TLS.Pin = spkiPin(serverCert) }, false, false},
+		{"mismatched pin", plain, func(c *config.Config) { c.Hub.TLS.Pin = spkiPin(clientCert) }, true, true},
+		{"unknown ca", plain, func(c *config.Config) { c.Hub.TLS.CA = otherCA }, true, true},
+		{"server name", plain, func(c *config.Config) { c.Hub.TLS.ServerName = "hub.test" }, false, false},
+		{"wrong server name", plain, func(c *config.Config) { c.Hub.TLS.ServerName = "other.test" }, true, true},
+		{"client certificate", mutual, func(c *config.Config) { c.Hub.TLS.Cert, c.Hub.TLS.Key = certPath, keyPath }, false, false},
+		// 服务器拒绝握手不是证书校验错误，可以重试
+		{"missing client certificate", mutual, func(*config.Config) {}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Hub.TLS.Enabled = true
+			cfg.Hub.TLS.CA = caPath
+			tt.configure(cfg)
+			conf, err := newTLSConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := net.Dial("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host, _, _ := net.SplitHostPort(tt.addr)
+			conn, err := handshakeTLS(raw, conf, host)
+			if err == nil && tt.addr == mutual {
+				// TLS 1.3 的客户端在读取时才得知服务器拒绝了证书
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, err = conn.Read(make([]byte, 1))
+				if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
+					err = nil
+				}
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			var permanent *permanentError
+			if errors.As(err, &permanent) != tt.wantPermanent {
+				t.Fatalf("permanent = %v, want %v (%v)", !tt.wantPermanent, tt.wantPermanent, err)
+			}
+		})
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("spki"))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		pin     string
+		wantErr bool
+	}{
+		{"sha256/" + b64, false},
+		{b64, false},
+		{"sha256/" + base64.StdEncoding.EncodeToString(sum[:16]), true},
+		{"sha256/not base64!", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pin, func(t *testing.T) {
+			got, err := parsePin(tt.pin)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != sum {
+				t.Fatalf("pin = %x, want %x", got, sum)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"agent/config"
+	"agent/logger"
+	"agent/protocol"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	transportTCP       = "tcp"
+	transportWebSocket = "websocket"
+	// transportFallbackAttempts 是 auto 模式下切换传输方式前连续失败的连接次数
+	transportFallbackAttempts = 3
+	defaultWebSocketPath      = "/agent"
+	wsHandshakeTimeout        = 10 * time.Second
+)
+
+// transportSelector 决定下一次连接使用的传输方式。auto 时先使用 TCP，连续失败后改用 WebSocket，
+// 使用 WebSocket 同样连续失败后再切换回 TCP。只在连接管理协程中使用。
+type transportSelector struct {
+	auto     bool
+	current  string
+	failures int
+}
+
+func newTransportSelector(mode string) (*transportSelector, error) {
+	switch mode {
+	case "", transportTCP:
+		return &transportSelector{current: transportTCP}, nil
+	case transportWebSocket:
+		return &transportSelector{current: transportWebSocket}, nil
+	case "auto":
+		return &transportSelector{auto: true, current: transportTCP}, nil
+	}
+	return nil, fmt.Errorf("未知的传输方式: %s", mode)
+}
+
+// failed 记录一次失败的连接尝试
+func (t *transportSelector) failed() {
+	if !t.auto {
+		return
+	}
+	t.failures++
+	if t.failures < transportFallbackAttempts {
+		return
+	}
+	previous := t.current
+	if t.current == transportTCP {
+		t.current = transportWebSocket
+	} else {
+		t.current = transportTCP
+	}
+	t.failures = 0
+	logger.Warn(fmt.Sprintf("使用 %s 连续 %d 次连接失败, 改用 %s", previous, transportFallbackAttempts, t.current))
+}
+
+func (t *transportSelector) succeeded() {
+	t.failures = 0
+}
+
+// webSocketTargets 返回 WebSocket 连接使用的地址：配置了 hub.websocket.port 时替换端口
+func webSocketTargets(cfg *config.Config, group []hubTarget) []hubTarget {
+	if cfg.Hub.WebSocket.Port == 0 {
+		return group
+	}
+	port := strconv.Itoa(cfg.Hub.WebSocket.Port)
+	targets := make([]hubTarget, len(group))
+	for i, target := range group {
+		host, _, err := net.SplitHostPort(target.endpoint)
+		if err != nil {
+			host = target.endpoint
+		}
+		targets[i] = hubTarget{endpoint: net.JoinHostPort(host, port), serverName: target.serverName}
+	}
+	return targets
+}
+
+// upgradeWebSocket 在已建立的连接（可能经由代理并已完成 TLS 握手）上完成 WebSocket 握手
+func (c *Client) upgradeWebSocket(conn net.Conn, target hubTarget) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(target.endpoint)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	path := c.cfg.Hub.WebSocket.Path
+	if path == "" {
+		path = defaultWebSocketPath
+	}
+	// TLS 已在下层完成，这里只进行 HTTP 升级
+	u := url.URL{Scheme: "ws", Host: net.JoinHostPort(target.serverName, port), Path: path}
+
+	dialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		HandshakeTimeout: wsHandshakeTimeout,
+	}
+	ws, resp, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		conn.Close()
+		if resp != nil {
+			return nil, fmt.Errorf("%v (HTTP %s)", err, resp.Status)
+		}
+		return nil, err
+	}
+	return newWSConn(ws, c), nil
+}
+
+// wsConn 将 WebSocket 连接适配为 net.Conn：每次 Write 作为一条二进制消息发送，即一个完整的帧；
+// Read 跨消息边界连续读取，交给帧解析器重新组装。
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+}
+
+// newWSConn 创建适配后的连接。控制帧在读取数据时处理，Hub 的 ping 与对心跳 ping 的 pong
+// 都说明连接仍然存活，按接收循环的读取超时延长；pong 同时作为心跳回显交给 client。
+func newWSConn(ws *websocket.Conn, client *Client) *wsConn {
+	c := &wsConn{ws: ws}
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(client.readTimeout(c)))
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	ws.SetPongHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(client.readTimeout(c)))
+		var heartbeat protocol.HeartbeatPayload
+		if err := json.Unmarshal([]byte(data), &heartbeat); err == nil {
+			client.heartbeatEchoed(&heartbeat)
+		}
+		return nil
+	})
+	return c
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, fmt.Errorf("收到非二进制的 WebSocket 消息 (类型 %d)", messageType)
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ping 发送带有 payload 的 ping，Hub 回复的 pong 原样带回 payload
+func (c *wsConn) ping(payload []byte) error {
+	return c.ws.WriteControl(websocket.PingMessage, payload, time.Now().Add(writeTimeout))
+}
+
+// Close 尽量通知 Hub 正常关闭后断开连接
+func (c *wsConn) Close() error {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
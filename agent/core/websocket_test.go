@@ -0,0 +1,288 @@
+package core
+
+import (
+	"agent/config"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTransportSelector(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		events string // f 为一次失败，s 为一次成功
+		want   string
+	}{
+		{"tcp never switches", "tcp", "ffffff", transportTCP},
+		{"websocket never switches", "websocket", "ffffff", transportWebSocket},
+		{"auto starts with tcp", "auto", "", transportTCP},
+		{"auto below threshold", "auto", "ff", transportTCP},
+		{"auto falls back", "auto", "fff", transportWebSocket},
+		{"success resets count", "auto", "ffsff", transportTCP},
+		{"websocket failures switch back", "auto", "ffffff", transportTCP},
+		{"websocket failures after success switch back", "auto", "fffsfff", transportTCP},
+		{"websocket success", "auto", "fffsff", transportWebSocket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newTransportSelector(tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range tt.events {
+				if event == 'f' {
+					s.failed()
+				} else {
+					s.succeeded()
+				}
+			}
+			if s.current != tt.want {
+				t.Fatalf("current = %s, want %s", s.current, tt.want)
+			}
+		})
+	}
+
+	if _, err := newTransportSelector("quic"); err == nil {
+		t.Fatal("未知的传输方式应返回错误")
+	}
+}
+
+func TestWebSocketTargets(t *testing.T) {
+	group := []hubTarget{{"192.0.2.1:9527", "hub.example.test"}, {"[2001:db8::1]:9527", "hub.example.test"}}
+
+	cfg := &config.Config{}
+	if got := webSocketTargets(cfg, group); got[0] != group[0] || got[1] != group[1] {
+		t.Fatalf("未配置端口时不应改变地址: %v", got)
+	}
+	cfg.Hub.WebSocket.Port = 443
+	want := []hubTarget{{"192.0.2.1:443", "hub.example.test"}, {"[2001:db8::1]:443", "hub.example.test"}}
+	if got := webSocketTargets(cfg, group); got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("targets = %v, want %v", got, want)
+	}
+}
+
+// wsHub 是本地的 WebSocket 测试服务器，handle 在升级成功后处理连接
+type wsHub struct {
+	*httptest.Server
+	paths chan string
+}
+
+func newWSHub(t *testing.T, path string, handle func(ws *websocket.Conn)) *wsHub {
+	t.Helper()
+	h := &wsHub{paths: make(chan string, 4)}
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		h.paths <- r.URL.Path
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		handle(ws)
+	})
+	h.Server = httptest.NewServer(mux)
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *wsHub) port(t *testing.T) int {
+	_, port, _ := net.SplitHostPort(h.Listener.Addr().String())
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// upgrade 连接 h 并在其上完成 WebSocket 握手
+func (h *wsHub) upgrade(t *testing.T, c *Client) (net.Conn, error) {
+	t.Helper()
+	addr := h.Listener.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.upgradeWebSocket(conn, hubTarget{endpoint: addr, serverName: "127.0.0.1"})
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	tests := []struct {
+		name       string
+		configPath string
+		serverPath string
+		wantErr    string
+	}{
+		{"default path", "", "/agent", ""},
+		{"custom path", "/pbm/ws", "/pbm/ws", ""},
+		{"wrong path", "/other", "/agent", "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newWSHub(t, tt.serverPath, func(ws *websocket.Conn) {
+				ws.WriteMessage(websocket.BinaryMessage, []byte("ok"))
+			})
+			cfg := &config.Config{}
+			cfg.Hub.WebSocket.Path = tt.configPath
+			conn, err := hub.upgrade(t, NewClient(cfg))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if path := <-hub.paths; path != tt.serverPath {
+				t.Fatalf("path = %s, want %s", path, tt.serverPath)
+			}
+			got := make([]byte, 2)
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ok" {
+				t.Fatalf("read %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestWSConn(t *testing.T) {
+	t.Run("frames span messages", func(t *testing.T) {
+		received := make(chan []byte, 2)
+		hub := newWSHub(t, "/agent", func(ws *websocket.Conn) {
+			// 一个帧拆成两条消息，另有一条空消息
+			ws.WriteMessage(websocket.BinaryMessage, []byte("hel"))
+			ws.WriteMessage(websocket.BinaryMessage, nil)
+			ws.WriteMessage(websocket.BinaryMessage, []byte("lo"))
+			for i := 0; i < 2; i++ {
+				messageType, data, err := ws.ReadMessage()
+				if err != nil || messageType != websocket.BinaryMessage {
+					return
+				}
+				received <- data
+			}
+		})
+		conn, err := hub.upgrade(t, NewClient(&config.Config{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+		// 每次 Write 作为一条消息发送
+		for _, frame := range []string{"frame1", "frame2"} {
+			if _, err := conn.Write([]byte(frame)); err != nil {
+				t.Fatal(err)
+			}
+			if data := <-received; string(data) != frame {
+				t.Fatalf("hub received %q, want %q", data, frame)
+			}
+		}
+	})
+
+	t.Run("text message rejected", func(t *testing.T) {
+		hub := newWSHub(t, "/agent", func(ws *websocket.Conn) {
+			ws.WriteMessage(websocket.TextMessage, []byte("{}"))
+			ws.ReadMessage()
+		})
+		conn, err := hub.upgrade(t, NewClient(&config.Config{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Read(make([]byte, 8)); err == nil || !strings.Contains(err.Error(), "非二进制") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("hub ping answered", func(t *testing.T) {
+		pong := make(chan string, 1)
+		hub := newWSHub(t, "/agent", func(ws *websocket.Conn) {
+			ws.SetPongHandler(func(data string) error {
+				pong <- data
+				return nil
+			})
+			ws.WriteControl(websocket.PingMessage, []byte("probe"), time.Now().Add(time.Second))
+			// 读取以处理 pong
+			ws.ReadMessage()
+		})
+		conn, err := hub.upgrade(t, NewClient(&config.Config{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go conn.Read(make([]byte, 8))
+		select {
+		case data := <-pong:
+			if data != "probe" {
+				t.Fatalf("pong = %q", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("未回复 Hub 的 ping")
+		}
+	})
+}
+
+// TestWebSocketFallback 确认 auto 模式在 TCP 连续失败后经由 hub.websocket 的端口和路径连接 Hub
+func TestWebSocketFallback(t *testing.T) {
+	hub := newWSHub(t, "/pbm", func(ws *websocket.Conn) {
+		ws.ReadMessage()
+	})
+
+	cfg := &config.Config{}
+	cfg.Hub.Address = "127.0.0.1"
+	cfg.Hub.Port = 1
+	cfg.Hub.Protocol = "ipv4"
+	cfg.Hub.Transport = "auto"
+	cfg.Hub.WebSocket.Path = "/pbm"
+	cfg.Hub.WebSocket.Port = hub.port(t)
+	c := NewClient(cfg)
+	c.dialer = &net.Dialer{}
+	c.failover = priorityStrategy{}
+	var err error
+	if c.discovery, err = newDiscovery(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.transport, err = newTransportSelector(cfg.Hub.Transport); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	// TCP 连接 hub.port 失败
+	for i := 0; i < transportFallbackAttempts; i++ {
+		conn, _, _, err := c.dial()
+		if conn != nil || err != nil {
+			t.Fatalf("TCP 连接应失败: %v, %v", conn, err)
+		}
+		c.transport.failed()
+	}
+	if c.transport.current != transportWebSocket {
+		t.Fatalf("transport = %s, want %s", c.transport.current, transportWebSocket)
+	}
+
+	conn, _, _, err := c.dial()
+	if err != nil || conn == nil {
+		t.Fatalf("WebSocket 连接失败: %v", err)
+	}
+	if _, ok := conn.(*wsConn); !ok {
+		t.Fatalf("conn = %T, want *wsConn", conn)
+	}
+	if path := <-hub.paths; path != "/pbm" {
+		t.Fatalf("path = %s, want /pbm", path)
+	}
+	if state := c.State(); state != StateHandshaking {
+		t.Fatalf("state = %v, want %v", state, StateHandshaking)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"agent/config"
+	"agent/core"
+	"agent/logger"
+	"flag"
+	"time"
+)
+
+// runEnroll 实现 enroll 子命令：以一次性注册令牌向 Hub 重新注册，
+// 成功后替换数据目录中的专属凭据，用于凭据被吊销或迁移机器后
+func runEnroll(args []string) int {
+	flags := flag.NewFlagSet("enroll", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "配置文件路径")
+	token := flags.String("token", "", "一次性注册令牌, 为空时使用配置中的 auth.enrollToken")
+	timeout := flags.Duration("timeout", 30*time.Second, "等待注册完成的时间")
+	flags.Parse(args)
+
+	if err := logger.Init(); err != nil {
+		panic("初始化日志失败: " + err.Error())
+	}
+	defer logger.Close()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.Error("加载配置失败: ", err)
+		return 1
+	}
+	if *token == "" {
+		*token = cfg.Auth.EnrollToken
+	}
+	if *token == "" {
+		logger.Error("未指定注册令牌, 请使用 -token 参数")
+		return 1
+	}
+
+	if err := core.Enroll(cfg, *token, *timeout); err != nil {
+		logger.Error("注册失败: ", err)
+		return 1
+	}
+	logger.Info("注册完成")
+	return 0
+}
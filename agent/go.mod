@@ -4,8 +4,14 @@ go 1.21
 
 require (
 	github.com/google/uuid v1.5.0
+	github.com/gorilla/websocket v1.5.1
+	github.com/klauspost/compress v1.17.4
 	github.com/mackerelio/go-osstat v0.2.4
 	github.com/shirou/gopsutil/v3 v3.23.11
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.19.0
+	google.golang.org/protobuf v1.31.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -16,6 +22,7 @@ require (
 	github.com/shoenig/go-m1cpu v0.1.6 // indirect
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.3 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
@@ -0,0 +1,119 @@
+// Package hubauth 是 Hub 端挑战-应答认证的 Go 参考实现，供测试及其他语言的 Hub 对照。
+//
+// 认证流程:
+//  1. Agent 发送 HELLO，Hub 调用 Challenge 生成一次性 nonce 并随 HELLO 回复下发；
+//  2. Agent 以 protocol.AuthMAC(key, nonce, uuid, timestamp) 应答，不发送密钥；
+//  3. Hub 调用 Verify 校验 nonce 确为本端签发且未被使用、时间戳在允许范围内、MAC 正确。
+package hubauth
+
+import (
+	"agent/protocol"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultWindow 是默认允许的时间戳偏差，同时也是 nonce 的有效期
+const DefaultWindow = 60 * time.Second
+
+var (
+	ErrUnknownAgent   = errors.New("未知的 Agent")
+	ErrNonceUnknown   = errors.New("挑战不存在、已过期或已被使用")
+	ErrStaleTimestamp = errors.New("时间戳超出允许范围")
+	ErrBadMAC         = errors.New("认证 MAC 不匹配")
+)
+
+// KeyFunc 返回 Agent 的认证密钥，Agent 未登记时 ok 为 false
+type KeyFunc func(uuid string) (key string, ok bool)
+
+// StaticKey 返回所有 Agent 共用同一密钥的 KeyFunc
+func StaticKey(key string) KeyFunc {
+	return func(string) (string, bool) {
+		return key, true
+	}
+}
+
+// Verifier 签发挑战并校验 Agent 的应答，可被多个连接并发使用
+type Verifier struct {
+	keys   KeyFunc
+	window time.Duration
+	now    func() time.Time
+
+	mutex  sync.Mutex
+	issued map[string]time.Time // 尚未使用的 nonce 及其签发时间
+}
+
+// NewVerifier 创建校验器，window 为 0 时使用 DefaultWindow
+func NewVerifier(keys KeyFunc, window time.Duration) *Verifier {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Verifier{
+		keys:   keys,
+		window: window,
+		now:    time.Now,
+		issued: make(map[string]time.Time),
+	}
+}
+
+// Challenge 签发一个一次性 nonce
+func (v *Verifier) Challenge() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(buf)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.pruneLocked()
+	v.issued[nonce] = v.now()
+	return nonce, nil
+}
+
+// Verify 校验认证消息，通过时返回 nil。无论成功与否 nonce 都会被作废，不能重放。
+func (v *Verifier) Verify(p *protocol.AuthPayload) error {
+	v.mutex.Lock()
+	issuedAt, ok := v.issued[p.Nonce]
+	delete(v.issued, p.Nonce)
+	now := v.now()
+	v.mutex.Unlock()
+
+	if !ok || now.Sub(issuedAt) > v.window {
+		return ErrNonceUnknown
+	}
+	if skew := now.Sub(time.Unix(p.Timestamp, 0)); skew > v.window || skew < -v.window {
+		return ErrStaleTimestamp
+	}
+	key, ok := v.keys(p.UUID)
+	if !ok {
+		return ErrUnknownAgent
+	}
+	if !protocol.VerifyAuthMAC(key, p) {
+		return ErrBadMAC
+	}
+	return nil
+}
+
+// FailReason 返回 Verify 错误对应的 AUTH_FAIL 原因代码
+func FailReason(err error) protocol.AuthFailReason {
+	switch err {
+	case ErrNonceUnknown, ErrStaleTimestamp:
+		return protocol.AuthFailReplay
+	case ErrUnknownAgent, ErrBadMAC:
+		return protocol.AuthFailBadKey
+	}
+	return protocol.AuthFailInternal
+}
+
+// pruneLocked 清理过期未用的 nonce
+func (v *Verifier) pruneLocked() {
+	now := v.now()
+	for nonce, issuedAt := range v.issued {
+		if now.Sub(issuedAt) > v.window {
+			delete(v.issued, nonce)
+		}
+	}
+}
@@ -10,7 +10,21 @@ import (
 	"syscall"
 )
 
+// exitAuthRejected 是认证被 Hub 永久拒绝、Hub 证书校验失败或认证配置有误时的退出码（sysexits 中的 EX_CONFIG），
+// 进程管理器可据此停止自动重启，如 systemd 的 RestartPreventExitStatus
+const exitAuthRejected = 78
+
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "enroll":
+			os.Exit(runEnroll(os.Args[2:]))
+		case "audit":
+			os.Exit(runAudit(os.Args[2:]))
+		}
+	}
+
 	// 解析命令行参数
 	configPath := flag.String("config", "config.yaml", "配置文件路径")
 	flag.Parse()
@@ -21,7 +35,7 @@ func main() {
 	}
 	defer logger.Close()
 
-	logger.Info("Agent 正在启动...")
+	logger.Info("Agent 正在启动..., 版本:", core.Version)
 
 	// 加载配置
 	cfg, err := config.Load(*configPath)
@@ -37,10 +51,16 @@ func main() {
 		os.Exit(1)
 	}
 
-	// 等待中断信号
+	// 等待中断信号或不可重试的错误
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	exitCode := 0
+	select {
+	case <-sigChan:
+	case <-agent.Done():
+		logger.Error("Agent 无法继续运行: ", agent.Err())
+		exitCode = exitAuthRejected
+	}
 
 	// 优雅关闭
 	logger.Info("正在关闭 Agent...")
@@ -50,4 +70,8 @@ func main() {
 	}
 
 	logger.Info("Agent 已关闭")
+	if exitCode != 0 {
+		logger.Close()
+		os.Exit(exitCode)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// AuthMAC 计算挑战-应答认证的 MAC：HMAC-SHA256(key, nonce "\n" uuid "\n" timestamp)，
+// 以十六进制文本表示。timestamp 为 Agent 生成应答时的 Unix 秒。
+func AuthMAC(key, nonce, uuid string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(uuid))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAuthMAC 以常数时间比较 AuthPayload 中的 MAC
+func VerifyAuthMAC(key string, p *AuthPayload) bool {
+	expected := AuthMAC(key, p.Nonce, p.UUID, p.Timestamp)
+	return hmac.Equal([]byte(expected), []byte(p.MAC))
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import "testing"
+
+func TestAuthMAC(t *testing.T) {
+	// 与 Hub 端 computeAuthMac 的结果一致
+	const golden = "43b2873d74e877e3fb108574058bd7e83d09e60d59d65606df460ab0c3e5bda5"
+	if got := AuthMAC("secret", "n0nce", "agent-1", 1700000000); got != golden {
+		t.Fatalf("AuthMAC = %s, want %s", got, golden)
+	}
+
+	valid := AuthPayload{UUID: "agent-1", Nonce: "n0nce", Timestamp: 1700000000, MAC: golden}
+	tests := []struct {
+		name   string
+		key    string
+		mutate func(p *AuthPayload)
+		want   bool
+	}{
+		{"valid", "secret", func(*AuthPayload) {}, true},
+		{"wrong key", "secret2", func(*AuthPayload) {}, false},
+		{"other nonce", "secret", func(p *AuthPayload) { p.Nonce = "n0nce2" }, false},
+		{"other uuid", "secret", func(p *AuthPayload) { p.UUID = "agent-2" }, false},
+		{"other timestamp", "secret", func(p *AuthPayload) { p.Timestamp++ }, false},
+		// 分隔符防止字段边界移动后得到相同的 MAC
+		{"shifted fields", "secret", func(p *AuthPayload) { p.Nonce, p.UUID = "n0nce\nagent", "1" }, false},
+		{"truncated mac", "secret", func(p *AuthPayload) { p.MAC = p.MAC[:32] }, false},
+		{"empty mac", "secret", func(p *AuthPayload) { p.MAC = "" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.mutate(&p)
+			if got := VerifyAuthMAC(tt.key, &p); got != tt.want {
+				t.Fatalf("VerifyAuthMAC = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// CodecID 标识负载的编码格式，写在帧标志位的低两位
+type CodecID uint8
+
+const (
+	CodecJSON     CodecID = 0
+	CodecMsgPack  CodecID = 1
+	CodecProtobuf CodecID = 2
+)
+
+// ErrCodecUnsupported 表示编码格式不支持该负载类型，调用方可回退到 JSON
+var ErrCodecUnsupported = errors.New("编码格式不支持该负载类型")
+
+// Codec 负责负载的序列化与反序列化
+type Codec interface {
+	ID() CodecID
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	MsgPackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+
+	codecs = map[CodecID]Codec{
+		CodecJSON:     JSONCodec,
+		CodecMsgPack:  MsgPackCodec,
+		CodecProtobuf: ProtobufCodec,
+	}
+)
+
+// CodecByID 返回编号对应的编码格式
+func CodecByID(id CodecID) (Codec, bool) {
+	c, ok := codecs[id]
+	return c, ok
+}
+
+// CodecByName 按名称（json、msgpack、protobuf）查找编码格式
+func CodecByName(name string) (Codec, bool) {
+	for _, c := range codecs {
+		if c.Name() == strings.ToLower(strings.TrimSpace(name)) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() CodecID  { return CodecJSON }
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec 沿用 json 标签作为字段名，与 JSON 负载结构保持一致
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() CodecID  { return CodecMsgPack }
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// protoMessage 由具有 protobuf 模式（见 pbm.proto）的负载类型实现
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto(data []byte) error
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ID() CodecID  { return CodecProtobuf }
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return nil, ErrCodecUnsupported
+	}
+	return m.marshalProto(), nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return ErrCodecUnsupported
+	}
+	return m.unmarshalProto(data)
+}
@@ -0,0 +1,371 @@
+package protocol
+
+import (
+	"encoding/json"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 以下为 pbm.proto 中各消息的手写编解码，零值字段按 proto3 规则省略
+
+func (p *AuthPayload) marshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, p.Key)
+	b = appendProtoString(b, 2, p.UUID)
+	b = appendProtoString(b, 3, p.Alias)
+	b = appendProtoString(b, 4, p.Nonce)
+	b = appendProtoVarint(b, 5, uint64(p.Timestamp))
+	b = appendProtoString(b, 6, p.MAC)
+	return b
+}
+
+func (p *AuthPayload) unmarshalProto(data []byte) error {
+	return readProto(data, func(f *protoField) {
+		switch f.num {
+		case 1:
+			p.Key = string(f.bytes)
+		case 2:
+			p.UUID = string(f.bytes)
+		case 3:
+			p.Alias = string(f.bytes)
+		case 4:
+			p.Nonce = string(f.bytes)
+		case 5:
+			p.Timestamp = int64(f.varint)
+		case 6:
+			p.MAC = string(f.bytes)
+		}
+	})
+}
+
+func (p *HeartbeatPayload) marshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, p.UUID)
+	b = appendProtoVarint(b, 2, p.Seq)
+	b = appendProtoVarint(b, 3, uint64(p.SentAt))
+	return b
+}
+
+func (p *HeartbeatPayload) unmarshalProto(data []byte) error {
+	return readProto(data, func(f *protoField) {
+		switch f.num {
+		case 1:
+			p.UUID = string(f.bytes)
+		case 2:
+			p.Seq = f.varint
+		case 3:
+			p.SentAt = int64(f.varint)
+		}
+	})
+}
+
+func (p *AckPayload) marshalProto() []byte {
+	var b []byte
+	if len(p.IDs) > 0 {
+		var packed []byte
+		for _, id := range p.IDs {
+			packed = protowire.AppendVarint(packed, id)
+		}
+		b = appendProtoBytes(b, 1, packed)
+	}
+	b = appendProtoString(b, 2, p.Reason)
+	return b
+}
+
+func (p *AckPayload) unmarshalProto(data []byte) error {
+	var err error
+	readErr := readProto(data, func(f *protoField) {
+		switch f.num {
+		case 1:
+			if f.typ == protowire.VarintType {
+				p.IDs = append(p.IDs, f.varint)
+				return
+			}
+			packed := f.bytes
+			for len(packed) > 0 {
+				id, n := protowire.ConsumeVarint(packed)
+				if n < 0 {
+					err = protowire.ParseError(n)
+					return
+				}
+				p.IDs = append(p.IDs, id)
+				packed = packed[n:]
+			}
+		case 2:
+			p.Reason = string(f.bytes)
+		}
+	})
+	if readErr != nil {
+		return readErr
+	}
+	return err
+}
+
+func (p *StaticSystemInfo) marshalProto() []byte {
+	var cpu []byte
+	cpu = appendProtoString(cpu, 1, p.CPU.Model)
+	cpu = appendProtoVarint(cpu, 2, uint64(p.CPU.Cores))
+
+	var b []byte
+	b = appendProtoString(b, 1, p.UUID)
+	b = appendProtoString(b, 2, p.Alias)
+	b = appendProtoBytes(b, 3, cpu)
+	b = appendProtoVarint(b, 4, p.Memory.Total)
+	b = appendProtoVarint(b, 5, p.Disk.Total)
+	b = appendProtoVarint(b, 6, p.Swap.Total)
+	for _, ip := range p.IPv4 {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendString(b, ip)
+	}
+	for _, ip := range p.IPv6 {
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendString(b, ip)
+	}
+	b = appendProtoVarint(b, 9, uint64(p.UpdateAt))
+	return b
+}
+
+func (p *StaticSystemInfo) unmarshalProto(data []byte) error {
+	var cpuErr error
+	err := readProto(data, func(f *protoField) {
+		switch f.num {
+		case 1:
+			p.UUID = string(f.bytes)
+		case 2:
+			p.Alias = string(f.bytes)
+		case 3:
+			cpuErr = readProto(f.bytes, func(cf *protoField) {
+				switch cf.num {
+				case 1:
+					p.CPU.Model = string(cf.bytes)
+				case 2:
+					p.CPU.Cores = int(int64(cf.varint))
+				}
+			})
+		case 4:
+			p.Memory.Total = f.varint
+		case 5:
+			p.Disk.Total = f.varint
+		case 6:
+			p.Swap.Total = f.varint
+		case 7:
+			p.IPv4 = append(p.IPv4, string(f.bytes))
+		case 8:
+			p.IPv6 = append(p.IPv6, string(f.bytes))
+		case 9:
+			p.UpdateAt = int64(f.varint)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return cpuErr
+}
+
+func (p *SystemInfo) marshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, p.UUID)
+	b = appendProtoVarint(b, 2, p.NetworkTraffic.In)
+	b = appendProtoVarint(b, 3, p.NetworkTraffic.Out)
+	b = appendProtoDouble(b, 4, p.Uptime)
+	b = appendProtoDouble(b, 5, p.CPU.Usage)
+	b = appendProtoVarint(b, 6, p.Memory.Used)
+	b = appendProtoVarint(b, 7, p.Disk.Used)
+	b = appendProtoVarint(b, 8, p.Swap.Used)
+	b = appendProtoVarint(b, 9, uint64(p.Network.TCP))
+	b = appendProtoVarint(b, 10, uint64(p.Network.UDP))
+	if p.Link != nil {
+		var link []byte
+		link = appendProtoDouble(link, 1, p.Link.RTT)
+		link = appendProtoDouble(link, 2, p.Link.RTTAvg)
+		link = appendProtoDouble(link, 3, p.Link.RTTMin)
+		link = appendProtoDouble(link, 4, p.Link.RTTMax)
+		link = appendProtoDouble(link, 5, p.Link.Jitter)
+		link = appendProtoVarint(link, 6, p.Link.Samples)
+		link = appendProtoVarint(link, 7, p.Link.Lost)
+		if p.Link.Encrypted {
+			link = appendProtoVarint(link, 8, 1)
+		}
+		b = protowire.AppendTag(b, 11, protowire.BytesType)
+		b = protowire.AppendBytes(b, link)
+	}
+	return b
+}
+
+func (p *SystemInfo) unmarshalProto(data []byte) error {
+	var linkErr error
+	err := readProto(data, func(f *protoField) {
+		switch f.num {
+		case 1:
+			p.UUID = string(f.bytes)
+		case 2:
+			p.NetworkTraffic.In = f.varint
+		case 3:
+			p.NetworkTraffic.Out = f.varint
+		case 4:
+			p.Uptime = math.Float64frombits(f.fixed64)
+		case 5:
+			p.CPU.Usage = math.Float64frombits(f.fixed64)
+		case 6:
+			p.Memory.Used = f.varint
+		case 7:
+			p.Disk.Used = f.varint
+		case 8:
+			p.Swap.Used = f.varint
+		case 9:
+			p.Network.TCP = int(int64(f.varint))
+		case 10:
+			p.Network.UDP = int(int64(f.varint))
+		case 11:
+			p.Link = &LinkStats{}
+			linkErr = readProto(f.bytes, func(lf *protoField) {
+				switch lf.num {
+				case 1:
+					p.Link.RTT = math.Float64frombits(lf.fixed64)
+				case 2:
+					p.Link.RTTAvg = math.Float64frombits(lf.fixed64)
+				case 3:
+					p.Link.RTTMin = math.Float64frombits(lf.fixed64)
+				case 4:
+					p.Link.RTTMax = math.Float64frombits(lf.fixed64)
+				case 5:
+					p.Link.Jitter = math.Float64frombits(lf.fixed64)
+				case 6:
+					p.Link.Samples = lf.varint
+				case 7:
+					p.Link.Lost = lf.varint
+				case 8:
+					p.Link.Encrypted = lf.varint != 0
+				}
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return linkErr
+}
+
+func (p *TaskRequestPayload) marshalProto() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(p.TaskID))
+	b = appendProtoString(b, 2, p.Type)
+	b = appendProtoBytes(b, 3, p.Config)
+	return b
+}
+
+func (p *TaskRequestPayload) unmarshalProto(data []byte) error {
+	return readProto(data, func(f *protoField) {
+		switch f.num {
+		case 1:
+			p.TaskID = int64(f.varint)
+		case 2:
+			p.Type = string(f.bytes)
+		case 3:
+			p.Config = append(json.RawMessage(nil), f.bytes...)
+		}
+	})
+}
+
+func (p *TaskResultPayload) marshalProto() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(p.TaskID))
+	b = appendProtoString(b, 2, p.UUID)
+	b = appendProtoString(b, 3, string(p.Status))
+	if p.Result != nil {
+		// 结果结构由任务类型决定，以 JSON 文本承载
+		if result, err := json.Marshal(p.Result); err == nil {
+			b = appendProtoBytes(b, 4, result)
+		}
+	}
+	b = appendProtoString(b, 5, p.Error)
+	return b
+}
+
+func (p *TaskResultPayload) unmarshalProto(data []byte) error {
+	return readProto(data, func(f *protoField) {
+		switch f.num {
+		case 1:
+			p.TaskID = int64(f.varint)
+		case 2:
+			p.UUID = string(f.bytes)
+		case 3:
+			p.Status = TaskStatus(f.bytes)
+		case 4:
+			p.Result = append(json.RawMessage(nil), f.bytes...)
+		case 5:
+			p.Error = string(f.bytes)
+		}
+	})
+}
+
+// protoField 是解析出的一个字段，按线路类型填充对应的值
+type protoField struct {
+	num     protowire.Number
+	typ     protowire.Type
+	varint  uint64
+	fixed64 uint64
+	bytes   []byte
+}
+
+// readProto 依次解析 data 中的字段并回调 fn，不认识的线路类型被跳过
+func readProto(data []byte, fn func(f *protoField)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			f.fixed64, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		fn(&f)
+	}
+	return nil
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendProtoDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
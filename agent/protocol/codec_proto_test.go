@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var (
+	protoComment    = regexp.MustCompile(`//.*`)
+	protoMessageDef = regexp.MustCompile(`message\s+(\w+)\s*\{([^}]*)\}`)
+	protoFieldDef   = regexp.MustCompile(`(repeated\s+)?(\w+)\s+(\w+)\s*=\s*(\d+);`)
+)
+
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint64": descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+}
+
+// loadSchema 将 pbm.proto 转换为描述符。模式只使用标量、repeated 和不嵌套的消息字段，
+// 简单的文本解析即可覆盖，测试因此始终以 pbm.proto 为准。
+func loadSchema(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	src, err := os.ReadFile("pbm.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := protoComment.ReplaceAllString(string(src), "")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("pbm.proto"),
+		Package: proto.String("pbm"),
+		Syntax:  proto.String("proto3"),
+	}
+	for _, m := range protoMessageDef.FindAllStringSubmatch(text, -1) {
+		msg := &descriptorpb.DescriptorProto{Name: proto.String(m[1])}
+		for _, f := range protoFieldDef.FindAllStringSubmatch(m[2], -1) {
+			num, _ := strconv.Atoi(f[4])
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:   proto.String(f[3]),
+				Number: proto.Int32(int32(num)),
+				Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			if f[1] != "" {
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			}
+			if typ, ok := protoScalarTypes[f[2]]; ok {
+				field.Type = typ.Enum()
+			} else {
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String(".pbm." + f[2])
+			}
+			msg.Field = append(msg.Field, field)
+		}
+		file.MessageType = append(file.MessageType, msg)
+	}
+
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	schema := loadSchema(t)
+
+	system := &SystemInfo{UUID: "u1", Uptime: 12.5, Link: &LinkStats{RTT: 1.5, RTTAvg: 2, RTTMin: 1, RTTMax: 3, Jitter: 0.25, Samples: 4, Lost: 1, Encrypted: true}}
+	system.NetworkTraffic.In, system.NetworkTraffic.Out = 100, 200
+	system.CPU.Usage = 37.5
+	system.Memory.Used, system.Disk.Used, system.Swap.Used = 1, 2, 3
+	system.Network.TCP, system.Network.UDP = 10, -1
+
+	result := json.RawMessage(`{"ok":true}`)
+	config := json.RawMessage(`{"target":"1.1.1.1"}`)
+
+	tests := []struct {
+		message string
+		value   protoMessage
+		golden  string // 按 pbm.proto 字段名书写的 protojson
+	}{
+		{"AuthPayload", &AuthPayload{Key: "k", UUID: "u1", Alias: "a", Nonce: "n", Timestamp: 1700000000, MAC: "m"},
+			`{"key":"k","uuid":"u1","alias":"a","nonce":"n","timestamp":"1700000000","mac":"m"}`},
+		{"HeartbeatPayload", &HeartbeatPayload{UUID: "u1", Seq: 7, SentAt: 1700000000123},
+			`{"uuid":"u1","seq":"7","sent_at":"1700000000123"}`},
+		{"AckPayload", &AckPayload{IDs: []uint64{1, 300, 1 << 40}, Reason: "r"},
+			`{"ids":["1","300","1099511627776"],"reason":"r"}`},
+		{"StaticSystemInfo", &StaticSystemInfo{UUID: "u1", Alias: "a", CPU: CPUInfo{Model: "x86", Cores: 8},
+			Memory: MemInfo{Total: 1 << 33}, Disk: DiskInfo{Total: 1 << 40}, Swap: SwapInfo{Total: 5},
+			IPv4: []string{"10.0.0.1", "10.0.0.2"}, IPv6: []string{"::1"}, UpdateAt: 1700000000},
+			`{"uuid":"u1","alias":"a","cpu":{"model":"x86","cores":"8"},"memory_total":"8589934592","disk_total":"1099511627776",
+			"swap_total":"5","ipv4":["10.0.0.1","10.0.0.2"],"ipv6":["::1"],"update_at":"1700000000"}`},
+		{"SystemInfo", system,
+			`{"uuid":"u1","traffic_in":"100","traffic_out":"200","uptime":12.5,"cpu_usage":37.5,"memory_used":"1","disk_used":"2",
+			"swap_used":"3","tcp":"10","udp":"-1","link":{"rtt":1.5,"rtt_avg":2,"rtt_min":1,"rtt_max":3,"jitter":0.25,"samples":"4","lost":"1","encrypted":true}}`},
+		{"SystemInfo", &SystemInfo{UUID: "empty link"}, `{"uuid":"empty link"}`},
+		{"TaskRequest", &TaskRequestPayload{TaskID: 42, Type: "ping", Config: config},
+			`{"task_id":"42","type":"ping","config":"` + base64.StdEncoding.EncodeToString(config) + `"}`},
+		{"TaskResult", &TaskResultPayload{TaskID: 42, UUID: "u1", Status: "completed", Result: result, Error: "e"},
+			`{"task_id":"42","uuid":"u1","status":"completed","result":"` + base64.StdEncoding.EncodeToString(result) + `","error":"e"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			desc := schema.Messages().ByName(protoreflect.Name(tt.message))
+			if desc == nil {
+				t.Fatalf("pbm.proto 中没有 %s", tt.message)
+			}
+			golden := dynamicpb.NewMessage(desc)
+			if err := protojson.Unmarshal([]byte(tt.golden), golden); err != nil {
+				t.Fatal(err)
+			}
+
+			// 手写编码的结果按模式解码后应与 golden 一致
+			decoded := dynamicpb.NewMessage(desc)
+			if err := proto.Unmarshal(tt.value.marshalProto(), decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(decoded, golden) {
+				t.Fatalf("marshalProto:\n got %v\nwant %v", decoded, golden)
+			}
+
+			// 标准库编码的 golden 经手写解码后应还原原值
+			data, err := proto.Marshal(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := reflect.New(reflect.TypeOf(tt.value).Elem()).Interface().(protoMessage)
+			if err := got.unmarshalProto(data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.value) {
+				t.Fatalf("unmarshalProto:\n got %+v\nwant %+v", got, tt.value)
+			}
+		})
+	}
+}
+
+// TestProtoUnknownFields 确认较新的 Hub 增加的字段被跳过
+func TestProtoUnknownFields(t *testing.T) {
+	schema := loadSchema(t)
+	desc := schema.Messages().ByName("HeartbeatPayload")
+	msg := dynamicpb.NewMessage(desc)
+	if err := protojson.Unmarshal([]byte(`{"uuid":"u1","seq":"3"}`), msg); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := proto.Marshal(msg)
+	// 追加字段号 14 的 fixed32 与字段号 15 的 bytes 字段
+	data = append(data, 14<<3|5, 1, 2, 3, 4, 15<<3|2, 2, 'h', 'i')
+
+	var got HeartbeatPayload
+	if err := got.unmarshalProto(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.UUID != "u1" || got.Seq != 3 {
+		t.Fatalf("got %+v", got)
+	}
+	if err := got.unmarshalProto(data[:len(data)-1]); err == nil {
+		t.Fatal("截断的数据应返回错误")
+	}
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionID 标识负载的压缩算法，写在帧标志位的第 2、3 位
+type CompressionID uint8
+
+const (
+	CompressNone CompressionID = 0
+	CompressGzip CompressionID = 1
+	CompressZstd CompressionID = 2
+
+	compressShift = 2
+)
+
+// DefaultCompressThreshold 是默认的压缩阈值，更小的负载压缩收益有限
+const DefaultCompressThreshold = 512
+
+// errDecompressLimit 表示解压后的负载超出上限，通常意味着压缩炸弹
+var errDecompressLimit = errors.New("解压后的负载超出上限")
+
+// Compressor 负责负载的压缩与解压
+type Compressor interface {
+	ID() CompressionID
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress 解压 data，结果超过 limit 字节时返回错误
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+var (
+	GzipCompressor Compressor = gzipCompressor{}
+	ZstdCompressor Compressor = &zstdCompressor{}
+
+	compressors = map[CompressionID]Compressor{
+		CompressGzip: GzipCompressor,
+		CompressZstd: ZstdCompressor,
+	}
+)
+
+// CompressorByID 返回编号对应的压缩算法
+func CompressorByID(id CompressionID) (Compressor, bool) {
+	c, ok := compressors[id]
+	return c, ok
+}
+
+// CompressorByName 按名称（gzip、zstd）查找压缩算法
+func CompressorByName(name string) (Compressor, bool) {
+	for _, c := range compressors {
+		if c.Name() == strings.ToLower(strings.TrimSpace(name)) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// readLimited 读取 r 的全部内容，超过 limit 字节时返回 errDecompressLimit
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, errDecompressLimit
+	}
+	return data, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) ID() CompressionID { return CompressGzip }
+func (gzipCompressor) Name() string      { return "gzip" }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+// zstdCompressor 复用编码器和解码器，二者创建开销较大
+type zstdCompressor struct {
+	encoderOnce sync.Once
+	encoder     *zstd.Encoder
+	encoderErr  error
+	decoders    sync.Pool
+}
+
+func (*zstdCompressor) ID() CompressionID { return CompressZstd }
+func (*zstdCompressor) Name() string      { return "zstd" }
+
+func (z *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	z.encoderOnce.Do(func() {
+		z.encoder, z.encoderErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	if z.encoderErr != nil {
+		return nil, z.encoderErr
+	}
+	return z.encoder.EncodeAll(data, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	// 以流式方式解压并限制输出长度，避免按帧头声明的大小一次性分配内存
+	dec, _ := z.decoders.Get().(*zstd.Decoder)
+	if dec == nil {
+		var err error
+		dec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := dec.Reset(bytes.NewReader(data)); err != nil {
+		z.decoders.Put(dec)
+		return nil, err
+	}
+	out, err := readLimited(dec, limit)
+	z.decoders.Put(dec)
+	return out, err
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var compressorsUnderTest = []Compressor{GzipCompressor, ZstdCompressor}
+
+func TestCompressorLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("system info "), 1000)
+	for _, c := range compressorsUnderTest {
+		t.Run(c.Name(), func(t *testing.T) {
+			compressed, err := c.Compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(data) {
+				t.Fatalf("compressed %d bytes to %d", len(data), len(compressed))
+			}
+
+			tests := []struct {
+				name    string
+				limit   int
+				wantErr error
+			}{
+				{"above limit", len(data) + 1, nil},
+				{"exactly limit", len(data), nil},
+				{"one byte over", len(data) - 1, errDecompressLimit},
+				{"bomb", 64, errDecompressLimit},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					out, err := c.Decompress(compressed, tt.limit)
+					if err != tt.wantErr {
+						t.Fatalf("err = %v, want %v", err, tt.wantErr)
+					}
+					if err == nil && !bytes.Equal(out, data) {
+						t.Fatal("解压结果与原文不一致")
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestCompressedFrame(t *testing.T) {
+	payload := &HeartbeatPayload{UUID: strings.Repeat("a", 4096)}
+	for _, c := range compressorsUnderTest {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := NewMessage(MessageTypeHeartbeat, payload).EncodeWithOptions(EncodeOptions{Compressor: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressor, _ := readCompression(t, data); compressor != c {
+				t.Fatalf("帧未以 %s 压缩", c.Name())
+			}
+
+			p := NewMessageParser()
+			p.Append(data)
+			msg, err := p.ParseMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hb, ok := msg.Payload.(*HeartbeatPayload); !ok || hb.UUID != payload.UUID {
+				t.Fatalf("payload = %+v", msg.Payload)
+			}
+
+			// 压缩后的帧不超过上限，解压结果超出时按负载错误跳过
+			p = NewMessageParser()
+			p.SetMaxPayloadSize(uint32(len(data)))
+			p.Append(data)
+			_, err = p.ParseMessage()
+			wantFrameError(t, err, ErrBadPayload, true)
+			if !errors.Is(errors.Unwrap(err.(*FrameError).Cause), errDecompressLimit) {
+				t.Fatalf("cause = %v, want %v", err.(*FrameError).Cause, errDecompressLimit)
+			}
+		})
+	}
+}
+
+// readCompression 返回帧头部标志位中记录的压缩算法
+func readCompression(t *testing.T, data []byte) (Compressor, bool) {
+	t.Helper()
+	header, _, _, ok := readHeader(data)
+	if !ok {
+		t.Fatal("帧头不完整")
+	}
+	return header.Compression()
+}
+
+func TestUnknownCompression(t *testing.T) {
+	data := heartbeatFrame(t, "agent")
+	// 压缩位的取值 3 没有对应的算法
+	flags := binary.BigEndian.Uint16(data[4:6]) | FlagCompressMask
+	binary.BigEndian.PutUint16(data[4:6], flags)
+
+	p := NewMessageParser()
+	p.Append(append(data, heartbeatFrame(t, "next")...))
+	_, err := p.ParseMessage()
+	wantFrameError(t, err, ErrBadPayload, true)
+	if err.(*FrameError).Cause != errUnknownCompression {
+		t.Fatalf("cause = %v, want %v", err.(*FrameError).Cause, errUnknownCompression)
+	}
+	msg, err := p.ParseMessage()
+	if err != nil || msg.Payload.(*HeartbeatPayload).UUID != "next" {
+		t.Fatalf("msg = %v, err = %v", msg, err)
+	}
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 加密的帧置 FlagEncrypted，负载为 nonce(24) | XChaCha20-Poly1305 密文，
+// 头部 Length 为加密后的长度。附加数据为线路上的完整头部（含扩展字段），
+// 篡改类型、标志位或扩展字段都会使解密失败。负载先压缩后加密，签名覆盖密文。
+//
+// 会话密钥由 X25519 派生：Agent 每个连接生成临时密钥，Hub 在 HELLO 回复中给出
+// 自己的临时公钥；Agent 临时密钥分别与 Hub 临时密钥、Hub 长期密钥做 ECDH，
+// 只有持有 Hub 长期私钥的一方才能得到会话密钥。
+
+const payloadKeyInfo = "pbm payload encryption\n"
+
+// FrameCipher 以 XChaCha20-Poly1305 加密一个方向上的帧负载，每帧使用随机 nonce
+type FrameCipher struct {
+	aead cipher.AEAD
+}
+
+func NewFrameCipher(key []byte) (*FrameCipher, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameCipher{aead: aead}, nil
+}
+
+// Overhead 返回加密后负载增加的字节数
+func (c *FrameCipher) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// seal 将 plaintext 加密写入 dst，dst 长度须为 len(plaintext)+Overhead()
+func (c *FrameCipher) seal(dst, header, plaintext []byte) error {
+	nonce := dst[:c.aead.NonceSize()]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	c.aead.Seal(dst[len(nonce):len(nonce)], nonce, plaintext, header)
+	return nil
+}
+
+func (c *FrameCipher) open(header, payload []byte) ([]byte, error) {
+	if len(payload) < c.Overhead() {
+		return nil, errCiphertextShort
+	}
+	nonce, ciphertext := payload[:c.aead.NonceSize()], payload[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, ciphertext, header)
+}
+
+// PayloadKeys 由两次 X25519 的结果派生双向的负载加密密钥。
+// ephemeral 为双方临时密钥的 ECDH 结果，static 为 Agent 临时密钥与 Hub 长期密钥的 ECDH 结果，
+// agentKey、hubKey 为双方的临时公钥。
+func PayloadKeys(ephemeral, static, agentKey, hubKey []byte) (agentToHub, hubToAgent []byte, err error) {
+	secret := append(append([]byte(nil), ephemeral...), static...)
+	info := append(append([]byte(payloadKeyInfo), agentKey...), hubKey...)
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), keys); err != nil {
+		return nil, nil, err
+	}
+	return keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:], nil
+}
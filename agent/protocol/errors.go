@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrFrameTooLarge = errors.New("帧长度超出上限")
+	ErrUnknownType   = errors.New("未知的消息类型")
+	ErrBadPayload    = errors.New("消息负载解析失败")
+	ErrBadHeader     = errors.New("消息头非法")
+	ErrDecrypt       = errors.New("负载解密失败")
+	ErrUnencrypted   = errors.New("已协商负载加密, 但收到未加密的帧")
+)
+
+// FrameError 描述一个无法解析的帧，可用 errors.Is 判断具体原因
+type FrameError struct {
+	Err    error
+	Type   MessageType
+	Code   TypeCode
+	Length uint32
+	Cause  error
+}
+
+func (e *FrameError) Error() string {
+	msg := fmt.Sprintf("%v (类型: %s, 编码: 0x%04x, 长度: %d)", e.Err, e.Type, uint16(e.Code), e.Length)
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// Recoverable 判断出错后解析器能否从下一帧继续；不可恢复的错误意味着帧边界已不可信，
+// 或帧未通过加密认证（可能遭到篡改），连接不应继续使用
+func (e *FrameError) Recoverable() bool {
+	return e.Err == ErrUnknownType || e.Err == ErrBadPayload
+}
+
+var (
+	errInvalidJSON        = errors.New("负载不是合法的 JSON")
+	errUnknownCodec       = errors.New("未知的负载编码格式")
+	errUnknownCompression = errors.New("未知的负载压缩算法")
+	errCiphertextShort    = errors.New("密文长度不足")
+	errNoCipher           = errors.New("未协商负载加密")
+)
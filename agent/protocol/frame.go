@@ -0,0 +1,212 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// 帧格式 v1（大端序）:
+//
+//	magic(2) | version(1) | headerLen(1) | flags(2) | type(2) | length(4) | timestamp(4) | 扩展字段 | 负载
+//
+// headerLen 为包含扩展字段在内的完整头部长度，解析方据此跳过不认识的扩展字段。
+// 扩展字段按 tag(1) | len(1) | value 依次排列。
+// 旧版 12 字节头部 type(4) | length(4) | timestamp(4) 在过渡期内仍可被解析。
+const (
+	FrameMagic       uint16 = 0xB24D
+	ProtocolVersion  uint8  = 1
+	FrameHeaderSize         = 16
+	LegacyHeaderSize        = 12
+)
+
+// 头部标志位
+const (
+	FlagCodecMask    uint16 = 0x0003 // 低两位为负载编码格式，见 CodecID
+	FlagCompressMask uint16 = 0x000C // 第 2、3 位为负载压缩算法，见 CompressionID；Length 为压缩后的长度
+	FlagSigned       uint16 = 0x0010 // 负载之后附有签名尾部，见 sign.go
+	FlagEncrypted    uint16 = 0x0020 // 负载已加密，见 encrypt.go
+)
+
+// 扩展字段标签
+const (
+	extSequence  uint8 = 0x01 // uint64，离线缓存记录序号
+	extMessageID uint8 = 0x02 // uint64，需要确认的消息 ID
+	extCorrelate uint8 = 0x03 // uint64，请求/响应关联 ID
+	extSignSeq   uint8 = 0x04 // uint64，会话内的签名序号
+)
+
+// TypeCode 是消息类型在 v1 帧中的数字编码
+type TypeCode uint16
+
+const TypeCodeUnknown TypeCode = 0
+
+var (
+	typeCodes = map[MessageType]TypeCode{
+		MessageTypeAuth:        0x0001,
+		MessageTypeHeartbeat:   0x0002,
+		MessageTypeSystemInfo:  0x0003,
+		MessageTypeStaticInfo:  0x0004,
+		MessageTypeTaskResult:  0x0005,
+		MessageTypeTaskRequest: 0x0006,
+		MessageTypeConfig:      0x0007,
+		MessageTypeAck:         0x0008,
+		MessageTypeNack:        0x0009,
+		MessageTypeRequest:     0x000A,
+		MessageTypeResponse:    0x000B,
+		MessageTypeHello:       0x000C,
+		MessageTypeAuthOK:      0x000D,
+		MessageTypeAuthFail:    0x000E,
+		MessageTypeEnroll:      0x000F,
+		MessageTypeEnrollOK:    0x0010,
+		MessageTypeRotate:      0x0011,
+	}
+	codeTypes = make(map[TypeCode]MessageType)
+
+	// 旧版头部只有 4 字节类型字段，超长的类型名会被截断
+	legacyTypes = map[string]MessageType{
+		"STAT": MessageTypeStaticInfo,
+		"CONF": MessageTypeConfig,
+	}
+)
+
+func init() {
+	for t, code := range typeCodes {
+		codeTypes[code] = t
+	}
+}
+
+// CodeOf 返回消息类型对应的数字编码，未注册的类型返回 TypeCodeUnknown
+func CodeOf(t MessageType) TypeCode {
+	return typeCodes[t]
+}
+
+// TypeOf 返回数字编码对应的消息类型
+func TypeOf(code TypeCode) (MessageType, bool) {
+	t, ok := codeTypes[code]
+	return t, ok
+}
+
+// isFrameV1 判断缓冲区是否以 v1 帧魔数开头
+func isFrameV1(data []byte) bool {
+	return len(data) >= 2 && binary.BigEndian.Uint16(data[0:2]) == FrameMagic
+}
+
+// headerSize 返回 v1 头部（含扩展字段）的长度
+func headerSize(h *MessageHeader) int {
+	size := FrameHeaderSize
+	if h.Seq != 0 {
+		size += 2 + 8
+	}
+	if h.ID != 0 {
+		size += 2 + 8
+	}
+	if h.CorrelationID != 0 {
+		size += 2 + 8
+	}
+	if h.SignSeq != 0 {
+		size += 2 + 8
+	}
+	return size
+}
+
+// putHeader 将 v1 头部写入 data，data 长度至少为 headerSize(h)
+func putHeader(data []byte, h *MessageHeader) {
+	size := headerSize(h)
+	binary.BigEndian.PutUint16(data[0:2], FrameMagic)
+	data[2] = h.Version
+	data[3] = uint8(size)
+	binary.BigEndian.PutUint16(data[4:6], h.Flags)
+	binary.BigEndian.PutUint16(data[6:8], uint16(CodeOf(h.Type)))
+	binary.BigEndian.PutUint32(data[8:12], h.Length)
+	binary.BigEndian.PutUint32(data[12:16], h.Timestamp)
+
+	ext := data[FrameHeaderSize:size]
+	if h.Seq != 0 {
+		ext[0], ext[1] = extSequence, 8
+		binary.BigEndian.PutUint64(ext[2:10], h.Seq)
+		ext = ext[10:]
+	}
+	if h.ID != 0 {
+		ext[0], ext[1] = extMessageID, 8
+		binary.BigEndian.PutUint64(ext[2:10], h.ID)
+		ext = ext[10:]
+	}
+	if h.CorrelationID != 0 {
+		ext[0], ext[1] = extCorrelate, 8
+		binary.BigEndian.PutUint64(ext[2:10], h.CorrelationID)
+		ext = ext[10:]
+	}
+	if h.SignSeq != 0 {
+		ext[0], ext[1] = extSignSeq, 8
+		binary.BigEndian.PutUint64(ext[2:10], h.SignSeq)
+		ext = ext[10:]
+	}
+}
+
+// readExtensions 解析扩展字段，忽略不认识的标签
+func readExtensions(ext []byte, h *MessageHeader) {
+	for len(ext) >= 2 {
+		tag, size := ext[0], int(ext[1])
+		if len(ext) < 2+size {
+			return
+		}
+		value := ext[2 : 2+size]
+		switch {
+		case tag == extSequence && size == 8:
+			h.Seq = binary.BigEndian.Uint64(value)
+		case tag == extMessageID && size == 8:
+			h.ID = binary.BigEndian.Uint64(value)
+		case tag == extCorrelate && size == 8:
+			h.CorrelationID = binary.BigEndian.Uint64(value)
+		case tag == extSignSeq && size == 8:
+			h.SignSeq = binary.BigEndian.Uint64(value)
+		}
+		ext = ext[2+size:]
+	}
+}
+
+// readHeader 从缓冲区读取头部，返回头部、类型编码及头部实际长度；数据不足时 ok 为 false。
+// 未知类型的 header.Type 为空（v1）或原始类型名（旧版），由调用方校验。
+func readHeader(data []byte) (header MessageHeader, code TypeCode, headerLen int, ok bool) {
+	if isFrameV1(data) {
+		if len(data) < FrameHeaderSize {
+			return header, 0, 0, false
+		}
+		headerLen = int(data[3])
+		if headerLen < FrameHeaderSize {
+			headerLen = FrameHeaderSize
+		}
+		if len(data) < headerLen {
+			return header, 0, 0, false
+		}
+		code = TypeCode(binary.BigEndian.Uint16(data[6:8]))
+		header.Type, _ = TypeOf(code)
+		header.Version = data[2]
+		header.Flags = binary.BigEndian.Uint16(data[4:6])
+		header.Length = binary.BigEndian.Uint32(data[8:12])
+		header.Timestamp = binary.BigEndian.Uint32(data[12:16])
+		readExtensions(data[FrameHeaderSize:headerLen], &header)
+		return header, code, headerLen, true
+	}
+
+	if len(data) < LegacyHeaderSize {
+		return header, 0, 0, false
+	}
+	name := strings.TrimRight(string(data[0:4]), "\x00 ")
+	if t, exists := legacyTypes[name]; exists {
+		header.Type = t
+	} else {
+		header.Type = MessageType(name)
+	}
+	header.Length = binary.BigEndian.Uint32(data[4:8])
+	header.Timestamp = binary.BigEndian.Uint32(data[8:12])
+	return header, CodeOf(header.Type), LegacyHeaderSize, true
+}
+
+// validHeader 检查 v1 头部的版本和头部长度字段
+func validHeader(data []byte) bool {
+	if !isFrameV1(data) || len(data) < FrameHeaderSize {
+		return true
+	}
+	return data[2] != 0 && data[3] >= FrameHeaderSize
+}
@@ -1,41 +1,189 @@
 package protocol
 
 import (
-	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
 type MessageType string
 
 const (
-	MessageTypeAuth       MessageType = "AUTH"
-	MessageTypeHeartbeat MessageType = "HEART"
-	MessageTypeSystemInfo MessageType = "SINFO"
-	MessageTypeStaticInfo MessageType = "STATIC"
-	MessageTypeTaskResult MessageType = "TRSLT"
-	MessageTypeConfig     MessageType = "CONFIG"
+	MessageTypeAuth        MessageType = "AUTH"
+	MessageTypeHeartbeat   MessageType = "HEART"
+	MessageTypeSystemInfo  MessageType = "SINFO"
+	MessageTypeStaticInfo  MessageType = "STATIC"
+	MessageTypeTaskResult  MessageType = "TRSLT"
+	MessageTypeTaskRequest MessageType = "TREQ"
+	MessageTypeConfig      MessageType = "CONFIG"
+	MessageTypeAck         MessageType = "ACK"
+	MessageTypeNack        MessageType = "NACK"
+	MessageTypeRequest     MessageType = "REQ"
+	MessageTypeResponse    MessageType = "RESP"
+	MessageTypeHello       MessageType = "HELLO"
+	MessageTypeAuthOK      MessageType = "AUTH_OK"
+	MessageTypeAuthFail    MessageType = "AUTH_FAIL"
+	MessageTypeEnroll      MessageType = "ENROLL"
+	MessageTypeEnrollOK    MessageType = "ENROLL_OK"
+	MessageTypeRotate      MessageType = "ROTATE"
 )
 
 type Message struct {
-	Header  MessageHeader
-	Payload interface{}
+	Header    MessageHeader
+	Payload   interface{}
+	Signature *FrameSignature // 帧带签名尾部时由解析器填充
+	Digest    [32]byte        // 负载字节（解密后、解压前）的 SHA-256，由解析器填充
 }
 
 type MessageHeader struct {
 	Type      MessageType
+	Version   uint8  // 帧格式版本，旧版头部为 0
+	Flags     uint16 // 帧标志位
 	Length    uint32
 	Timestamp uint32
+	Seq       uint64 // 离线缓存记录序号，0 表示未携带，供 Hub 去重
+	ID        uint64 // 消息 ID，0 表示未携带；携带时 Hub 需回复 ACK/NACK
+	// 关联 ID，请求方生成，响应方原样带回以匹配请求，0 表示未携带
+	CorrelationID uint64
+	SignSeq       uint64 // 签名序号，会话内严格递增，0 表示未携带
 }
 
+// 认证消息。Hub 在 HELLO 中下发挑战 nonce 时，Agent 以 MAC 应答而不发送密钥；
+// Key 仅用于不支持挑战的旧版 Hub。
 type AuthPayload struct {
-	Key   string `json:"key"`
+	Key       string `json:"key,omitempty"`
+	UUID      string `json:"uuid"`
+	Alias     string `json:"alias"`
+	Nonce     string `json:"nonce,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"` // 生成应答时的 Unix 秒
+	MAC       string `json:"mac,omitempty"`       // 见 AuthMAC
+}
+
+// AUTH_FAIL 的原因代码
+type AuthFailReason string
+
+const (
+	AuthFailBadKey        AuthFailReason = "bad_key"         // 密钥错误
+	AuthFailRevoked       AuthFailReason = "revoked"         // 凭据已被吊销
+	AuthFailBanned        AuthFailReason = "banned"          // Agent 已被封禁
+	AuthFailVersionTooOld AuthFailReason = "version_too_old" // Agent 版本过旧
+	AuthFailReplay        AuthFailReason = "replay"          // 挑战已使用或时间戳超出允许范围，可重试
+	AuthFailInternal      AuthFailReason = "internal"        // Hub 内部错误，可重试
+	AuthFailBadToken      AuthFailReason = "bad_token"       // 注册令牌无效或已被使用
+)
+
+// Permanent 判断该原因是否无法通过重试解决
+func (r AuthFailReason) Permanent() bool {
+	switch r {
+	case AuthFailBadKey, AuthFailRevoked, AuthFailBanned, AuthFailVersionTooOld, AuthFailBadToken:
+		return true
+	}
+	return false
+}
+
+// Hub 对 AUTH 的答复，AUTH_OK 时 Reason 为空
+type AuthResultPayload struct {
+	Reason  AuthFailReason `json:"reason,omitempty"`
+	Message string         `json:"message,omitempty"`
+}
+
+// 注册消息。Agent 以一次性注册令牌换取专属凭据，随后以该凭据认证。
+// CSR 为可选的 PEM 证书签名请求，Hub 可据此签发 mTLS 客户端证书。
+type EnrollPayload struct {
+	Token string `json:"token"`
 	UUID  string `json:"uuid"`
 	Alias string `json:"alias"`
+	CSR   string `json:"csr,omitempty"`
 }
 
+// Hub 对 ENROLL 的答复，失败时以 AUTH_FAIL 答复
+type EnrollResultPayload struct {
+	Secret      string `json:"secret,omitempty"`      // Agent 专属认证密钥
+	Certificate string `json:"certificate,omitempty"` // 按 CSR 签发的客户端证书（PEM）
+	// Hub 的 X25519 长期公钥（base64），用于负载加密
+	EncryptionKey string `json:"encryptionKey,omitempty"`
+}
+
+// Hub 下发的新凭据，可同时包含多项。Secret 为新的认证密钥（共享密钥或专属密钥），
+// Certificate 为按 Agent 当前私钥续签的客户端证书（PEM）
+type RotatePayload struct {
+	Secret      string `json:"secret,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// 握手阶段 Agent 通告的能力，Hub 以同样的结构回复选定的子集。
+// Hub 回复中 Codecs、Compression 的第一项为本连接使用的编码格式和压缩算法。
+type HelloPayload struct {
+	ProtocolVersion uint8    `json:"protocolVersion"`
+	Version         string   `json:"version,omitempty"` // 构建版本
+	Codecs          []string `json:"codecs"`
+	Compression     []string `json:"compression,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	MaxFrameSize    uint32   `json:"maxFrameSize,omitempty"` // 单帧负载上限（字节），0 表示未声明
+	Nonce           string   `json:"nonce,omitempty"`        // Hub 下发的一次性认证挑战
+	KeyShare        string   `json:"keyShare,omitempty"`     // 负载加密的 X25519 临时公钥（base64）
+}
+
+// 可协商的功能
+const (
+	FeatureTasks         = "tasks"      // 任务下发与结果上报
+	FeaturePlugins       = "plugins"    // 插件
+	FeatureAcks          = "acks"       // 消息确认 ACK/NACK
+	FeatureSignedFrames  = "signing"    // Hub 下发的帧附带签名
+	FeatureEnroll        = "enroll"     // 以注册令牌换取 Agent 专属凭据
+	FeatureRotate        = "rotate"     // Hub 下发新凭据（ROTATE）
+	FeatureEncryption    = "encryption" // 负载加密，见 encrypt.go
+	FeatureHeartbeatEcho = "echo"       // Hub 原样发回心跳，用于检测存活及测量往返时延
+)
+
+// 心跳消息。协商了心跳回显时 Hub 将负载原样发回，Seq 与 SentAt 供 Agent 匹配回显，旧版 Hub 忽略
 type HeartbeatPayload struct {
-	UUID string `json:"uuid"`
+	UUID   string `json:"uuid"`
+	Seq    uint64 `json:"seq,omitempty"`    // 连接内递增的心跳序号
+	SentAt int64  `json:"sentAt,omitempty"` // 发送时间（Unix 毫秒）
+}
+
+// Hub 对指定消息 ID 的确认（ACK）或拒绝（NACK）
+type AckPayload struct {
+	IDs    []uint64 `json:"ids"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// 任务状态，与 Hub 端 TaskStatus 保持一致
+type TaskStatus string
+
+const (
+	TaskStatusRunning   TaskStatus = "running"
+	TaskStatusCompleted TaskStatus = "completed"
+	TaskStatusFailed    TaskStatus = "failed"
+)
+
+// Hub 下发的任务请求
+type TaskRequestPayload struct {
+	TaskID int64           `json:"taskId"`
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config"`
+}
+
+// 上报给 Hub 的任务状态及结果
+type TaskResultPayload struct {
+	TaskID int64       `json:"taskId"`
+	UUID   string      `json:"uuid"`
+	Status TaskStatus  `json:"status"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// 通用请求，Method 由 Hub 约定，如 config.get、peers.list、file.chunk
+type RequestPayload struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// 通用响应，Error 非空表示请求失败
+type ResponsePayload struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
 }
 
 // 静态系统信息
@@ -70,13 +218,13 @@ type SwapInfo struct {
 
 // 动态系统信息
 type SystemInfo struct {
-	UUID          string `json:"uuid"`
+	UUID           string `json:"uuid"`
 	NetworkTraffic struct {
 		In  uint64 `json:"in"`
 		Out uint64 `json:"out"`
 	} `json:"networkTraffic"`
-	Uptime  float64 `json:"uptime"`
-	CPU     struct {
+	Uptime float64 `json:"uptime"`
+	CPU    struct {
 		Usage float64 `json:"usage"`
 	} `json:"cpu"`
 	Memory struct {
@@ -92,44 +240,190 @@ type SystemInfo struct {
 		TCP int `json:"tcp"`
 		UDP int `json:"udp"`
 	} `json:"network"`
+	Link *LinkStats `json:"link,omitempty"` // 到 Hub 的链路质量，尚无统计时为 nil
+}
+
+// 以心跳回显测得的链路质量，时延单位为毫秒。
+// 平均、最小、最大时延及样本数、丢失数统计自上一次上报，RTT 与 Jitter 为当前值。
+type LinkStats struct {
+	RTT     float64 `json:"rtt"` // 最近一次往返时延
+	RTTAvg  float64 `json:"rttAvg"`
+	RTTMin  float64 `json:"rttMin"`
+	RTTMax  float64 `json:"rttMax"`
+	Jitter  float64 `json:"jitter"`  // 按 RFC 3550 平滑的时延抖动
+	Samples uint64  `json:"samples"` // 收到的回显数
+	Lost    uint64  `json:"lost"`    // 未收到回显的心跳数
+
+	Encrypted bool `json:"encrypted"` // 当前连接是否协商了负载加密
 }
 
 func NewMessage(msgType MessageType, payload interface{}) *Message {
 	return &Message{
 		Header: MessageHeader{
 			Type:      msgType,
+			Version:   ProtocolVersion,
 			Timestamp: uint32(time.Now().Unix()),
 		},
 		Payload: payload,
 	}
 }
 
-func (m *Message) Encode() []byte {
-	payloadBytes, _ := json.Marshal(m.Payload)
-	m.Header.Length = uint32(len(payloadBytes))
+// EncodeOptions 控制负载的编码与压缩方式
+type EncodeOptions struct {
+	Codec      Codec      // 负载编码格式，nil 时使用 JSON
+	Compressor Compressor // 压缩算法，nil 时不压缩
+	// 负载不小于该字节数时才压缩，0 时使用 DefaultCompressThreshold
+	CompressThreshold int
+	// 对端可接受的单帧负载上限，超出时返回 ErrFrameTooLarge，0 表示不限制
+	MaxPayloadSize uint32
+	// 帧签名器，非 nil 时在负载后附加签名尾部；签名序号由调用方写入 Header.SignSeq
+	Signer FrameSigner
+	// 负载加密密钥，非 nil 时压缩后加密负载，见 encrypt.go
+	Cipher *FrameCipher
+}
+
+// Encode 以 JSON 编码负载并生成完整的帧
+func (m *Message) Encode() ([]byte, error) {
+	return m.EncodeWithOptions(EncodeOptions{})
+}
+
+// EncodeWith 以指定编码格式编码负载，编码格式记录在头部标志位中
+func (m *Message) EncodeWith(codec Codec) ([]byte, error) {
+	return m.EncodeWithOptions(EncodeOptions{Codec: codec})
+}
+
+// EncodeWithOptions 按 opts 编码负载并生成完整的帧。
+// 负载达到压缩阈值且压缩后确实变小时才压缩，压缩算法记录在头部标志位中。
+func (m *Message) EncodeWithOptions(opts EncodeOptions) ([]byte, error) {
+	codec := opts.Codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+	payloadBytes, err := codec.Marshal(m.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s 编码 %s 消息失败: %w", codec.Name(), m.Header.Type, err)
+	}
+	m.Header.Flags = m.Header.Flags&^(FlagCodecMask|FlagCompressMask|FlagSigned|FlagEncrypted) | uint16(codec.ID())
+	if opts.Signer != nil {
+		m.Header.Flags |= FlagSigned
+	}
+	if opts.Cipher != nil {
+		m.Header.Flags |= FlagEncrypted
+	}
+
+	threshold := opts.CompressThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	if opts.Compressor != nil && len(payloadBytes) >= threshold {
+		compressed, err := opts.Compressor.Compress(payloadBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s 压缩 %s 消息失败: %w", opts.Compressor.Name(), m.Header.Type, err)
+		}
+		if len(compressed) < len(payloadBytes) {
+			payloadBytes = compressed
+			m.Header.Flags |= uint16(opts.Compressor.ID()) << compressShift
+		}
+	}
+
+	length := len(payloadBytes)
+	if opts.Cipher != nil {
+		length += opts.Cipher.Overhead()
+	}
+	if opts.MaxPayloadSize > 0 && length > int(opts.MaxPayloadSize) {
+		return nil, &FrameError{Err: ErrFrameTooLarge, Type: m.Header.Type, Code: CodeOf(m.Header.Type), Length: uint32(length)}
+	}
 
-	headerSize := 12 // 4(type) + 4(length) + 4(timestamp)
-	data := make([]byte, headerSize+len(payloadBytes))
+	m.Header.Length = uint32(length)
+	if m.Header.Version == 0 {
+		m.Header.Version = ProtocolVersion
+	}
 
-	// 写入消息类型 (4字节)
-	copy(data[0:4], []byte(m.Header.Type))
+	size := headerSize(&m.Header)
+	data := make([]byte, size+length)
 
-	// 写入数据长度 (4字节)
-	binary.BigEndian.PutUint32(data[4:8], m.Header.Length)
+	// 写入 v1 头部
+	putHeader(data, &m.Header)
 
-	// 写入时间戳 (4字节)
-	binary.BigEndian.PutUint32(data[8:12], m.Header.Timestamp)
+	// 写入负载数据，加密时以头部为附加数据
+	if opts.Cipher != nil {
+		if err := opts.Cipher.seal(data[size:], data[:size], payloadBytes); err != nil {
+			return nil, fmt.Errorf("加密 %s 消息失败: %w", m.Header.Type, err)
+		}
+	} else {
+		copy(data[size:], payloadBytes)
+	}
 
-	// 写入负载数据
-	copy(data[headerSize:], payloadBytes)
+	if opts.Signer != nil {
+		data = appendSignature(data, opts.Signer)
+	}
+	return data, nil
+}
+
+// Codec 返回头部标志位中记录的负载编码格式
+func (h *MessageHeader) Codec() (Codec, bool) {
+	return CodecByID(CodecID(h.Flags & FlagCodecMask))
+}
 
-	return data
+// Compression 返回头部标志位中记录的压缩算法，未压缩时返回 nil, true
+func (h *MessageHeader) Compression() (Compressor, bool) {
+	id := CompressionID((h.Flags & FlagCompressMask) >> compressShift)
+	if id == CompressNone {
+		return nil, true
+	}
+	return CompressorByID(id)
 }
 
 func (m *Message) DecodePayload(v interface{}) error {
+	switch payload := m.Payload.(type) {
+	case json.RawMessage:
+		return json.Unmarshal(payload, v)
+	case *RawPayload:
+		return payload.Codec.Unmarshal(payload.Data, v)
+	}
+
 	payloadBytes, err := json.Marshal(m.Payload)
 	if err != nil {
 		return err
 	}
 	return json.Unmarshal(payloadBytes, v)
-}
\ No newline at end of file
+}
+
+// RawPayload 是未按类型解码的非 JSON 负载，保留原始字节及其编码格式
+type RawPayload struct {
+	Codec Codec
+	Data  []byte
+}
+
+// NewPayload 返回消息类型对应负载结构体的指针，没有固定结构的类型返回 nil
+func NewPayload(msgType MessageType) interface{} {
+	switch msgType {
+	case MessageTypeAuth:
+		return &AuthPayload{}
+	case MessageTypeHeartbeat:
+		return &HeartbeatPayload{}
+	case MessageTypeSystemInfo:
+		return &SystemInfo{}
+	case MessageTypeStaticInfo:
+		return &StaticSystemInfo{}
+	case MessageTypeTaskRequest:
+		return &TaskRequestPayload{}
+	case MessageTypeTaskResult:
+		return &TaskResultPayload{}
+	case MessageTypeAck, MessageTypeNack:
+		return &AckPayload{}
+	case MessageTypeResponse:
+		return &ResponsePayload{}
+	case MessageTypeHello:
+		return &HelloPayload{}
+	case MessageTypeAuthOK, MessageTypeAuthFail:
+		return &AuthResultPayload{}
+	case MessageTypeEnroll:
+		return &EnrollPayload{}
+	case MessageTypeEnrollOK:
+		return &EnrollResultPayload{}
+	case MessageTypeRotate:
+		return &RotatePayload{}
+	}
+	return nil
+}
@@ -1,73 +1,229 @@
 package protocol
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+)
+
+const (
+	// DefaultMaxPayloadSize 是单帧负载的默认上限
+	DefaultMaxPayloadSize = 1 << 20
+	// 缓冲区空闲时超过该容量会被释放，避免一次大帧长期占用内存
+	parserBufferShrinkSize = 64 << 10
 )
 
 type MessageParser struct {
-	buffer []byte
+	buffer         []byte
+	start          int // buffer 中尚未解析数据的起始位置
+	maxPayloadSize uint32
+	cipher         *FrameCipher // 非 nil 时所有帧都必须加密
 }
 
 func NewMessageParser() *MessageParser {
 	return &MessageParser{
-		buffer: make([]byte, 0),
+		buffer:         make([]byte, 0, 4096),
+		maxPayloadSize: DefaultMaxPayloadSize,
+	}
+}
+
+// SetMaxPayloadSize 设置单帧负载上限，同时作为压缩负载解压后的上限；size 为 0 时使用默认值
+func (p *MessageParser) SetMaxPayloadSize(size uint32) {
+	if size == 0 {
+		size = DefaultMaxPayloadSize
 	}
+	p.maxPayloadSize = size
+}
+
+// SetCipher 设置解密负载的密钥，此后收到的帧都必须加密
+func (p *MessageParser) SetCipher(cipher *FrameCipher) {
+	p.cipher = cipher
 }
 
 func (p *MessageParser) Append(data []byte) {
+	// 复用已解析部分占用的空间，而不是让缓冲区持续增长
+	if p.start > 0 {
+		n := copy(p.buffer, p.buffer[p.start:])
+		p.buffer = p.buffer[:n]
+		p.start = 0
+	}
 	p.buffer = append(p.buffer, data...)
 }
 
+// Buffered 返回尚未解析的字节数
+func (p *MessageParser) Buffered() int {
+	return len(p.buffer) - p.start
+}
+
+// HasCompleteMessage 判断是否可以调用 ParseMessage 取得一条消息或一个解析错误
 func (p *MessageParser) HasCompleteMessage() bool {
-	headerSize := 12 // 4(type) + 4(length) + 4(timestamp)
-	if len(p.buffer) < headerSize {
+	data := p.buffer[p.start:]
+	if !validHeader(data) {
+		return true
+	}
+	header, _, headerLen, ok := readHeader(data)
+	if !ok {
 		return false
 	}
-
-	length := binary.BigEndian.Uint32(p.buffer[4:8])
-	return len(p.buffer) >= headerSize+int(length)
+	if header.Length > p.maxPayloadSize {
+		return true
+	}
+	frameLen := headerLen + int(header.Length)
+	if header.Flags&FlagSigned != 0 {
+		trailer, ok := trailerSize(data, frameLen)
+		if !ok {
+			return false
+		}
+		frameLen += trailer
+	}
+	return len(data) >= frameLen
 }
 
-func (p *MessageParser) ParseMessage() *Message {
-	if !p.HasCompleteMessage() {
-		return nil
+// ParseMessage 解析一条完整消息；数据不足时返回 nil, nil。
+// 未知类型和负载错误会跳过该帧并返回可恢复的 *FrameError；
+// 头部非法或长度超限时丢弃数据直到下一个帧魔数，返回不可恢复的 *FrameError。
+func (p *MessageParser) ParseMessage() (*Message, error) {
+	data := p.buffer[p.start:]
+	if !validHeader(data) {
+		p.resync()
+		return nil, &FrameError{Err: ErrBadHeader}
 	}
 
-	headerSize := 12
-	msgType := MessageType(string(p.buffer[0:4]))
-	length := binary.BigEndian.Uint32(p.buffer[4:8])
-	timestamp := binary.BigEndian.Uint32(p.buffer[8:12])
-
-	header := MessageHeader{
-		Type:      msgType,
-		Length:    length,
-		Timestamp: timestamp,
+	header, code, headerSize, ok := readHeader(data)
+	if !ok {
+		return nil, nil
 	}
+	length := header.Length
+	msgType := header.Type
 
-	payloadBytes := p.buffer[headerSize : headerSize+int(length)]
-	var payload interface{}
+	if length > p.maxPayloadSize {
+		p.resync()
+		return nil, &FrameError{Err: ErrFrameTooLarge, Type: msgType, Code: code, Length: length}
+	}
+	frameLen := headerSize + int(length)
+	if len(data) < frameLen {
+		return nil, nil
+	}
 
-	switch msgType {
-	case MessageTypeAuth:
-		var auth AuthPayload
-		json.Unmarshal(payloadBytes, &auth)
-		payload = &auth
-	case MessageTypeHeartbeat:
-		var heartbeat HeartbeatPayload
-		json.Unmarshal(payloadBytes, &heartbeat)
-		payload = &heartbeat
-	case MessageTypeSystemInfo:
-		var sysInfo SystemInfo
-		json.Unmarshal(payloadBytes, &sysInfo)
-		payload = &sysInfo
+	var signature *FrameSignature
+	consumed := frameLen
+	if header.Flags&FlagSigned != 0 {
+		trailer, ok := trailerSize(data, frameLen)
+		if !ok || len(data) < frameLen+trailer {
+			return nil, nil
+		}
+		signature = &FrameSignature{
+			Algorithm: SignAlgorithm(data[frameLen]),
+			Value:     append([]byte(nil), data[frameLen+2:frameLen+trailer]...),
+			Data:      append([]byte(nil), data[:frameLen]...),
+		}
+		consumed += trailer
 	}
 
+	payloadBytes := data[headerSize:frameLen]
+	headerBytes := data[:headerSize]
+
 	// 移除已解析的消息
-	p.buffer = p.buffer[headerSize+int(length):]
+	p.consume(consumed)
+
+	// 解密先于其他校验，未通过认证的帧不可信，不能作为可恢复的错误跳过
+	if header.Flags&FlagEncrypted != 0 {
+		if p.cipher == nil {
+			return nil, &FrameError{Err: ErrDecrypt, Type: msgType, Code: code, Length: length, Cause: errNoCipher}
+		}
+		plaintext, err := p.cipher.open(headerBytes, payloadBytes)
+		if err != nil {
+			return nil, &FrameError{Err: ErrDecrypt, Type: msgType, Code: code, Length: length, Cause: err}
+		}
+		payloadBytes = plaintext
+	} else if p.cipher != nil {
+		return nil, &FrameError{Err: ErrUnencrypted, Type: msgType, Code: code, Length: length}
+	}
+
+	if _, known := TypeOf(code); !known {
+		return nil, &FrameError{Err: ErrUnknownType, Type: msgType, Code: code, Length: length}
+	}
+
+	payload, err := decodePayload(&header, payloadBytes, int(p.maxPayloadSize))
+	if err != nil {
+		return nil, &FrameError{Err: ErrBadPayload, Type: msgType, Code: code, Length: length, Cause: err}
+	}
 
 	return &Message{
-		Header:  header,
-		Payload: payload,
+		Header:    header,
+		Payload:   payload,
+		Signature: signature,
+		Digest:    sha256.Sum256(payloadBytes),
+	}, nil
+}
+
+// decodePayload 按头部记录的压缩算法和编码格式将已知类型的负载解码为对应结构体，
+// 其余类型保留原始字节，由调用方通过 DecodePayload 解码。解压结果不得超过 limit 字节。
+func decodePayload(header *MessageHeader, payloadBytes []byte, limit int) (interface{}, error) {
+	codec, ok := header.Codec()
+	if !ok {
+		return nil, errUnknownCodec
+	}
+	compressor, ok := header.Compression()
+	if !ok {
+		return nil, errUnknownCompression
+	}
+	if compressor != nil {
+		data, err := compressor.Decompress(payloadBytes, limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s 解压失败: %w", compressor.Name(), err)
+		}
+		payloadBytes = data
+	}
+
+	payload := NewPayload(header.Type)
+	if payload == nil {
+		raw := make([]byte, len(payloadBytes))
+		copy(raw, payloadBytes)
+		if codec.ID() != CodecJSON {
+			return &RawPayload{Codec: codec, Data: raw}, nil
+		}
+		if len(raw) > 0 && !json.Valid(raw) {
+			return nil, errInvalidJSON
+		}
+		return json.RawMessage(raw), nil
+	}
+
+	if len(payloadBytes) == 0 {
+		return payload, nil
 	}
-}
\ No newline at end of file
+	if err := codec.Unmarshal(payloadBytes, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// consume 丢弃已处理的 n 个字节，缓冲区清空后释放过大的底层数组
+func (p *MessageParser) consume(n int) {
+	p.start += n
+	if p.start < len(p.buffer) {
+		return
+	}
+	p.start = 0
+	if cap(p.buffer) > parserBufferShrinkSize {
+		p.buffer = make([]byte, 0, 4096)
+	} else {
+		p.buffer = p.buffer[:0]
+	}
+}
+
+// resync 丢弃当前帧头，跳到缓冲区中下一个 v1 帧魔数处；找不到时只保留最后一个字节，
+// 以防魔数被拆分在两次读取之间
+func (p *MessageParser) resync() {
+	data := p.buffer[p.start:]
+	magic := make([]byte, 2)
+	binary.BigEndian.PutUint16(magic, FrameMagic)
+
+	if idx := bytes.Index(data[1:], magic); idx >= 0 {
+		p.consume(idx + 1)
+		return
+	}
+	p.consume(len(data) - 1)
+}
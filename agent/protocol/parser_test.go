@@ -0,0 +1,212 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func encode(t *testing.T, msgType MessageType, payload interface{}) []byte {
+	t.Helper()
+	data, err := NewMessage(msgType, payload).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func heartbeatFrame(t *testing.T, uuid string) []byte {
+	return encode(t, MessageTypeHeartbeat, &HeartbeatPayload{UUID: uuid})
+}
+
+// parseAll 解析缓冲区中的全部数据，返回解析出的消息和遇到的错误
+func parseAll(t *testing.T, p *MessageParser) ([]*Message, []error) {
+	t.Helper()
+	var msgs []*Message
+	var errs []error
+	for i := 0; p.HasCompleteMessage(); i++ {
+		if i > 100 {
+			t.Fatal("解析没有进展")
+		}
+		msg, err := p.ParseMessage()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if msg == nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, errs
+}
+
+func wantHeartbeats(t *testing.T, msgs []*Message, uuids ...string) {
+	t.Helper()
+	if len(msgs) != len(uuids) {
+		t.Fatalf("parsed %d messages, want %d", len(msgs), len(uuids))
+	}
+	for i, msg := range msgs {
+		hb, ok := msg.Payload.(*HeartbeatPayload)
+		if msg.Header.Type != MessageTypeHeartbeat || !ok || hb.UUID != uuids[i] {
+			t.Fatalf("message %d = %s %+v, want heartbeat %s", i, msg.Header.Type, msg.Payload, uuids[i])
+		}
+	}
+}
+
+func wantFrameError(t *testing.T, err error, target error, recoverable bool) {
+	t.Helper()
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || !errors.Is(err, target) {
+		t.Fatalf("err = %v, want %v", err, target)
+	}
+	if frameErr.Recoverable() != recoverable {
+		t.Fatalf("Recoverable() = %v, want %v", frameErr.Recoverable(), recoverable)
+	}
+}
+
+func TestParserFrameTooLarge(t *testing.T) {
+	p := NewMessageParser()
+	p.SetMaxPayloadSize(64)
+	large := heartbeatFrame(t, strings.Repeat("x", 128))
+	p.Append(append(large, heartbeatFrame(t, "next")...))
+
+	msgs, errs := parseAll(t, p)
+	if len(errs) != 1 {
+		t.Fatalf("errs = %v", errs)
+	}
+	wantFrameError(t, errs[0], ErrFrameTooLarge, false)
+	// 超限的帧不读入负载，直接跳到下一个帧魔数
+	wantHeartbeats(t, msgs, "next")
+}
+
+func TestParserGarbage(t *testing.T) {
+	tests := []struct {
+		name    string
+		garbage []byte
+	}{
+		{"short", []byte("junk!")},
+		{"long", bytes.Repeat([]byte("x"), 32)},
+		{"bad version", []byte{0xb2, 0x4d, 0x00, 16}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewMessageParser()
+			p.Append(append(tt.garbage, heartbeatFrame(t, "after")...))
+			msgs, errs := parseAll(t, p)
+			if len(errs) == 0 {
+				t.Fatal("垃圾数据应返回错误")
+			}
+			for _, err := range errs {
+				var frameErr *FrameError
+				if !errors.As(err, &frameErr) || frameErr.Recoverable() {
+					t.Fatalf("err = %v, 帧边界不可信时应为不可恢复的错误", err)
+				}
+			}
+			wantHeartbeats(t, msgs, "after")
+		})
+	}
+}
+
+func TestParserSplitMagic(t *testing.T) {
+	frame := heartbeatFrame(t, "split")
+	p := NewMessageParser()
+	// 魔数的第一个字节在垃圾数据之后到达，resync 须保留它
+	p.Append(append(bytes.Repeat([]byte("x"), 32), frame[0]))
+	msgs, _ := parseAll(t, p)
+	if len(msgs) != 0 || p.Buffered() != 1 {
+		t.Fatalf("msgs = %v, buffered = %d", msgs, p.Buffered())
+	}
+
+	p.Append(frame[1:])
+	msgs, errs := parseAll(t, p)
+	if len(errs) != 0 {
+		t.Fatalf("errs = %v", errs)
+	}
+	wantHeartbeats(t, msgs, "split")
+}
+
+func TestParserRecoverable(t *testing.T) {
+	unknown := heartbeatFrame(t, "unknown")
+	binary.BigEndian.PutUint16(unknown[6:8], 0x7fff)
+
+	badPayload := encode(t, MessageTypeHeartbeat, json.RawMessage(`{"uuid":1}`))
+	notJSON := encode(t, MessageTypeConfig, json.RawMessage(`{}`))
+	copy(notJSON[len(notJSON)-2:], "{{")
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"unknown type", unknown, ErrUnknownType},
+		{"payload type mismatch", badPayload, ErrBadPayload},
+		{"invalid json", notJSON, ErrBadPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewMessageParser()
+			p.Append(append(append(heartbeatFrame(t, "before"), tt.frame...), heartbeatFrame(t, "after")...))
+			msgs, errs := parseAll(t, p)
+			if len(errs) != 1 {
+				t.Fatalf("errs = %v", errs)
+			}
+			wantFrameError(t, errs[0], tt.want, true)
+			// 只跳过出错的一帧
+			wantHeartbeats(t, msgs, "before", "after")
+		})
+	}
+}
+
+func TestParserShrink(t *testing.T) {
+	p := NewMessageParser()
+	large := heartbeatFrame(t, strings.Repeat("x", 256<<10))
+	p.Append(large[:len(large)/2])
+	if msg, err := p.ParseMessage(); msg != nil || err != nil {
+		t.Fatalf("不完整的帧: %v, %v", msg, err)
+	}
+	p.Append(large[len(large)/2:])
+	msgs, errs := parseAll(t, p)
+	if len(errs) != 0 || len(msgs) != 1 {
+		t.Fatalf("msgs = %d, errs = %v", len(msgs), errs)
+	}
+	if cap(p.buffer) > parserBufferShrinkSize {
+		t.Fatalf("解析大帧后缓冲区未释放: cap = %d", cap(p.buffer))
+	}
+}
+
+func TestParserLegacyHeader(t *testing.T) {
+	payload := []byte(`{"heartbeatInterval":30}`)
+	frame := make([]byte, LegacyHeaderSize+len(payload))
+	// 旧版头部的类型字段为 4 字节，CONFIG 被截断为 CONF
+	copy(frame[0:4], "CONF")
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[8:12], 1700000000)
+	copy(frame[LegacyHeaderSize:], payload)
+
+	p := NewMessageParser()
+	// 逐字节到达
+	for _, b := range frame[:len(frame)-1] {
+		p.Append([]byte{b})
+		if p.HasCompleteMessage() {
+			t.Fatalf("收到 %d 字节时不应有完整消息", p.Buffered())
+		}
+	}
+	p.Append(frame[len(frame)-1:])
+	msg, err := p.ParseMessage()
+	if err != nil || msg == nil {
+		t.Fatalf("msg = %v, err = %v", msg, err)
+	}
+	if msg.Header.Type != MessageTypeConfig || msg.Header.Version != 0 || msg.Header.Timestamp != 1700000000 {
+		t.Fatalf("header = %+v", msg.Header)
+	}
+	var config struct {
+		HeartbeatInterval int `json:"heartbeatInterval"`
+	}
+	if err := msg.DecodePayload(&config); err != nil || config.HeartbeatInterval != 30 {
+		t.Fatalf("payload = %+v, %v", config, err)
+	}
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// 带签名的帧在负载之后附加签名尾部：algorithm(1) | len(1) | signature。
+// 签名覆盖线路上的完整头部（含扩展字段）和负载，头部 Length 不包含尾部。
+// 签名序号由扩展字段 extSignSeq 携带，在一个会话内严格递增，供接收方防重放。
+
+// SignAlgorithm 标识帧签名算法
+type SignAlgorithm uint8
+
+const (
+	SignHMACSHA256 SignAlgorithm = 1
+	SignEd25519    SignAlgorithm = 2
+)
+
+func (a SignAlgorithm) String() string {
+	switch a {
+	case SignHMACSHA256:
+		return "hmac-sha256"
+	case SignEd25519:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
+// FrameSignature 是解析出的签名尾部
+type FrameSignature struct {
+	Algorithm SignAlgorithm
+	Value     []byte
+	Data      []byte // 被签名的头部与负载
+}
+
+// FrameSigner 为帧生成签名
+type FrameSigner interface {
+	Algorithm() SignAlgorithm
+	Sign(data []byte) []byte
+}
+
+// FrameVerifier 校验帧签名
+type FrameVerifier interface {
+	Algorithm() SignAlgorithm
+	Verify(data, sig []byte) bool
+}
+
+// SessionSigningKey 从认证密钥和会话挑战派生 HMAC 帧签名密钥，使签名只在本会话内有效
+func SessionSigningKey(authKey, nonce string) []byte {
+	mac := hmac.New(sha256.New, []byte(authKey))
+	mac.Write([]byte("pbm frame signing\n"))
+	mac.Write([]byte(nonce))
+	return mac.Sum(nil)
+}
+
+// HMACFrameSigner 以 HMAC-SHA256 签名，同时可用作校验器
+type HMACFrameSigner struct {
+	key []byte
+}
+
+func NewHMACFrameSigner(key []byte) *HMACFrameSigner {
+	return &HMACFrameSigner{key: key}
+}
+
+func (s *HMACFrameSigner) Algorithm() SignAlgorithm { return SignHMACSHA256 }
+
+func (s *HMACFrameSigner) Sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (s *HMACFrameSigner) Verify(data, sig []byte) bool {
+	return hmac.Equal(s.Sign(data), sig)
+}
+
+// Ed25519 签名在帧数据前加上会话上下文（通常为会话挑战），使签名无法跨会话重放
+type ed25519FrameSigner struct {
+	key     ed25519.PrivateKey
+	context []byte
+}
+
+// NewEd25519FrameSigner 返回 Ed25519 签名器，context 用于绑定会话
+func NewEd25519FrameSigner(key ed25519.PrivateKey, context []byte) FrameSigner {
+	return &ed25519FrameSigner{key: key, context: context}
+}
+
+func (s *ed25519FrameSigner) Algorithm() SignAlgorithm { return SignEd25519 }
+
+func (s *ed25519FrameSigner) Sign(data []byte) []byte {
+	return ed25519.Sign(s.key, withContext(s.context, data))
+}
+
+type ed25519FrameVerifier struct {
+	key     ed25519.PublicKey
+	context []byte
+}
+
+// NewEd25519FrameVerifier 返回 Ed25519 校验器，context 须与签名方一致
+func NewEd25519FrameVerifier(key ed25519.PublicKey, context []byte) FrameVerifier {
+	return &ed25519FrameVerifier{key: key, context: context}
+}
+
+func (v *ed25519FrameVerifier) Algorithm() SignAlgorithm { return SignEd25519 }
+
+func (v *ed25519FrameVerifier) Verify(data, sig []byte) bool {
+	return ed25519.Verify(v.key, withContext(v.context, data), sig)
+}
+
+// withContext 返回 len(context) | context | data
+func withContext(context, data []byte) []byte {
+	buf := make([]byte, 4+len(context)+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(context)))
+	copy(buf[4:], context)
+	copy(buf[4+len(context):], data)
+	return buf
+}
+
+// trailerSize 返回 data[frameLen:] 处签名尾部的长度，数据不足时 ok 为 false
+func trailerSize(data []byte, frameLen int) (size int, ok bool) {
+	if len(data) < frameLen+2 {
+		return 0, false
+	}
+	return 2 + int(data[frameLen+1]), true
+}
+
+// appendSignature 为 frame（头部与负载）附加签名尾部
+func appendSignature(frame []byte, signer FrameSigner) []byte {
+	sig := signer.Sign(frame)
+	frame = append(frame, uint8(signer.Algorithm()), uint8(len(sig)))
+	return append(frame, sig...)
+}
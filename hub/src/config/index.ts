@@ -24,6 +24,16 @@ export const config = {
   },
   auth: {
     key: yamlConfig.auth.key || 'default-key-not-secure',
+    // 是否接受旧版 Agent 以明文发送的密钥
+    allowPlaintextKey: yamlConfig.auth.allowPlaintextKey || false,
+    // 一次性注册令牌，每个令牌只能为一个 Agent 签发专属凭据
+    enrollTokens: (yamlConfig.auth.enrollTokens || []) as string[],
+    // Agent 密钥的轮换周期（天），0 表示不自动轮换
+    rotationDays: yamlConfig.auth.rotationDays || 0,
+  },
+  encryption: {
+    // Hub 的 X25519 私钥（base64），为空时不支持负载加密
+    privateKey: yamlConfig.encryption?.privateKey || '',
   },
 };
 
@@ -76,6 +76,23 @@ export function initDatabase() {
       CREATE INDEX IF NOT EXISTS task_logs_task_idx ON task_logs(task_id);
     `);
 
+    // 创建注册令牌使用记录表和 Agent 专属凭据表
+    db.exec(`
+      CREATE TABLE IF NOT EXISTS enroll_tokens (
+        token_hash TEXT PRIMARY KEY,
+        used_by TEXT NOT NULL,
+        used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+      );
+      CREATE TABLE IF NOT EXISTS agent_credentials (
+        uuid TEXT PRIMARY KEY,
+        secret TEXT NOT NULL,
+        next_secret TEXT,
+        revoked INTEGER DEFAULT 0,
+        issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        revoked_at TIMESTAMP
+      );
+    `);
+
     Info('数据库初始化成功');
   } catch (error) {
     throw error;
@@ -3,6 +3,7 @@ import { Info, Error } from './logger';
 import { initDatabase } from './database';
 import { TCPServer } from './tcp/server';
 import { AgentManager } from './managers/agent-manager';
+import { CredentialManager } from './managers/credential-manager';
 
 async function main() {
   try {
@@ -15,7 +16,7 @@ async function main() {
     const agentManager = new AgentManager();
     
     // 启动 TCP 服务器
-    const tcpServer = new TCPServer(agentManager);
+    const tcpServer = new TCPServer(agentManager, new CredentialManager());
     tcpServer.start();
     
     // 优雅关闭
@@ -0,0 +1,102 @@
+import crypto from 'crypto';
+import { db } from '../database';
+import { config } from '../config';
+import { Info } from '../logger';
+
+export interface AgentCredential {
+  uuid: string;
+  secret: string;
+  nextSecret?: string; // 轮换中已下发、Agent 尚未以其认证的新密钥
+  revoked: boolean;
+}
+
+// 管理一次性注册令牌和 Agent 专属凭据
+export class CredentialManager {
+  // 以注册令牌为 Agent 签发专属密钥，令牌无效或已被使用时返回 null。
+  // 令牌在配置 auth.enrollTokens 中列出，数据库只记录其哈希及使用情况。
+  public enroll(token: string, uuid: string): string | null {
+    if (!token || !config.auth.enrollTokens.includes(token)) {
+      return null;
+    }
+    const tokenHash = crypto.createHash('sha256').update(token).digest('hex');
+    const secret = crypto.randomBytes(32).toString('hex');
+
+    const issue = db.transaction((): boolean => {
+      const used = db.prepare('SELECT used_by FROM enroll_tokens WHERE token_hash = ?').get(tokenHash);
+      if (used) {
+        return false;
+      }
+      db.prepare('INSERT INTO enroll_tokens (token_hash, used_by) VALUES (?, ?)').run(tokenHash, uuid);
+      db.prepare(`
+        INSERT INTO agent_credentials (uuid, secret, revoked) VALUES (?, ?, 0)
+        ON CONFLICT(uuid) DO UPDATE SET secret = excluded.secret, revoked = 0,
+          issued_at = CURRENT_TIMESTAMP, revoked_at = NULL
+      `).run(uuid, secret);
+      return true;
+    });
+
+    if (!issue()) {
+      return null;
+    }
+    Info(`已为 Agent ${uuid} 签发专属凭据`);
+    return secret;
+  }
+
+  public getCredential(uuid: string): AgentCredential | undefined {
+    const row = db.prepare('SELECT uuid, secret, next_secret, revoked FROM agent_credentials WHERE uuid = ?').get(uuid);
+    if (!row) {
+      return undefined;
+    }
+    return { uuid: row.uuid, secret: row.secret, nextSecret: row.next_secret || undefined, revoked: row.revoked === 1 };
+  }
+
+  // 判断是否应向 Agent 下发新密钥：仍在使用共享密钥、密钥已超过 auth.rotationDays，
+  // 或上次下发的新密钥尚未被使用（Agent 可能未收到）
+  public rotationDue(uuid: string): boolean {
+    if (config.auth.rotationDays <= 0) {
+      return false;
+    }
+    const row = db.prepare('SELECT issued_at, next_secret, revoked FROM agent_credentials WHERE uuid = ?').get(uuid);
+    if (!row) {
+      return true;
+    }
+    if (row.revoked === 1) {
+      return false;
+    }
+    if (row.next_secret) {
+      return true;
+    }
+    const issuedAt = Date.parse(`${row.issued_at.replace(' ', 'T')}Z`);
+    return Date.now() - issuedAt >= config.auth.rotationDays * 24 * 60 * 60 * 1000;
+  }
+
+  // 生成新密钥并与现有密钥并存，Agent 以新密钥认证成功后才替换（见 completeRotation），
+  // 在此之前两者都可通过认证。仍在使用共享密钥的 Agent 由此获得专属密钥。
+  public beginRotation(uuid: string): string {
+    const existing = this.getCredential(uuid);
+    if (existing?.nextSecret) {
+      return existing.nextSecret;
+    }
+    const nextSecret = crypto.randomBytes(32).toString('hex');
+    db.prepare(`
+      INSERT INTO agent_credentials (uuid, secret, next_secret) VALUES (?, ?, ?)
+      ON CONFLICT(uuid) DO UPDATE SET next_secret = excluded.next_secret
+    `).run(uuid, config.auth.key, nextSecret);
+    Info(`已为 Agent ${uuid} 生成新密钥, 等待其以新密钥认证`);
+    return nextSecret;
+  }
+
+  public completeRotation(uuid: string): void {
+    db.prepare(`
+      UPDATE agent_credentials SET secret = next_secret, next_secret = NULL, issued_at = CURRENT_TIMESTAMP
+      WHERE uuid = ? AND next_secret IS NOT NULL
+    `).run(uuid);
+    Info(`Agent ${uuid} 已启用新密钥, 旧密钥作废`);
+  }
+
+  // 吊销 Agent 的专属凭据，Agent 下次认证时收到 revoked 并需重新注册
+  public revoke(uuid: string): void {
+    db.prepare('UPDATE agent_credentials SET revoked = 1, revoked_at = CURRENT_TIMESTAMP WHERE uuid = ?').run(uuid);
+    Info(`已吊销 Agent ${uuid} 的专属凭据`);
+  }
+}
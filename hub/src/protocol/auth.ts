@@ -0,0 +1,43 @@
+import crypto from 'crypto';
+
+// 允许的时间戳偏差，同时也是挑战的有效期（毫秒），与 Agent 端 hubauth.DefaultWindow 一致
+export const AUTH_WINDOW_MS = 60 * 1000;
+
+// 生成一次性认证挑战
+export function createNonce(): string {
+  return crypto.randomBytes(16).toString('hex');
+}
+
+// HMAC-SHA256(key, nonce "\n" uuid "\n" timestamp)，与 Agent 端 protocol.AuthMAC 一致
+export function computeAuthMac(key: string, nonce: string, uuid: string, timestamp: number): string {
+  return crypto
+    .createHmac('sha256', key)
+    .update(`${nonce}\n${uuid}\n${timestamp}`)
+    .digest('hex');
+}
+
+export interface Challenge {
+  nonce: string;
+  issuedAt: number;
+}
+
+// 校验挑战应答，返回失败原因代码，通过时返回 null。调用方需保证挑战只被使用一次。
+export function verifyAuth(
+  key: string,
+  challenge: Challenge | undefined,
+  payload: { nonce?: string; uuid: string; timestamp?: number; mac?: string },
+): 'replay' | 'bad_key' | null {
+  const now = Date.now();
+  if (!challenge || challenge.nonce !== payload.nonce || now - challenge.issuedAt > AUTH_WINDOW_MS) {
+    return 'replay';
+  }
+  if (!payload.timestamp || Math.abs(now - payload.timestamp * 1000) > AUTH_WINDOW_MS) {
+    return 'replay';
+  }
+  const expected = Buffer.from(computeAuthMac(key, challenge.nonce, payload.uuid, payload.timestamp));
+  const actual = Buffer.from(payload.mac || '');
+  if (expected.length !== actual.length || !crypto.timingSafeEqual(expected, actual)) {
+    return 'bad_key';
+  }
+  return null;
+}
@@ -0,0 +1,134 @@
+import crypto from 'crypto';
+
+// 负载加密，与 Agent 端 protocol/encrypt.go 一致：
+// 加密的帧置 FLAG_ENCRYPTED，负载为 nonce(24) | XChaCha20-Poly1305 密文 | tag(16)，附加数据为完整的帧头部。
+// 会话密钥由 Agent 临时密钥分别与 Hub 临时密钥、Hub 长期密钥做 X25519 后经 HKDF-SHA256 派生。
+export const FLAG_ENCRYPTED = 0x0020;
+const NONCE_SIZE = 24;
+const TAG_SIZE = 16;
+const PAYLOAD_KEY_INFO = 'pbm payload encryption\n';
+
+// 原始 X25519 密钥与 DER 编码之间转换所用的前缀
+const X25519_SPKI_PREFIX = Buffer.from('302a300506032b656e032100', 'hex');
+const X25519_PKCS8_PREFIX = Buffer.from('302e020100300506032b656e04220420', 'hex');
+
+// 一个连接上两个方向的负载加密密钥
+export interface EncryptionSession {
+  send: Buffer; // Hub→Agent
+  recv: Buffer; // Agent→Hub
+}
+
+export class DecryptError extends Error {}
+
+// 读取 base64 编码的 X25519 私钥（32 字节）
+export function loadPrivateKey(base64: string): crypto.KeyObject {
+  const raw = Buffer.from(base64, 'base64');
+  if (raw.length !== 32) {
+    throw new Error('X25519 私钥应为 32 字节');
+  }
+  return crypto.createPrivateKey({ key: Buffer.concat([X25519_PKCS8_PREFIX, raw]), format: 'der', type: 'pkcs8' });
+}
+
+// 返回私钥对应的原始公钥
+export function rawPublicKey(key: crypto.KeyObject): Buffer {
+  const der = crypto.createPublicKey(key).export({ format: 'der', type: 'spki' });
+  return der.subarray(X25519_SPKI_PREFIX.length);
+}
+
+// 以 Hub 长期私钥响应 Agent 在 HELLO 中给出的临时公钥，返回 Hub 的临时公钥（base64）及会话密钥
+export function acceptKeyShare(hubKey: crypto.KeyObject, keyShare: string): { keyShare: string; session: EncryptionSession } {
+  const agentRaw = Buffer.from(keyShare, 'base64');
+  if (agentRaw.length !== 32) {
+    throw new Error('Agent 的临时公钥无效');
+  }
+  const agentKey = crypto.createPublicKey({ key: Buffer.concat([X25519_SPKI_PREFIX, agentRaw]), format: 'der', type: 'spki' });
+  const ephemeral = crypto.generateKeyPairSync('x25519');
+  const ephemeralRaw = rawPublicKey(ephemeral.privateKey);
+
+  const secret = Buffer.concat([
+    crypto.diffieHellman({ privateKey: ephemeral.privateKey, publicKey: agentKey }),
+    crypto.diffieHellman({ privateKey: hubKey, publicKey: agentKey }),
+  ]);
+  const info = Buffer.concat([Buffer.from(PAYLOAD_KEY_INFO), agentRaw, ephemeralRaw]);
+  const keys = Buffer.from(crypto.hkdfSync('sha256', secret, Buffer.alloc(0), info, 64));
+  return {
+    keyShare: ephemeralRaw.toString('base64'),
+    session: { recv: keys.subarray(0, 32), send: keys.subarray(32) },
+  };
+}
+
+// 加密已组装好的帧（头部与负载），置 FLAG_ENCRYPTED 并更新长度；须在签名之前调用
+export function encryptFrame(frame: Buffer, key: Buffer): Buffer {
+  const headerLen = frame.readUInt8(3);
+  const payload = frame.subarray(headerLen);
+  const header = Buffer.from(frame.subarray(0, headerLen));
+  header.writeUInt16BE(header.readUInt16BE(4) | FLAG_ENCRYPTED, 4);
+  header.writeUInt32BE(payload.length + NONCE_SIZE + TAG_SIZE, 8);
+
+  const nonce = crypto.randomBytes(NONCE_SIZE);
+  const cipher = crypto.createCipheriv('chacha20-poly1305', hchacha20(key, nonce), chachaNonce(nonce), { authTagLength: TAG_SIZE });
+  cipher.setAAD(header, { plaintextLength: payload.length });
+  const ciphertext = Buffer.concat([cipher.update(payload), cipher.final()]);
+  return Buffer.concat([header, nonce, ciphertext, cipher.getAuthTag()]);
+}
+
+// 解密负载，header 为线路上的完整头部；认证失败时抛出 DecryptError
+export function decryptPayload(header: Buffer, payload: Buffer, key: Buffer): Buffer {
+  if (payload.length < NONCE_SIZE + TAG_SIZE) {
+    throw new DecryptError('密文长度不足');
+  }
+  const nonce = payload.subarray(0, NONCE_SIZE);
+  const ciphertext = payload.subarray(NONCE_SIZE, payload.length - TAG_SIZE);
+  const decipher = crypto.createDecipheriv('chacha20-poly1305', hchacha20(key, nonce), chachaNonce(nonce), { authTagLength: TAG_SIZE });
+  decipher.setAAD(header, { plaintextLength: ciphertext.length });
+  decipher.setAuthTag(payload.subarray(payload.length - TAG_SIZE));
+  try {
+    return Buffer.concat([decipher.update(ciphertext), decipher.final()]);
+  } catch {
+    throw new DecryptError('负载解密失败');
+  }
+}
+
+// XChaCha20 以 HChaCha20(key, nonce[0:16]) 为子密钥，nonce[16:24] 前补 4 字节 0 作为 ChaCha20 的 nonce
+function chachaNonce(nonce: Buffer): Buffer {
+  return Buffer.concat([Buffer.alloc(4), nonce.subarray(16, 24)]);
+}
+
+function hchacha20(key: Buffer, nonce: Buffer): Buffer {
+  const s = new Uint32Array(16);
+  s[0] = 0x61707865;
+  s[1] = 0x3320646e;
+  s[2] = 0x79622d32;
+  s[3] = 0x6b206574;
+  for (let i = 0; i < 8; i++) {
+    s[4 + i] = key.readUInt32LE(4 * i);
+  }
+  for (let i = 0; i < 4; i++) {
+    s[12 + i] = nonce.readUInt32LE(4 * i);
+  }
+
+  const quarterRound = (a: number, b: number, c: number, d: number) => {
+    s[a] += s[b]; s[d] = rotl(s[d] ^ s[a], 16);
+    s[c] += s[d]; s[b] = rotl(s[b] ^ s[c], 12);
+    s[a] += s[b]; s[d] = rotl(s[d] ^ s[a], 8);
+    s[c] += s[d]; s[b] = rotl(s[b] ^ s[c], 7);
+  };
+  for (let i = 0; i < 10; i++) {
+    quarterRound(0, 4, 8, 12);
+    quarterRound(1, 5, 9, 13);
+    quarterRound(2, 6, 10, 14);
+    quarterRound(3, 7, 11, 15);
+    quarterRound(0, 5, 10, 15);
+    quarterRound(1, 6, 11, 12);
+    quarterRound(2, 7, 8, 13);
+    quarterRound(3, 4, 9, 14);
+  }
+
+  const out = Buffer.alloc(32);
+  [0, 1, 2, 3, 12, 13, 14, 15].forEach((word, i) => out.writeUInt32LE(s[word], 4 * i));
+  return out;
+}
+
+function rotl(v: number, n: number): number {
+  return ((v << n) | (v >>> (32 - n))) >>> 0;
+}
@@ -1,9 +1,29 @@
-import { Message, MessageHeader, MessageType } from './types';
+import { Message, MessageHeader, MessageType, MESSAGE_TYPE_CODES } from './types';
 import { Debug, Error } from '../logger';
+import { DecryptError, FLAG_ENCRYPTED, decryptPayload } from './encrypt';
+
+// 旧版 4 字节类型字段会截断超长的类型名
+const LEGACY_TYPES: Record<string, MessageType> = {
+  STAT: MessageType.STATIC_INFO,
+  CONF: MessageType.CONFIG,
+};
 
 export class MessageParser {
   private buffer: Buffer = Buffer.alloc(0);
-  private static HEADER_SIZE = 12; // 4(type) + 4(length) + 4(timestamp)
+  // 协商负载加密后 Agent→Hub 的密钥，此后收到的帧都必须加密
+  private cipher?: Buffer;
+  // v1: magic(2) + version(1) + headerLen(1) + flags(2) + type(2) + length(4) + timestamp(4)
+  private static FRAME_MAGIC = 0xb24d;
+  private static PROTOCOL_VERSION = 1;
+  private static HEADER_SIZE = 16;
+  private static LEGACY_HEADER_SIZE = 12; // 4(type) + 4(length) + 4(timestamp)
+  // 扩展字段按 tag(1) + len(1) + value 排列，见 Agent 端 protocol/frame.go
+  private static EXT_MESSAGE_ID = 0x02;
+  private static EXT_CORRELATE = 0x03;
+
+  public setCipher(key: Buffer): void {
+    this.cipher = key;
+  }
 
   public append(chunk: Buffer): void {
     this.buffer = Buffer.concat([this.buffer, chunk]);
@@ -11,14 +31,79 @@ export class MessageParser {
     Debug(`原始数据: ${chunk.toString('hex')}`);
   }
 
+  private isFrameV1(): boolean {
+    return this.buffer.length >= 2 && this.buffer.readUInt16BE(0) === MessageParser.FRAME_MAGIC;
+  }
+
+  // 读取消息头，数据不足时返回 null
+  private readHeader(): { header: MessageHeader; headerSize: number } | null {
+    if (this.isFrameV1()) {
+      if (this.buffer.length < MessageParser.HEADER_SIZE) {
+        Debug(`缓冲区大小不足消息头: ${this.buffer.length} < ${MessageParser.HEADER_SIZE}`);
+        return null;
+      }
+      const code = this.buffer.readUInt16BE(6);
+      const type = (Object.keys(MESSAGE_TYPE_CODES) as MessageType[])
+        .find(t => MESSAGE_TYPE_CODES[t] === code);
+      const headerSize = Math.max(this.buffer.readUInt8(3), MessageParser.HEADER_SIZE);
+      if (this.buffer.length < headerSize) {
+        return null;
+      }
+      const ext = this.buffer.subarray(MessageParser.HEADER_SIZE, headerSize);
+      return {
+        header: {
+          type: type ?? (`0x${code.toString(16)}` as MessageType),
+          version: this.buffer.readUInt8(2),
+          flags: this.buffer.readUInt16BE(4),
+          id: MessageParser.readExtension(ext, MessageParser.EXT_MESSAGE_ID),
+          correlationId: MessageParser.readExtension(ext, MessageParser.EXT_CORRELATE),
+          length: this.buffer.readUInt32BE(8),
+          timestamp: this.buffer.readUInt32BE(12),
+        },
+        headerSize,
+      };
+    }
+
+    if (this.buffer.length < MessageParser.LEGACY_HEADER_SIZE) {
+      Debug(`缓冲区大小不足消息头: ${this.buffer.length} < ${MessageParser.LEGACY_HEADER_SIZE}`);
+      return null;
+    }
+    const typeStr = this.buffer.toString('utf8', 0, 4).replace(/\0+$/, '');
+    return {
+      header: {
+        type: LEGACY_TYPES[typeStr] ?? (typeStr as MessageType),
+        version: 0,
+        flags: 0,
+        length: this.buffer.readUInt32BE(4),
+        timestamp: this.buffer.readUInt32BE(8),
+      },
+      headerSize: MessageParser.LEGACY_HEADER_SIZE,
+    };
+  }
+
+  // 从扩展字段中读取 uint64 类型的 tag，未携带时返回 undefined
+  private static readExtension(ext: Buffer, tag: number): number | undefined {
+    while (ext.length >= 2) {
+      const size = ext.readUInt8(1);
+      if (ext.length < 2 + size) {
+        return undefined;
+      }
+      if (ext.readUInt8(0) === tag && size === 8) {
+        return Number(ext.readBigUInt64BE(2));
+      }
+      ext = ext.subarray(2 + size);
+    }
+    return undefined;
+  }
+
   public hasCompleteMessage(): boolean {
-    if (this.buffer.length < MessageParser.HEADER_SIZE) {
-      Debug(`缓冲区大小不足消息头: ${this.buffer.length} < ${MessageParser.HEADER_SIZE}`);
+    const result = this.readHeader();
+    if (!result) {
       return false;
     }
 
-    const dataLength = this.buffer.readUInt32BE(4);
-    const hasComplete = this.buffer.length >= MessageParser.HEADER_SIZE + dataLength;
+    const dataLength = result.header.length;
+    const hasComplete = this.buffer.length >= result.headerSize + dataLength;
     Debug(`消息体长度: ${dataLength}, 当前缓冲区: ${this.buffer.length}, 是否完整: ${hasComplete}`);
     return hasComplete;
   }
@@ -30,24 +115,20 @@ export class MessageParser {
 
     try {
       // 解析消息头
-      const typeStr = this.buffer.toString('utf8', 0, 4);
-      const length = this.buffer.readUInt32BE(4);
-      const timestamp = this.buffer.readUInt32BE(8);
-
-      Debug(`解析消息头 - 类型: ${typeStr}, 长度: ${length}, 时间戳: ${timestamp}`);
-      Debug(`消息头原始数据: ${this.buffer.slice(0, MessageParser.HEADER_SIZE).toString('hex')}`);
-
-      const header: MessageHeader = {
-        type: typeStr as MessageType,
-        length,
-        timestamp,
-      };
-
-      // 解析消息体
-      const payloadBuffer = this.buffer.slice(
-        MessageParser.HEADER_SIZE,
-        MessageParser.HEADER_SIZE + length
-      );
+      const { header, headerSize } = this.readHeader()!;
+      const length = header.length;
+
+      Debug(`解析消息头 - 类型: ${header.type}, 版本: ${header.version}, 长度: ${length}, 时间戳: ${header.timestamp}`);
+      Debug(`消息头原始数据: ${this.buffer.slice(0, headerSize).toString('hex')}`);
+
+      // 解析消息体，加密的负载先解密，附加数据为完整头部
+      let payloadBuffer = this.buffer.slice(headerSize, headerSize + length);
+      if ((header.flags ?? 0) & FLAG_ENCRYPTED || this.cipher) {
+        if (!this.cipher || !((header.flags ?? 0) & FLAG_ENCRYPTED)) {
+          throw new DecryptError(this.cipher ? '已协商负载加密, 但收到未加密的帧' : '未协商负载加密, 但收到加密的帧');
+        }
+        payloadBuffer = decryptPayload(this.buffer.slice(0, headerSize), payloadBuffer, this.cipher);
+      }
       const payloadStr = payloadBuffer.toString('utf8');
       Debug(`原始消息体: ${payloadStr}`);
       
@@ -58,11 +139,12 @@ export class MessageParser {
       } catch (e) {
         Error(`JSON解析失败: ${e.message}`);
         Debug(`解析失败的消息体内容: ${payloadStr}`);
+        this.buffer = this.buffer.slice(headerSize + length);
         return null;
       }
 
       // 移除已解析的消息
-      this.buffer = this.buffer.slice(MessageParser.HEADER_SIZE + length);
+      this.buffer = this.buffer.slice(headerSize + length);
       Debug(`移除已解析消息后缓冲区大小: ${this.buffer.length}`);
 
       return { 
@@ -70,6 +152,11 @@ export class MessageParser {
         payload 
       };
     } catch (error) {
+      if (error instanceof DecryptError) {
+        // 未通过加密认证的帧可能遭到篡改，交由调用方断开连接
+        this.buffer = Buffer.alloc(0);
+        throw error;
+      }
       Error('解析消息失败:', error);
       Debug('当前缓冲区内容:', this.buffer.toString('hex'));
       // 清空缓冲区以防止错误累积
@@ -78,7 +165,8 @@ export class MessageParser {
     }
   }
 
-  public static createMessage(type: MessageType, payload: any): Buffer {
+  // correlationId 非空时写入关联 ID 扩展字段，用于回复 REQ
+  public static createMessage(type: MessageType, payload: any, correlationId?: number): Buffer {
     const payloadStr = JSON.stringify(payload);
     const payloadBuffer = Buffer.from(payloadStr, 'utf8');
     const length = payloadBuffer.length;
@@ -87,15 +175,25 @@ export class MessageParser {
     Debug(`创建消息 - 类型: ${type}, 长度: ${length}, 时间戳: ${timestamp}`);
     Debug(`消息体: ${payloadStr}`);
 
-    const buffer = Buffer.alloc(MessageParser.HEADER_SIZE + length);
+    const headerSize = MessageParser.HEADER_SIZE + (correlationId !== undefined ? 10 : 0);
+    const buffer = Buffer.alloc(headerSize + length);
     
-    // 写入消息头
-    buffer.write(type, 0, 4);
-    buffer.writeUInt32BE(length, 4);
-    buffer.writeUInt32BE(timestamp, 8);
+    // 写入 v1 消息头
+    buffer.writeUInt16BE(MessageParser.FRAME_MAGIC, 0);
+    buffer.writeUInt8(MessageParser.PROTOCOL_VERSION, 2);
+    buffer.writeUInt8(headerSize, 3);
+    buffer.writeUInt16BE(0, 4);
+    buffer.writeUInt16BE(MESSAGE_TYPE_CODES[type], 6);
+    buffer.writeUInt32BE(length, 8);
+    buffer.writeUInt32BE(timestamp, 12);
+    if (correlationId !== undefined) {
+      buffer.writeUInt8(MessageParser.EXT_CORRELATE, MessageParser.HEADER_SIZE);
+      buffer.writeUInt8(8, MessageParser.HEADER_SIZE + 1);
+      buffer.writeBigUInt64BE(BigInt(correlationId), MessageParser.HEADER_SIZE + 2);
+    }
     
     // 写入消息体
-    payloadBuffer.copy(buffer, MessageParser.HEADER_SIZE);
+    payloadBuffer.copy(buffer, headerSize);
 
     Debug(`完整消息内容: ${buffer.toString('hex')}`);
     return buffer;
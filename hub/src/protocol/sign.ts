@@ -0,0 +1,44 @@
+import crypto from 'crypto';
+
+// 帧签名，与 Agent 端 protocol/sign.go 一致：
+// 头部追加 SignSeq 扩展字段并置 FLAG_SIGNED，负载之后附加 algorithm(1) | len(1) | signature。
+// 签名覆盖加密后的负载，加密的帧须在 withSignSeq 与 appendSignature 之间加密。
+const FLAG_SIGNED = 0x0010;
+const EXT_SIGN_SEQ = 0x04;
+const SIGN_HMAC_SHA256 = 1;
+
+export interface SigningSession {
+  key: Buffer;
+  seq: bigint;
+}
+
+// 从认证密钥和会话挑战派生 HMAC 帧签名密钥，与 Agent 端 protocol.SessionSigningKey 一致
+export function sessionSigningKey(authKey: string, nonce: string): Buffer {
+  return crypto
+    .createHmac('sha256', authKey)
+    .update(`pbm frame signing\n${nonce}`)
+    .digest();
+}
+
+// 为 createMessage 生成的帧添加会话内递增的签名序号并置 FLAG_SIGNED
+export function withSignSeq(frame: Buffer, session: SigningSession): Buffer {
+  const headerLen = frame.readUInt8(3);
+  session.seq += 1n;
+
+  const ext = Buffer.alloc(10);
+  ext.writeUInt8(EXT_SIGN_SEQ, 0);
+  ext.writeUInt8(8, 1);
+  ext.writeBigUInt64BE(session.seq, 2);
+
+  const header = Buffer.concat([frame.subarray(0, headerLen), ext]);
+  header.writeUInt8(header.length, 3);
+  header.writeUInt16BE(header.readUInt16BE(4) | FLAG_SIGNED, 4);
+
+  return Buffer.concat([header, frame.subarray(headerLen)]);
+}
+
+// 为 withSignSeq 处理过的帧附加签名尾部
+export function appendSignature(frame: Buffer, session: SigningSession): Buffer {
+  const sig = crypto.createHmac('sha256', session.key).update(frame).digest();
+  return Buffer.concat([frame, Buffer.from([SIGN_HMAC_SHA256, sig.length]), sig]);
+}
@@ -7,11 +7,75 @@ export enum MessageType {
   TASK_RESULT = 'TRSLT',  // 任务结果
   TASK_REQUEST = 'TREQ',  // 任务请求
   CONFIG = 'CONFIG',      // 配置更新
+  ACK = 'ACK',            // 确认收到携带消息 ID 的消息
+  NACK = 'NACK',          // 拒绝携带消息 ID 的消息，Agent 收到后重传
+  REQUEST = 'REQ',        // Agent 发起的通用请求
+  RESPONSE = 'RESP',      // 对 REQ 的响应，携带相同的关联 ID
+  HELLO = 'HELLO',        // 能力协商
+  AUTH_OK = 'AUTH_OK',    // 认证成功
+  AUTH_FAIL = 'AUTH_FAIL', // 认证失败
+  ENROLL = 'ENROLL',      // 注册
+  ENROLL_OK = 'ENROLL_OK', // 注册成功，携带专属凭据
+  ROTATE = 'ROTATE',      // 下发新凭据
+}
+
+// v1 帧中消息类型的数字编码，需与 Agent 端 protocol/frame.go 保持一致
+export const MESSAGE_TYPE_CODES: Record<MessageType, number> = {
+  [MessageType.AUTH]: 0x0001,
+  [MessageType.HEARTBEAT]: 0x0002,
+  [MessageType.SYSTEM_INFO]: 0x0003,
+  [MessageType.STATIC_INFO]: 0x0004,
+  [MessageType.TASK_RESULT]: 0x0005,
+  [MessageType.TASK_REQUEST]: 0x0006,
+  [MessageType.CONFIG]: 0x0007,
+  [MessageType.ACK]: 0x0008,
+  [MessageType.NACK]: 0x0009,
+  [MessageType.REQUEST]: 0x000a,
+  [MessageType.RESPONSE]: 0x000b,
+  [MessageType.HELLO]: 0x000c,
+  [MessageType.AUTH_OK]: 0x000d,
+  [MessageType.AUTH_FAIL]: 0x000e,
+  [MessageType.ENROLL]: 0x000f,
+  [MessageType.ENROLL_OK]: 0x0010,
+  [MessageType.ROTATE]: 0x0011,
+};
+
+// AUTH_FAIL 的原因代码，除 replay 和 internal 外 Agent 收到后不再重连
+export type AuthFailReason = 'bad_key' | 'revoked' | 'banned' | 'version_too_old' | 'replay' | 'internal' | 'bad_token';
+
+// 注册消息，Agent 以一次性令牌换取专属凭据
+export interface EnrollPayload {
+  token: string;
+  uuid: string;
+  alias?: string;
+  csr?: string; // 可选的证书签名请求（PEM），Hub 目前只签发专属密钥
+}
+
+// ACK/NACK 消息，与 Agent 端 protocol.AckPayload 一致
+export interface AckPayload {
+  ids: number[];
+  reason?: string;
+}
+
+// 通用请求与响应，与 Agent 端 protocol.RequestPayload、protocol.ResponsePayload 一致；
+// error 非空表示请求失败
+export interface RequestPayload {
+  method: string;
+  params?: any;
+}
+
+export interface ResponsePayload {
+  result?: any;
+  error?: string;
 }
 
 // 消息头部接口
 export interface MessageHeader {
   type: MessageType;
+  version?: number;  // 帧格式版本，旧版头部为 0
+  flags?: number;    // 帧标志位
+  id?: number;       // 消息 ID 扩展字段，携带时需回复 ACK/NACK
+  correlationId?: number; // 关联 ID 扩展字段，REQ 携带，RESP 原样带回
   length: number;
   timestamp: number;
 }
@@ -22,6 +86,18 @@ export interface Message {
   payload: any;
 }
 
+// 能力协商消息，Hub 回复时 codecs、compression 的第一项为选定的编码格式和压缩算法
+export interface HelloPayload {
+  protocolVersion: number;
+  version?: string;
+  codecs: string[];
+  compression?: string[];
+  features?: string[];
+  maxFrameSize?: number;
+  nonce?: string; // Hub 下发的一次性认证挑战
+  keyShare?: string; // 负载加密的 X25519 临时公钥（base64）
+}
+
 // 系统信息接口
 export interface SystemInfo {
   networkTraffic: {
@@ -50,7 +126,20 @@ export interface SystemInfo {
     tcp: number;
     udp: number;
   };
+  link?: LinkStats; // 到 Hub 的链路质量，Agent 尚无统计时缺省
   uuid: string;
   ipv4: string[];
   ipv6: string[];
+}
+
+// Agent 以心跳回显测得的链路质量，时延单位为毫秒；平均、最小、最大时延及样本数、丢失数统计自上一次上报
+export interface LinkStats {
+  rtt: number;
+  rttAvg: number;
+  rttMin: number;
+  rttMax: number;
+  jitter: number;
+  samples: number;
+  lost: number;
+  encrypted?: boolean; // 当前连接是否协商了负载加密，旧版 Agent 不上报
 }
\ No newline at end of file
@@ -1,25 +1,56 @@
+import crypto from 'crypto';
 import net from 'net';
 import { config } from '../config';
 import { Debug, Info, Warn, Error } from '../logger';
 import { MessageParser } from '../protocol/parser';
-import { Message, MessageType } from '../protocol/types';
+import { AckPayload, AuthFailReason, EnrollPayload, HelloPayload, Message, MessageType, RequestPayload, ResponsePayload } from '../protocol/types';
+import { Challenge, createNonce, verifyAuth } from '../protocol/auth';
+import { SigningSession, appendSignature, sessionSigningKey, withSignSeq } from '../protocol/sign';
+import { EncryptionSession, acceptKeyShare, encryptFrame, loadPrivateKey, rawPublicKey } from '../protocol/encrypt';
 import { AgentManager } from '../managers/agent-manager';
+import { CredentialManager } from '../managers/credential-manager';
 import { db } from '../database';
 
+// Hub 目前只支持 JSON 负载、不压缩，以及任务下发、HMAC 帧签名、令牌注册、密钥轮换和心跳回显；
+// 配置了 X25519 私钥时还支持负载加密
+const SUPPORTED_CODECS = ['json'];
+const SUPPORTED_FEATURES = ['tasks', 'signing', 'enroll', 'rotate', 'echo', 'acks'];
+const MAX_FRAME_SIZE = 1 << 20;
+
 export class TCPServer {
   private server: net.Server;
   private server6?: net.Server;
   private clients: Map<string, net.Socket> = new Map();
   private parsers: Map<string, MessageParser> = new Map();
   private agentManager: AgentManager;
+  private credentialManager: CredentialManager;
   private authenticatedClients: Set<string> = new Set();
-
-  constructor(agentManager: AgentManager) {
+  // 已认证连接对应的 Agent UUID
+  private agentIds: Map<string, string> = new Map();
+  // 已下发但尚未使用的认证挑战
+  private challenges: Map<string, Challenge> = new Map();
+  // 各连接协商出的功能
+  private features: Map<string, string[]> = new Map();
+  // 协商了帧签名、但尚未确定签名密钥的连接及其会话挑战
+  private pendingSigning: Map<string, string> = new Map();
+  // 协商了帧签名的连接，HELLO 回复之后发出的帧都需签名
+  private signing: Map<string, SigningSession> = new Map();
+  // 协商了负载加密的连接及 Hub→Agent 的密钥，HELLO 回复之后双方的帧都需加密
+  private encryption: Map<string, Buffer> = new Map();
+  // Hub 的 X25519 长期私钥，未配置时不支持负载加密
+  private encryptionKey?: crypto.KeyObject;
+
+  constructor(agentManager: AgentManager, credentialManager: CredentialManager) {
     this.server = net.createServer(this.handleConnection.bind(this));
     if (config.hub.enableIPv6) {
       this.server6 = net.createServer(this.handleConnection.bind(this));
     }
     this.agentManager = agentManager;
+    this.credentialManager = credentialManager;
+    if (config.encryption.privateKey) {
+      this.encryptionKey = loadPrivateKey(config.encryption.privateKey);
+      Info(`已启用负载加密, Hub 公钥: ${rawPublicKey(this.encryptionKey).toString('base64')}`);
+    }
 
     // 添加服务器事件监听
     this.server.on('error', (error) => {
@@ -164,6 +195,12 @@ export class TCPServer {
 
     try {
       switch (message.header.type) {
+        case MessageType.HELLO:
+          this.handleHello(clientId, message);
+          break;
+        case MessageType.ENROLL:
+          this.handleEnroll(clientId, message);
+          break;
         case MessageType.AUTH:
           this.handleAuth(clientId, message);
           break;
@@ -176,32 +213,166 @@ export class TCPServer {
         case MessageType.TASK_RESULT:
           this.handleTaskResult(clientId, message);
           break;
+        case MessageType.REQUEST:
+          this.handleRequest(clientId, message);
+          break;
         default:
           Warn(`未知的消息类型: ${message.header.type}`);
       }
+      this.acknowledge(clientId, message, MessageType.ACK);
     } catch (error) {
       Error(`处理消息时发生错误 - 客户端: ${clientId}, 类型: ${message.header.type}:`, error);
+      this.acknowledge(clientId, message, MessageType.NACK, String(error));
+    }
+  }
+
+  // 协商了消息确认时，对已认证连接上携带消息 ID 的消息回复 ACK（已处理）或 NACK（处理失败，Agent 重传）
+  private acknowledge(clientId: string, message: Message, type: MessageType.ACK | MessageType.NACK, reason?: string): void {
+    const id = message.header.id;
+    const socket = this.clients.get(clientId);
+    if (id === undefined || !socket || !this.authenticatedClients.has(clientId) || !this.features.get(clientId)?.includes('acks')) {
+      return;
+    }
+    const payload: AckPayload = { ids: [id], reason };
+    socket.write(this.frame(clientId, MessageParser.createMessage(type, payload)));
+  }
+
+  // 从 Agent 通告的能力中选出 Hub 支持的子集并回复
+  private handleHello(clientId: string, message: Message): void {
+    const hello = message.payload as HelloPayload;
+    const codec = (hello.codecs || []).find(c => SUPPORTED_CODECS.includes(c)) || 'json';
+    const reply: HelloPayload = {
+      protocolVersion: Math.min(hello.protocolVersion || 1, 1),
+      codecs: [codec],
+      compression: [],
+      features: (hello.features || []).filter(f => SUPPORTED_FEATURES.includes(f)),
+      maxFrameSize: MAX_FRAME_SIZE,
+      nonce: createNonce(),
+    };
+
+    // Agent 给出临时公钥时以 Hub 长期私钥完成密钥交换
+    let session: EncryptionSession | undefined;
+    if (this.encryptionKey && hello.features?.includes('encryption') && hello.keyShare) {
+      try {
+        const exchange = acceptKeyShare(this.encryptionKey, hello.keyShare);
+        session = exchange.session;
+        reply.keyShare = exchange.keyShare;
+        reply.features!.push('encryption');
+      } catch (error) {
+        Warn(`客户端 ${clientId} 的负载加密密钥交换失败, 不加密:`, error);
+      }
+    }
+    this.challenges.set(clientId, { nonce: reply.nonce!, issuedAt: Date.now() });
+    this.features.set(clientId, reply.features || []);
+    Info(`客户端 ${clientId} 握手: Agent 版本 ${hello.version}, 协商功能 ${reply.features?.join(',')}`);
+
+    const socket = this.clients.get(clientId);
+    if (socket) {
+      socket.write(MessageParser.createMessage(MessageType.HELLO, reply));
+    }
+    if (session) {
+      this.parsers.get(clientId)?.setCipher(session.recv);
+      this.encryption.set(clientId, session.send);
+    }
+    if (reply.features?.includes('signing')) {
+      this.pendingSigning.set(clientId, reply.nonce!);
+    }
+  }
+
+  // 签名密钥由 Agent 认证所用的密钥派生，收到 ENROLL 或 AUTH 后才能确定；
+  // 一个连接上只以第一次确定的密钥签名，与 Agent 端在握手时确定的密钥一致
+  private startSigning(clientId: string, key: string): void {
+    const nonce = this.pendingSigning.get(clientId);
+    if (nonce === undefined) {
+      return;
+    }
+    this.pendingSigning.delete(clientId);
+    this.signing.set(clientId, { key: sessionSigningKey(key, nonce), seq: 0n });
+  }
+
+  // 按连接协商结果为帧加密和签名，签名覆盖密文
+  private frame(clientId: string, frame: Buffer): Buffer {
+    const session = this.signing.get(clientId);
+    const key = this.encryption.get(clientId);
+    if (session) {
+      frame = withSignSeq(frame, session);
+    }
+    if (key) {
+      frame = encryptFrame(frame, key);
+    }
+    return session ? appendSignature(frame, session) : frame;
+  }
+
+  // 以一次性令牌为 Agent 签发专属密钥，Agent 随后在同一连接上以该密钥认证
+  private handleEnroll(clientId: string, message: Message): void {
+    const { token, uuid, alias } = message.payload as EnrollPayload;
+    Debug(`处理注册消息 - 客户端: ${clientId}, UUID: ${uuid}`);
+    this.startSigning(clientId, token || '');
+
+    const socket = this.clients.get(clientId);
+    if (!socket) {
+      return;
+    }
+    const secret = uuid ? this.credentialManager.enroll(token, uuid) : null;
+    if (!secret) {
+      Warn(`客户端 ${clientId} (UUID: ${uuid}) 注册失败: 令牌无效或已被使用`);
+      socket.end(this.frame(clientId, MessageParser.createMessage(MessageType.AUTH_FAIL, { reason: 'bad_token' })));
+      return;
     }
+    Info(`客户端 ${clientId} (UUID: ${uuid}, Alias: ${alias}) 注册成功`);
+    // 同时下发 Hub 的加密公钥，Agent 此后无需配置即可加密负载
+    const encryptionKey = this.encryptionKey ? rawPublicKey(this.encryptionKey).toString('base64') : undefined;
+    socket.write(this.frame(clientId, MessageParser.createMessage(MessageType.ENROLL_OK, { secret, encryptionKey })));
   }
 
   private handleAuth(clientId: string, message: Message): void {
-    Debug(`处理认证消息 - 客户端: ${clientId}
-    - 负载: ${JSON.stringify(message.payload, null, 2)}`);
-    
-    const { key, uuid, alias } = message.payload;
-    
-    if (key === config.auth.key) {
+    const { key, uuid, alias, mac } = message.payload;
+    Debug(`处理认证消息 - 客户端: ${clientId}, UUID: ${uuid}, 方式: ${mac ? '挑战-应答' : '明文密钥'}`);
+
+    // 挑战只能使用一次，无论认证是否通过
+    const challenge = this.challenges.get(clientId);
+    this.challenges.delete(clientId);
+
+    // 已注册的 Agent 只接受专属凭据；轮换期间新旧密钥都可通过认证
+    const credential = this.credentialManager.getCredential(uuid);
+    const candidates = credential
+      ? [credential.secret, credential.nextSecret].filter((k): k is string => !!k)
+      : [config.auth.key];
+    let authKey = candidates[0];
+
+    let failReason: AuthFailReason | null = 'bad_key';
+    if (credential?.revoked) {
+      failReason = 'revoked';
+    } else if (mac || config.auth.allowPlaintextKey) {
+      for (const candidate of candidates) {
+        const reason = mac ? verifyAuth(candidate, challenge, message.payload) : key === candidate ? null : 'bad_key';
+        if (reason !== 'bad_key') {
+          failReason = reason;
+          authKey = candidate;
+          break;
+        }
+      }
+    }
+    this.startSigning(clientId, authKey);
+
+    if (!failReason) {
       Info(`客户端 ${clientId} (UUID: ${uuid}, Alias: ${alias}) 认证成功`);
+      if (credential?.nextSecret && authKey === credential.nextSecret) {
+        this.credentialManager.completeRotation(uuid);
+      }
       
       const socket = this.clients.get(clientId);
       if (socket) {
         // 将客户端标记为已认证
         this.authenticatedClients.add(clientId);
+        this.agentIds.set(clientId, uuid);
         Debug(`客户端 ${clientId} 已添加到认证列表`);
         
         // 认证成功后设置正常的超时时间
         socket.setTimeout(60000);
         Debug(`已更新客户端 ${clientId} 的超时时间为 60 秒`);
+
+        socket.write(this.frame(clientId, MessageParser.createMessage(MessageType.AUTH_OK, {})));
         
         const ipAddress = clientId.split(':')[0];
         this.agentManager.registerAgent(uuid, ipAddress);
@@ -214,7 +385,7 @@ export class TCPServer {
           - 消息长度: ${configMessage.length} 字节
           - 消息内容: ${configMessage.toString('hex')}`);
           
-          socket.write(configMessage, (error) => {
+          socket.write(this.frame(clientId, configMessage), (error) => {
             if (error) {
               Error(`发送配置消息到 Agent ${uuid} 失败:`, error);
             } else {
@@ -224,14 +395,20 @@ export class TCPServer {
         } catch (error) {
           Error(`准备配置消息时发生错误 - Agent ${uuid}:`, error);
         }
+
+        // 密钥到期时下发新密钥，Agent 以新密钥重连成功后旧密钥才作废
+        if (this.features.get(clientId)?.includes('rotate') && this.credentialManager.rotationDue(uuid)) {
+          const secret = this.credentialManager.beginRotation(uuid);
+          socket.write(this.frame(clientId, MessageParser.createMessage(MessageType.ROTATE, { secret })));
+          Info(`已向 Agent ${uuid} 下发新密钥`);
+        }
       }
     } else {
-      Warn(`客户端 ${clientId} 认证失败: 密钥不匹配
-      - 期望的密钥: ${config.auth.key}
-      - 收到的密钥: ${key}`);
+      Warn(`客户端 ${clientId} (UUID: ${uuid}) 认证失败: ${failReason}`);
       const socket = this.clients.get(clientId);
       if (socket) {
-        socket.destroy();
+        // 告知 Agent 失败原因后再关闭连接，避免其无休止地重连
+        socket.end(this.frame(clientId, MessageParser.createMessage(MessageType.AUTH_FAIL, { reason: failReason })));
       }
     }
   }
@@ -245,6 +422,12 @@ export class TCPServer {
     const { uuid } = message.payload;
     Debug(`收到来自 ${uuid} 的心跳消息 - 客户端: ${clientId}`);
     this.agentManager.updateAgentStatus(uuid, 'online');
+
+    // 协商了心跳回显时原样发回，Agent 据此检测存活并测量往返时延
+    const socket = this.clients.get(clientId);
+    if (socket && this.features.get(clientId)?.includes('echo')) {
+      socket.write(this.frame(clientId, MessageParser.createMessage(MessageType.HEARTBEAT, message.payload)));
+    }
   }
 
   private handleSystemInfo(clientId: string, message: Message): void {
@@ -289,6 +472,38 @@ export class TCPServer {
       Debug(`已更新任务 ${taskId} 的结果到数据库`);
     } catch (error) {
       Error(`更新任务 ${taskId} 结果失败:`, error);
+      // 交由 handleMessage 回复 NACK，Agent 稍后重传
+      throw error;
+    }
+  }
+
+  // 处理 Agent 的通用请求，以 RESP 带回相同的关联 ID；未知的方法在 error 中说明
+  private handleRequest(clientId: string, message: Message): void {
+    const uuid = this.agentIds.get(clientId);
+    if (!uuid) {
+      Warn(`未认证的客户端 ${clientId} 发送请求`);
+      return;
+    }
+    const correlationId = message.header.correlationId;
+    if (correlationId === undefined) {
+      Warn(`客户端 ${clientId} 的请求缺少关联 ID, 无法回复`);
+      return;
+    }
+
+    const { method } = message.payload as RequestPayload;
+    Debug(`收到请求 - 客户端: ${clientId}, 方法: ${method}, 关联 ID: ${correlationId}`);
+    let response: ResponsePayload;
+    switch (method) {
+      case 'config':
+        response = { result: this.agentManager.getAgent(uuid)?.config };
+        break;
+      default:
+        response = { error: `未知的方法: ${method}` };
+    }
+
+    const socket = this.clients.get(clientId);
+    if (socket) {
+      socket.write(this.frame(clientId, MessageParser.createMessage(MessageType.RESPONSE, response, correlationId)));
     }
   }
 
@@ -305,6 +520,12 @@ export class TCPServer {
       }
 
       this.authenticatedClients.delete(clientId);
+      this.agentIds.delete(clientId);
+      this.challenges.delete(clientId);
+      this.features.delete(clientId);
+      this.pendingSigning.delete(clientId);
+      this.signing.delete(clientId);
+      this.encryption.delete(clientId);
       this.clients.delete(clientId);
       this.parsers.delete(clientId);
       Debug(`已清理客户端 ${clientId} 的所有相关资源`);
@@ -347,6 +568,7 @@ export class TCPServer {
         this.clients.delete(clientId);
         this.parsers.delete(clientId);
         this.authenticatedClients.delete(clientId);
+        this.agentIds.delete(clientId);
       }
 
       Info('所有客户端连接已关闭');